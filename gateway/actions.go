@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"runtime/debug"
+	"time"
+)
+
+// actionTimeout bounds a whole callback run, including the YOLO round trip
+const actionTimeout = 60 * time.Second
+
+// Action results stored on the alert that triggered them
+const (
+	actionQueued    = "queued"
+	actionSucceeded = "succeeded"
+	actionFailed    = "failed"
+)
+
+// errActionQueued is returned by an action that handed its work off to a queue after recording itself as queued on
+// the alert. The queue records the final result, so executeCallback leaves the alert alone.
+var errActionQueued = errors.New("action queued")
+
+// ActionContext carries everything a callback may need about what triggered it.
+// EventID, Data, Rule and AlertID are zero when the callback is not run on behalf of a rule, e.g. a test run.
+type ActionContext struct {
+	context.Context
+
+	DB       *sql.DB
+	ClientID string
+	EventID  int64
+	Data     map[string]interface{}
+	Rule     *Rule
+	AlertID  int64
+}
+
+// Action is a callback rules can run when they match
+type Action interface {
+	Run(ac *ActionContext) error
+}
+
+// ActionFunc adapts a plain function to the Action interface
+type ActionFunc func(ac *ActionContext) error
+
+// Run calls f(ac)
+func (f ActionFunc) Run(ac *ActionContext) error {
+	return f(ac)
+}
+
+// Run performs a registry callback
+func (action CallbackAction) Run(ac *ActionContext) error {
+	return runCallbackAction(ac, action)
+}
+
+// resolveAction returns the built-in callback from StubStorage or, failing that, the callback of that name from the registry
+func resolveAction(db *sql.DB, name string) (Action, error) {
+	if action, ok := StubStorage[name]; ok {
+		return action, nil
+	}
+	action, err := getCallbackActionByName(db, name)
+	if err != nil {
+		return nil, fmt.Errorf("callback %s: %w", name, err)
+	}
+	return action, nil
+}
+
+// executeCallback runs the named callback and reports the outcome on the alert, if there is one.
+// A panicking callback is recovered and reported as an error instead of taking the gateway down.
+// A callback that was queued is not an error, its outcome is reported by the queue.
+func executeCallback(ac *ActionContext, name string) (err error) {
+	if ac.Context == nil {
+		ctx, cancel := context.WithTimeout(context.Background(), actionTimeout)
+		defer cancel()
+		ac.Context = ctx
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("Callback %s panicked: %v\n%s", name, r, debug.Stack())
+			err = fmt.Errorf("callback %s panicked: %v", name, r)
+		}
+		if errors.Is(err, errActionQueued) {
+			err = nil
+			return
+		}
+		if err != nil {
+			log.Printf("Error running callback %s for %s: %v\n", name, ac.ClientID, err)
+		}
+		if ac.AlertID != 0 {
+			recordActionResult(ac.DB, ac.AlertID, name, err)
+		}
+	}()
+
+	action, err := resolveAction(ac.DB, name)
+	if err != nil {
+		return err
+	}
+	return action.Run(ac)
+}
+
+// recordActionResult stores the outcome of the latest callback run on an alert
+func recordActionResult(db *sql.DB, alertID int64, name string, err error) {
+	status, errMsg := actionSucceeded, ""
+	if err != nil {
+		status, errMsg = actionFailed, err.Error()
+	}
+	recordActionStatus(db, alertID, name, status, errMsg)
+}
+
+// recordActionStatus stores the status of the latest callback run on an alert
+func recordActionStatus(db *sql.DB, alertID int64, name string, status string, errMsg string) {
+	_, dbErr := db.Exec(
+		"UPDATE alerts SET action_name = ?, action_status = ?, action_error = ?, action_at = ? WHERE id = ?",
+		name, status, errMsg, time.Now().Unix(), alertID,
+	)
+	if dbErr != nil {
+		log.Printf("Error recording callback result on alert %d: %v\n", alertID, dbErr)
+	}
+}
@@ -0,0 +1,140 @@
+// This file holds the policies applied when a rule matches: deduplication of identical open alerts,
+// cooldown windows that stop a rule from firing over and over, and escalation to the next contact tier
+// when nobody acknowledges an alert in time.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Cooldown scopes. A "device" cooldown is tracked separately for every device the rule matches,
+// a "rule" cooldown silences the rule for all devices once it has fired.
+const (
+	cooldownPerDevice = "device"
+	cooldownPerRule   = "rule"
+)
+
+// EscalationTier notifies more channels when an alert is still open after AfterMinutes
+type EscalationTier struct {
+	AfterMinutes int      `json:"after_minutes"`
+	Notify       []string `json:"notify"`
+}
+
+// findDuplicateAlert returns the ID of an open alert raised by the same rule for the same device, or 0.
+// Acknowledged alerts are left out so a condition that is still there fires again once the cooldown has passed.
+func findDuplicateAlert(db *sql.DB, ruleID int, clientID string) (int64, error) {
+	var alertID int64
+	err := db.QueryRow(
+		"SELECT id FROM alerts WHERE rule_id = ? AND client_id = ? AND state = ? ORDER BY id DESC LIMIT 1",
+		ruleID, clientID, alertOpen,
+	).Scan(&alertID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return alertID, err
+}
+
+// recordAlertOccurrence counts another match of the condition that raised an existing alert
+func recordAlertOccurrence(db *sql.DB, alertID int64) error {
+	_, err := db.Exec("UPDATE alerts SET occurrences = occurrences + 1, last_seen_at = ? WHERE id = ?", time.Now().Unix(), alertID)
+	return err
+}
+
+// inCooldown reports whether the rule fired within its cooldown window, for this device or for any device depending on the scope
+func inCooldown(db *sql.DB, rule Rule, clientID string) (bool, error) {
+	if rule.CooldownSeconds <= 0 {
+		return false, nil
+	}
+
+	query := "SELECT MAX(COALESCE(last_seen_at, created_at)) FROM alerts WHERE rule_id = ?"
+	args := []interface{}{rule.RuleID}
+	if rule.CooldownScope != cooldownPerRule {
+		query += " AND client_id = ?"
+		args = append(args, clientID)
+	}
+
+	var lastFired sql.NullInt64
+	if err := db.QueryRow(query, args...).Scan(&lastFired); err != nil {
+		return false, err
+	}
+	if !lastFired.Valid {
+		return false, nil
+	}
+	return time.Since(time.Unix(lastFired.Int64, 0)) < time.Duration(rule.CooldownSeconds)*time.Second, nil
+}
+
+// validateAlertPolicy checks the cooldown and escalation settings of a rule
+func validateAlertPolicy(db *sql.DB, rule Rule) error {
+	if rule.CooldownSeconds < 0 {
+		return fmt.Errorf("cooldown_seconds must not be negative")
+	}
+	if rule.CooldownScope != "" && rule.CooldownScope != cooldownPerDevice && rule.CooldownScope != cooldownPerRule {
+		return fmt.Errorf("invalid cooldown_scope: %s", rule.CooldownScope)
+	}
+
+	previous := 0
+	for i, tier := range rule.Escalation {
+		if tier.AfterMinutes <= previous {
+			return fmt.Errorf("escalation tier %d must come after %d minutes", i+1, previous)
+		}
+		if len(tier.Notify) == 0 {
+			return fmt.Errorf("escalation tier %d has no channels to notify", i+1)
+		}
+		for _, name := range tier.Notify {
+			if _, err := getChannelByName(db, name); errors.Is(err, errChannelNotFound) {
+				return fmt.Errorf("unknown notification channel in escalation tier %d: %s", i+1, name)
+			} else if err != nil {
+				return err
+			}
+		}
+		previous = tier.AfterMinutes
+	}
+	return nil
+}
+
+// escalateAlerts notifies the next contact tier of every open alert that has not been acknowledged within the tier's window
+func escalateAlerts(db *sql.DB) {
+	alerts, err := queryAlerts(db, "SELECT "+alertColumns+" FROM alerts WHERE state = ? AND rule_id IS NOT NULL", alertOpen)
+	if err != nil {
+		log.Printf("Error loading alerts to escalate: %v\n", err)
+		return
+	}
+
+	for _, alert := range alerts {
+		rule, err := getRule(db, *alert.RuleID)
+		if errors.Is(err, errRuleNotFound) {
+			continue
+		} else if err != nil {
+			log.Printf("Error loading rule %d for alert %d: %v\n", *alert.RuleID, alert.ID, err)
+			continue
+		}
+		if alert.EscalationLevel >= len(rule.Escalation) {
+			continue
+		}
+
+		tier := rule.Escalation[alert.EscalationLevel]
+		if time.Since(alert.createdAt) < time.Duration(tier.AfterMinutes)*time.Minute {
+			continue
+		}
+
+		// Claim the level first so a slow delivery is never escalated twice
+		result, err := db.Exec("UPDATE alerts SET escalation_level = ? WHERE id = ? AND escalation_level = ?", alert.EscalationLevel+1, alert.ID, alert.EscalationLevel)
+		if err := expectOneRow(result, err, errAlertNotFound); err != nil {
+			continue
+		}
+
+		log.Printf("Escalating alert %d to tier %d\n", alert.ID, alert.EscalationLevel+1)
+		notifyChannels(db, tier.Notify, Notification{
+			AlertID:  alert.ID,
+			RuleID:   int64(rule.RuleID),
+			ClientID: alert.ClientID,
+			Subject:  fmt.Sprintf("%s (not acknowledged after %d minutes)", notificationSubject, tier.AfterMinutes),
+			Message:  fmt.Sprintf("Device %s: %s", alert.ClientID, alert.Message),
+		})
+	}
+}
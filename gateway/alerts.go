@@ -0,0 +1,290 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/url"
+	"time"
+)
+
+// Alert states. An alert starts open, can be acknowledged by an operator and is finally resolved,
+// either by hand or automatically once its condition has not been seen for longer than alertExpiry.
+const (
+	alertOpen         = "open"
+	alertAcknowledged = "acknowledged"
+	alertResolved     = "resolved"
+	alertExpired      = "expired"
+)
+
+// alertExpiry is how long an alert stays open or acknowledged after its last occurrence before it is auto-expired
+const alertExpiry = 24 * time.Hour
+
+var (
+	// errAlertNotFound is returned when an alert ID does not exist
+	errAlertNotFound = errors.New("alert not found")
+	// errInvalidTransition is returned when an alert is not in a state it can be moved out of
+	errInvalidTransition = errors.New("invalid alert state transition")
+)
+
+// Alert struct to hold a row of the alerts table
+type Alert struct {
+	ID             int64  `json:"id"`
+	Type           string `json:"alert_type"`
+	ClientID       string `json:"client_id"`
+	RuleID         *int64 `json:"rule_id"`
+	EventID        *int64 `json:"event_id"`
+	Message        string `json:"message"`
+	State          string `json:"state"`
+	Timestamp      string `json:"timestamp"`
+	AcknowledgedBy string `json:"acknowledged_by,omitempty"`
+	AcknowledgedAt string `json:"acknowledged_at,omitempty"`
+	ResolvedBy     string `json:"resolved_by,omitempty"`
+	ResolvedAt     string `json:"resolved_at,omitempty"`
+
+	// Occurrences counts how often the condition matched while the alert was open, LastSeen is the latest match
+	Occurrences     int    `json:"occurrences"`
+	LastSeen        string `json:"last_seen"`
+	EscalationLevel int    `json:"escalation_level"`
+
+	// The outcome of the latest callback run for this alert, empty until the callback has finished
+	ActionName   string `json:"action_name,omitempty"`
+	ActionStatus string `json:"action_status,omitempty"`
+	ActionError  string `json:"action_error,omitempty"`
+	ActionAt     string `json:"action_at,omitempty"`
+
+	// SnapshotHash names the camera image captured when the alert was raised, see snapshots.go
+	SnapshotHash string `json:"snapshot,omitempty"`
+
+	createdAt time.Time
+}
+
+// alertColumns is the column list matching scanAlert
+const alertColumns = "id, type, client_id, rule_id, event_id, message, state, created_at, acknowledged_by, acknowledged_at, resolved_by, resolved_at, occurrences, last_seen_at, escalation_level, action_name, action_status, action_error, action_at, snapshot_hash"
+
+func scanAlert(row scanner) (Alert, error) {
+	var alert Alert
+	var ruleID, eventID, acknowledgedAt, resolvedAt, lastSeenAt, actionAt sql.NullInt64
+	var acknowledgedBy, resolvedBy, actionName, actionStatus, actionError, snapshotHash sql.NullString
+	var createdAt int64
+	if err := row.Scan(&alert.ID, &alert.Type, &alert.ClientID, &ruleID, &eventID, &alert.Message, &alert.State, &createdAt, &acknowledgedBy, &acknowledgedAt, &resolvedBy, &resolvedAt, &alert.Occurrences, &lastSeenAt, &alert.EscalationLevel, &actionName, &actionStatus, &actionError, &actionAt, &snapshotHash); err != nil {
+		return alert, err
+	}
+	alert.createdAt = time.Unix(createdAt, 0)
+	alert.Timestamp = formatTimestamp(createdAt)
+	alert.LastSeen = alert.Timestamp
+	if lastSeenAt.Valid {
+		alert.LastSeen = formatTimestamp(lastSeenAt.Int64)
+	}
+	if ruleID.Valid {
+		alert.RuleID = &ruleID.Int64
+	}
+	if eventID.Valid {
+		alert.EventID = &eventID.Int64
+	}
+	alert.AcknowledgedBy = acknowledgedBy.String
+	if acknowledgedAt.Valid {
+		alert.AcknowledgedAt = formatTimestamp(acknowledgedAt.Int64)
+	}
+	alert.ResolvedBy = resolvedBy.String
+	if resolvedAt.Valid {
+		alert.ResolvedAt = formatTimestamp(resolvedAt.Int64)
+	}
+	alert.ActionName = actionName.String
+	alert.ActionStatus = actionStatus.String
+	alert.ActionError = actionError.String
+	if actionAt.Valid {
+		alert.ActionAt = formatTimestamp(actionAt.Int64)
+	}
+	alert.SnapshotHash = snapshotHash.String
+	return alert, nil
+}
+
+func formatTimestamp(unix int64) string {
+	return time.Unix(unix, 0).Format("2006-01-02 15:04:05")
+}
+
+// nullableID maps a zero ID to NULL so optional foreign keys are stored correctly
+func nullableID(id int64) interface{} {
+	if id == 0 {
+		return nil
+	}
+	return id
+}
+
+// createAlert stores a new open alert and returns its ID. ruleID and eventID are optional and may be 0.
+func createAlert(db *sql.DB, alertType string, clientID string, ruleID int64, eventID int64, message string) (int64, error) {
+	now := time.Now().Unix()
+	result, err := db.Exec(
+		"INSERT INTO alerts (type, client_id, rule_id, event_id, message, state, created_at, occurrences, last_seen_at) VALUES (?, ?, ?, ?, ?, ?, ?, 1, ?)",
+		alertType, clientID, nullableID(ruleID), nullableID(eventID), message, alertOpen, now, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+func getAlert(db *sql.DB, id int64) (Alert, error) {
+	alert, err := scanAlert(db.QueryRow("SELECT "+alertColumns+" FROM alerts WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return alert, errAlertNotFound
+	}
+	return alert, err
+}
+
+// listActiveAlerts returns the open and acknowledged alerts, newest first
+func listActiveAlerts(db *sql.DB) ([]Alert, error) {
+	return queryAlerts(db, "SELECT "+alertColumns+" FROM alerts WHERE state IN (?, ?) ORDER BY id DESC", alertOpen, alertAcknowledged)
+}
+
+// listAlertHistory returns one page of alerts, newest first, optionally filtered by state and client ID.
+// It also returns the total number of matching alerts so callers can paginate.
+func listAlertHistory(db *sql.DB, state string, clientID string, page int, pageSize int) ([]Alert, int, error) {
+	where := " WHERE 1 = 1"
+	var args []interface{}
+	if state != "" {
+		where += " AND state = ?"
+		args = append(args, state)
+	}
+	if clientID != "" {
+		where += " AND client_id = ?"
+		args = append(args, clientID)
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM alerts"+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	args = append(args, pageSize, (page-1)*pageSize)
+	alerts, err := queryAlerts(db, "SELECT "+alertColumns+" FROM alerts"+where+" ORDER BY id DESC LIMIT ? OFFSET ?", args...)
+	return alerts, total, err
+}
+
+// AlertFilter selects alerts for exports. Zero values do not filter.
+type AlertFilter struct {
+	State    string
+	ClientID string
+	Type     string
+	From, To int64 // created_at range in Unix seconds, To is exclusive
+}
+
+// parseAlertFilter reads an AlertFilter from the query parameters state, client_id, type, from and to
+func parseAlertFilter(query url.Values) (AlertFilter, error) {
+	filter := AlertFilter{State: query.Get("state"), ClientID: query.Get("client_id"), Type: query.Get("type")}
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from")); err != nil {
+		return filter, fmt.Errorf("invalid from: %v", err)
+	}
+	if filter.To, err = parseTimeParam(query.Get("to")); err != nil {
+		return filter, fmt.Errorf("invalid to: %v", err)
+	}
+	return filter, nil
+}
+
+// eachAlert calls fn for every alert matching the filter, oldest first, without loading them all into memory
+func eachAlert(db *sql.DB, filter AlertFilter, fn func(Alert) error) error {
+	where := " WHERE 1 = 1"
+	var args []interface{}
+	for column, value := range map[string]string{"state": filter.State, "client_id": filter.ClientID, "type": filter.Type} {
+		if value != "" {
+			where += " AND " + column + " = ?"
+			args = append(args, value)
+		}
+	}
+	if filter.From != 0 {
+		where += " AND created_at >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != 0 {
+		where += " AND created_at < ?"
+		args = append(args, filter.To)
+	}
+
+	rows, err := db.Query("SELECT "+alertColumns+" FROM alerts"+where+" ORDER BY id", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(alert); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func queryAlerts(db *sql.DB, query string, args ...interface{}) ([]Alert, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	alerts := []Alert{}
+	for rows.Next() {
+		alert, err := scanAlert(rows)
+		if err != nil {
+			return nil, err
+		}
+		alerts = append(alerts, alert)
+	}
+	return alerts, rows.Err()
+}
+
+// acknowledgeAlert marks an open alert as acknowledged by the given user
+func acknowledgeAlert(db *sql.DB, id int64, user string) error {
+	result, err := db.Exec(
+		"UPDATE alerts SET state = ?, acknowledged_by = ?, acknowledged_at = ? WHERE id = ? AND state = ?",
+		alertAcknowledged, user, time.Now().Unix(), id, alertOpen,
+	)
+	return alertTransitionResult(db, id, "acknowledged", result, err)
+}
+
+// resolveAlert marks an open or acknowledged alert as resolved by the given user
+func resolveAlert(db *sql.DB, id int64, user string) error {
+	result, err := db.Exec(
+		"UPDATE alerts SET state = ?, resolved_by = ?, resolved_at = ? WHERE id = ? AND state IN (?, ?)",
+		alertResolved, user, time.Now().Unix(), id, alertOpen, alertAcknowledged,
+	)
+	return alertTransitionResult(db, id, "resolved", result, err)
+}
+
+// alertTransitionResult checks the outcome of a conditional state change. When no row changed, the alert does not
+// exist or was not in a state it could leave, possibly because another user or expireAlerts moved it first.
+func alertTransitionResult(db *sql.DB, id int64, to string, result sql.Result, err error) error {
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 1 {
+		return err
+	}
+	alert, err := getAlert(db, id)
+	if err != nil {
+		return err
+	}
+	return fmt.Errorf("%w: alert %d is %s and cannot be %s", errInvalidTransition, id, alert.State, to)
+}
+
+// expireAlerts moves active alerts whose condition was last seen more than alertExpiry ago to the expired state.
+// Device offline alerts stay open for as long as the device is offline, see health.go.
+func expireAlerts(db *sql.DB) {
+	now := time.Now()
+	result, err := db.Exec(
+		"UPDATE alerts SET state = ?, resolved_at = ? WHERE state IN (?, ?) AND COALESCE(last_seen_at, created_at) < ? AND type != ?",
+		alertExpired, now.Unix(), alertOpen, alertAcknowledged, now.Add(-alertExpiry).Unix(), deviceOfflineAlert,
+	)
+	if err != nil {
+		log.Printf("Error expiring alerts: %v\n", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("Expired %d alerts\n", n)
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAlertTransitions(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	open, err := createAlert(db, "rule", "cam-1", 0, 0, "bear")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acknowledgeAlert(db, open, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acknowledgeAlert(db, open, "bob"); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("acknowledging twice: %v", err)
+	}
+	if err := resolveAlert(db, open, "alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolveAlert(db, open, "bob"); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("resolving twice: %v", err)
+	}
+	if alert, err := getAlert(db, open); err != nil || alert.AcknowledgedBy != "alice" || alert.ResolvedBy != "alice" {
+		t.Errorf("alert = %+v, %v", alert, err)
+	}
+
+	// An alert expired in the meantime stays expired
+	expired, err := createAlert(db, "rule", "cam-1", 0, 0, "wolf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("UPDATE alerts SET state = ? WHERE id = ?", alertExpired, expired); err != nil {
+		t.Fatal(err)
+	}
+	if err := acknowledgeAlert(db, expired, "alice"); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("acknowledging an expired alert: %v", err)
+	}
+	if err := resolveAlert(db, expired, "alice"); !errors.Is(err, errInvalidTransition) {
+		t.Errorf("resolving an expired alert: %v", err)
+	}
+	if alert, _ := getAlert(db, expired); alert.State != alertExpired || alert.ResolvedBy != "" {
+		t.Errorf("expired alert = %+v", alert)
+	}
+
+	if err := resolveAlert(db, 9999, "alice"); !errors.Is(err, errAlertNotFound) {
+		t.Errorf("resolving a missing alert: %v", err)
+	}
+}
+
+func TestRuleFiresAgainAfterAcknowledgement(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	notified := make(chan struct{}, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		notified <- struct{}{}
+	}))
+	defer server.Close()
+	testChannel(t, db, channelWebhook, map[string]interface{}{"url": server.URL})
+
+	rule := Rule{RuleID: 7, ClientID: "*", Trigger: expressionTrigger, Callback: "none", Notify: []string{"test-webhook"}, CooldownSeconds: 60, CooldownScope: cooldownPerDevice}
+	waitNotified := func(what string) {
+		t.Helper()
+		select {
+		case <-notified:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%s: no notification", what)
+		}
+	}
+	countAlerts := func() int {
+		t.Helper()
+		var n int
+		if err := db.QueryRow("SELECT COUNT(*) FROM alerts WHERE rule_id = ?", rule.RuleID).Scan(&n); err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	raiseRuleAlert(db, rule, "cam-1", 0, nil, "bear")
+	waitNotified("first match")
+
+	// A match while the alert is open only counts as another occurrence
+	raiseRuleAlert(db, rule, "cam-1", 0, nil, "bear")
+	var first int64
+	if err := db.QueryRow("SELECT id FROM alerts WHERE rule_id = ?", rule.RuleID).Scan(&first); err != nil {
+		t.Fatal(err)
+	}
+	if alert, err := getAlert(db, first); err != nil || alert.Occurrences != 2 {
+		t.Fatalf("alert = %+v, %v", alert, err)
+	}
+	if err := acknowledgeAlert(db, first, "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Acknowledged and still within the cooldown, the match is ignored
+	raiseRuleAlert(db, rule, "cam-1", 0, nil, "bear")
+	if n := countAlerts(); n != 1 {
+		t.Fatalf("%d alerts within the cooldown, want 1", n)
+	}
+
+	// Once the cooldown has passed the rule raises a new alert and notifies again
+	if _, err := db.Exec("UPDATE alerts SET created_at = created_at - 120, last_seen_at = last_seen_at - 120 WHERE id = ?", first); err != nil {
+		t.Fatal(err)
+	}
+	raiseRuleAlert(db, rule, "cam-1", 0, nil, "bear")
+	if n := countAlerts(); n != 2 {
+		t.Fatalf("%d alerts after the cooldown, want 2", n)
+	}
+	waitNotified("match after the cooldown")
+	if alert, err := getAlert(db, first); err != nil || alert.Occurrences != 2 {
+		t.Errorf("acknowledged alert = %+v, %v", alert, err)
+	}
+}
@@ -0,0 +1,612 @@
+// This file implements the authentication of the web interface and the API. Users are local accounts in the users
+// table with PBKDF2-SHA256 password hashes and one of three roles:
+//
+//	viewer    read everything except the users and the device settings
+//	operator  also acknowledge and resolve alerts, edit devices, rules, species and dead letters
+//	admin     also manage users, callbacks, notification channels and the device settings
+//
+// Logging in creates a session whose random token is kept in an HttpOnly cookie; only its SHA-256 is stored. Requests
+// that change state must carry the session's CSRF token in the X-CSRF-Token header, which static/gateway.js copies
+// from the readable gateway_csrf cookie for every jQuery request. The login form has no session yet, so it only
+// accepts posts from the gateway's own pages: another site cannot log a browser into an account of its choosing.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// User roles, each includes the permissions of the ones before it
+const (
+	roleViewer   = "viewer"
+	roleOperator = "operator"
+	roleAdmin    = "admin"
+)
+
+var roleRanks = map[string]int{roleViewer: 1, roleOperator: 2, roleAdmin: 3}
+
+const (
+	sessionCookie   = "gateway_session"
+	csrfCookie      = "gateway_csrf"
+	csrfHeader      = "X-CSRF-Token"
+	sessionLifetime = 12 * time.Hour
+
+	// passwordIterations is the PBKDF2 work factor, stored with every hash so it can be raised later
+	passwordIterations = 600000
+	minPasswordLength  = 8
+)
+
+var (
+	errUserNotFound       = errors.New("user not found")
+	errUserExists         = errors.New("a user with this name already exists")
+	errInvalidCredentials = errors.New("invalid username or password")
+	errLastAdmin          = errors.New("the last admin cannot be removed or demoted")
+	errSessionNotFound    = errors.New("session not found or expired")
+	// errInvalidUser wraps the validation errors of createUser and updateUser
+	errInvalidUser = errors.New("invalid user")
+)
+
+// User struct to hold a row of the users table
+type User struct {
+	ID        int64  `json:"id"`
+	Username  string `json:"username"`
+	Role      string `json:"role"`
+	CreatedAt string `json:"created_at"`
+	LastLogin string `json:"last_login,omitempty"`
+}
+
+// Session is a logged in user
+type Session struct {
+	User      User
+	CSRFToken string
+}
+
+// routeRole is the role needed to read (GET) and to change (any other method) the routes under prefix
+type routeRole struct {
+	prefix string
+	read   string
+	write  string
+}
+
+// routeRoles lists the routes that need more than viewer to read or operator to change, the first match wins
+var routeRoles = []routeRole{
+	{"/users", roleAdmin, roleAdmin},
+	{"/_users", roleAdmin, roleAdmin},
+	{"/devices/settings/", roleAdmin, roleAdmin},
+	{"/_devices/settings/", roleAdmin, roleAdmin},
+	{"/_rollouts", roleOperator, roleAdmin},
+	{"/_settings_changes", roleOperator, roleAdmin},
+	// The rules page lists the callbacks and channels, whose config may hold credentials
+	{"/_callbacks", roleOperator, roleAdmin},
+	{"/_channels", roleOperator, roleAdmin},
+	// Every user can see and change their own account
+	{"/_me", roleViewer, roleViewer},
+	{"/logout", roleViewer, roleViewer},
+}
+
+// publicRoutes are served without a session
+var publicRoutes = []string{"/login", "/static/"}
+
+// alwaysWrites are routes that change state even on GET, kept for older dashboards
+var alwaysWrites = map[string]bool{"/_dismiss_alert": true}
+
+func validRole(role string) bool {
+	_, ok := roleRanks[role]
+	return ok
+}
+
+// hashPassword returns the password hash in the form pbkdf2-sha256$<iterations>$<salt>$<hash>
+func hashPassword(password string) (string, error) {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, passwordIterations, sha256.Size)
+	if err != nil {
+		return "", err
+	}
+	encoding := base64.RawStdEncoding
+	return fmt.Sprintf("pbkdf2-sha256$%d$%s$%s", passwordIterations, encoding.EncodeToString(salt), encoding.EncodeToString(key)), nil
+}
+
+// checkPassword reports whether password matches a hash made by hashPassword
+func checkPassword(hash string, password string) bool {
+	parts := strings.Split(hash, "$")
+	if len(parts) != 4 || parts[0] != "pbkdf2-sha256" {
+		return false
+	}
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return false
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return false
+	}
+	expected, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil {
+		return false
+	}
+	key, err := pbkdf2.Key(sha256.New, password, salt, iterations, len(expected))
+	return err == nil && subtle.ConstantTimeCompare(key, expected) == 1
+}
+
+// dummyPasswordHash is checked against when the user does not exist, so the response time does not tell usernames apart
+var dummyPasswordHash = sync.OnceValue(func() string {
+	hash, _ := hashPassword("not a password")
+	return hash
+})
+
+func validateCredentials(username string, password string, role string) error {
+	if username == "" || len(username) > 64 || strings.ContainsAny(username, " \t\r\n") {
+		return fmt.Errorf("%w: username must be 1-64 characters without spaces", errInvalidUser)
+	}
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("%w: password must have at least %d characters", errInvalidUser, minPasswordLength)
+	}
+	if !validRole(role) {
+		return fmt.Errorf("%w: invalid role: %s", errInvalidUser, role)
+	}
+	return nil
+}
+
+const userColumns = "id, username, role, created_at, last_login_at"
+
+func scanUser(row scanner) (User, error) {
+	var user User
+	var createdAt int64
+	var lastLogin sql.NullInt64
+	if err := row.Scan(&user.ID, &user.Username, &user.Role, &createdAt, &lastLogin); err != nil {
+		return user, err
+	}
+	user.CreatedAt = formatTimestamp(createdAt)
+	if lastLogin.Valid {
+		user.LastLogin = formatTimestamp(lastLogin.Int64)
+	}
+	return user, nil
+}
+
+func createUser(db *sql.DB, username string, password string, role string) (User, error) {
+	if err := validateCredentials(username, password, role); err != nil {
+		return User{}, err
+	}
+	hash, err := hashPassword(password)
+	if err != nil {
+		return User{}, err
+	}
+	result, err := db.Exec("INSERT INTO users (username, password_hash, role, created_at) VALUES (?, ?, ?, ?)", username, hash, role, time.Now().Unix())
+	if err != nil {
+		if isUniqueViolation(err) {
+			return User{}, errUserExists
+		}
+		return User{}, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+	return getUser(db, id)
+}
+
+func getUser(db *sql.DB, id int64) (User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func getUserByName(db *sql.DB, username string) (User, error) {
+	user, err := scanUser(db.QueryRow("SELECT "+userColumns+" FROM users WHERE username = ?", username))
+	if errors.Is(err, sql.ErrNoRows) {
+		return user, errUserNotFound
+	}
+	return user, err
+}
+
+func listUsers(db *sql.DB) ([]User, error) {
+	rows, err := db.Query("SELECT " + userColumns + " FROM users ORDER BY username")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
+func countUsers(db *sql.DB) (int, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
+
+// isLastAdmin reports whether the user is the only admin. Called inside the transaction that demotes or
+// deletes the user, so two admins cannot remove each other at the same time.
+func isLastAdmin(tx *sql.Tx, id int64) (bool, error) {
+	var role string
+	var admins int
+	err := tx.QueryRow("SELECT role, (SELECT COUNT(*) FROM users WHERE role = ?) FROM users WHERE id = ?", roleAdmin, id).Scan(&role, &admins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return false, errUserNotFound
+	}
+	return role == roleAdmin && admins <= 1, err
+}
+
+// updateUser changes the role and the password of a user in one go, an empty role or password is left
+// unchanged. The last admin keeps their role and a new password logs the user out everywhere.
+func updateUser(db *sql.DB, id int64, role string, password string) error {
+	if role != "" && !validRole(role) {
+		return fmt.Errorf("%w: invalid role: %s", errInvalidUser, role)
+	}
+	var hash string
+	if password != "" {
+		if len(password) < minPasswordLength {
+			return fmt.Errorf("%w: password must have at least %d characters", errInvalidUser, minPasswordLength)
+		}
+		var err error
+		if hash, err = hashPassword(password); err != nil {
+			return err
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	last, err := isLastAdmin(tx, id)
+	if err != nil {
+		return err
+	}
+	if role != "" {
+		if last && role != roleAdmin {
+			return errLastAdmin
+		}
+		result, err := tx.Exec("UPDATE users SET role = ? WHERE id = ?", role, id)
+		if err := expectOneRow(result, err, errUserNotFound); err != nil {
+			return err
+		}
+	}
+	if hash != "" {
+		result, err := tx.Exec("UPDATE users SET password_hash = ? WHERE id = ?", hash, id)
+		if err := expectOneRow(result, err, errUserNotFound); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// setUserPassword changes the password of a user and logs them out everywhere
+func setUserPassword(db *sql.DB, id int64, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: password must have at least %d characters", errInvalidUser, minPasswordLength)
+	}
+	return updateUser(db, id, "", password)
+}
+
+// deleteUser removes a user and their sessions, the last admin cannot be removed
+func deleteUser(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if last, err := isLastAdmin(tx, id); err != nil {
+		return err
+	} else if last {
+		return errLastAdmin
+	}
+	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", id); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM users WHERE id = ?", id)
+	if err := expectOneRow(result, err, errUserNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// authenticate checks a username and password
+func authenticate(db *sql.DB, username string, password string) (User, error) {
+	var id int64
+	var hash string
+	err := db.QueryRow("SELECT id, password_hash FROM users WHERE username = ?", username).Scan(&id, &hash)
+	if errors.Is(err, sql.ErrNoRows) {
+		checkPassword(dummyPasswordHash(), password)
+		return User{}, errInvalidCredentials
+	} else if err != nil {
+		return User{}, err
+	}
+	if !checkPassword(hash, password) {
+		return User{}, errInvalidCredentials
+	}
+	if _, err := db.Exec("UPDATE users SET last_login_at = ? WHERE id = ?", time.Now().Unix(), id); err != nil {
+		return User{}, err
+	}
+	return getUser(db, id)
+}
+
+func randomToken() (string, error) {
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(token), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession logs a user in and returns the session token and its CSRF token
+func createSession(db *sql.DB, userID int64) (string, string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	csrfToken, err := randomToken()
+	if err != nil {
+		return "", "", err
+	}
+	now := time.Now()
+	if _, err := db.Exec("DELETE FROM sessions WHERE expires_at < ?", now.Unix()); err != nil {
+		return "", "", err
+	}
+	_, err = db.Exec(
+		"INSERT INTO sessions (token_hash, user_id, csrf_token, created_at, expires_at) VALUES (?, ?, ?, ?, ?)",
+		hashToken(token), userID, csrfToken, now.Unix(), now.Add(sessionLifetime).Unix(),
+	)
+	return token, csrfToken, err
+}
+
+func lookupSession(db *sql.DB, token string) (Session, error) {
+	var session Session
+	var createdAt int64
+	var lastLogin sql.NullInt64
+	err := db.QueryRow(
+		`SELECT u.id, u.username, u.role, u.created_at, u.last_login_at, s.csrf_token FROM sessions s
+		JOIN users u ON u.id = s.user_id WHERE s.token_hash = ? AND s.expires_at > ?`,
+		hashToken(token), time.Now().Unix(),
+	).Scan(&session.User.ID, &session.User.Username, &session.User.Role, &createdAt, &lastLogin, &session.CSRFToken)
+	if errors.Is(err, sql.ErrNoRows) {
+		return session, errSessionNotFound
+	} else if err != nil {
+		return session, err
+	}
+	session.User.CreatedAt = formatTimestamp(createdAt)
+	if lastLogin.Valid {
+		session.User.LastLogin = formatTimestamp(lastLogin.Int64)
+	}
+	return session, nil
+}
+
+func deleteSession(db *sql.DB, token string) error {
+	_, err := db.Exec("DELETE FROM sessions WHERE token_hash = ?", hashToken(token))
+	return err
+}
+
+// setSessionCookies sets the session cookie and the CSRF cookie read by static/gateway.js, empty values clear them
+func setSessionCookies(w http.ResponseWriter, req *http.Request, token string, csrfToken string) {
+	maxAge := int(sessionLifetime.Seconds())
+	if token == "" {
+		maxAge = -1
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookie, Value: token, Path: "/", MaxAge: maxAge, HttpOnly: true, Secure: req.TLS != nil, SameSite: http.SameSiteLaxMode})
+	http.SetCookie(w, &http.Cookie{Name: csrfCookie, Value: csrfToken, Path: "/", MaxAge: maxAge, Secure: req.TLS != nil, SameSite: http.SameSiteStrictMode})
+}
+
+type sessionContextKey struct{}
+
+// requestSession returns the session of an authenticated request
+func requestSession(req *http.Request) (Session, bool) {
+	session, ok := req.Context().Value(sessionContextKey{}).(Session)
+	return session, ok
+}
+
+// requiredRole returns the role needed for a request and whether it changes state
+func requiredRole(req *http.Request) (string, bool) {
+	write := alwaysWrites[req.URL.Path]
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		write = true
+	}
+	for _, route := range routeRoles {
+		if strings.HasPrefix(req.URL.Path, route.prefix) {
+			if write {
+				return route.write, true
+			}
+			return route.read, false
+		}
+	}
+	if write {
+		return roleOperator, true
+	}
+	return roleViewer, false
+}
+
+// requireAuth serves the public routes as they are and everything else only to a logged in user with the
+// required role, checking the CSRF token of requests that change state
+func requireAuth(db *sql.DB, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for _, prefix := range publicRoutes {
+			if req.URL.Path == prefix || (strings.HasSuffix(prefix, "/") && strings.HasPrefix(req.URL.Path, prefix)) {
+				next.ServeHTTP(w, req)
+				return
+			}
+		}
+
+		var session Session
+		cookie, err := req.Cookie(sessionCookie)
+		if err == nil {
+			session, err = lookupSession(db, cookie.Value)
+		}
+		if err != nil {
+			if !errors.Is(err, http.ErrNoCookie) && !errors.Is(err, errSessionNotFound) {
+				log.Printf("Error loading session: %v\n", err)
+			}
+			// Pages send the browser to the login form, the API answers 401 for static/gateway.js to handle
+			if req.Method == http.MethodGet && !strings.HasPrefix(req.URL.Path, "/_") {
+				http.Redirect(w, req, "/login?next="+url.QueryEscape(req.URL.RequestURI()), http.StatusSeeOther)
+				return
+			}
+			http.Error(w, "Login required", http.StatusUnauthorized)
+			return
+		}
+
+		role, write := requiredRole(req)
+		if roleRanks[session.User.Role] < roleRanks[role] {
+			http.Error(w, fmt.Sprintf("Forbidden: %s role required", role), http.StatusForbidden)
+			return
+		}
+		if write && subtle.ConstantTimeCompare([]byte(req.Header.Get(csrfHeader)), []byte(session.CSRFToken)) != 1 {
+			http.Error(w, "Forbidden: invalid CSRF token", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), sessionContextKey{}, session)))
+	})
+}
+
+// sameOrigin reports whether a request comes from a page of this gateway. Browsers tell with Sec-Fetch-Site or,
+// older ones, with the Origin header of every POST; a request without either does not come from a browser.
+func sameOrigin(req *http.Request) bool {
+	if site := req.Header.Get("Sec-Fetch-Site"); site != "" {
+		return site == "same-origin" || site == "none"
+	}
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host == req.Host
+}
+
+// safeRedirect returns next if it is a path on this gateway, "/" otherwise
+func safeRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/"
+	}
+	return next
+}
+
+// ensureAdmin creates an admin account with a random password when there are no users, so a new gateway can be
+// logged into. The password is logged once.
+func ensureAdmin(db *sql.DB) error {
+	count, err := countUsers(db)
+	if err != nil || count > 0 {
+		return err
+	}
+	password, err := randomToken()
+	if err != nil {
+		return err
+	}
+	password = password[:16]
+	if _, err := createUser(db, "admin", password, roleAdmin); err != nil {
+		return err
+	}
+	log.Printf("Created user admin with password %s, change it after logging in\n", password)
+	return nil
+}
+
+// runUserCommand implements `uol-gateway user add <username> [-role viewer|operator|admin] | passwd <username> | list`.
+// Passwords are read from the first line of standard input, so they do not show up in the process list.
+func runUserCommand(db *sql.DB, args []string) error {
+	usage := errors.New("usage: user add <username> [-role viewer|operator|admin] | passwd <username> | list")
+	if len(args) == 0 {
+		return usage
+	}
+	readPassword := func() (string, error) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", fmt.Errorf("reading the password: %v", err)
+		}
+		return strings.TrimRight(line, "\r\n"), nil
+	}
+
+	switch args[0] {
+	case "add":
+		fs := flag.NewFlagSet("user add", flag.ContinueOnError)
+		role := fs.String("role", roleViewer, "viewer, operator or admin")
+		if len(args) < 2 {
+			return usage
+		}
+		if err := fs.Parse(args[2:]); err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		user, err := createUser(db, args[1], password, *role)
+		if err != nil {
+			return err
+		}
+		log.Printf("Created user %s with role %s\n", user.Username, user.Role)
+		return nil
+	case "passwd":
+		if len(args) != 2 {
+			return usage
+		}
+		user, err := getUserByName(db, args[1])
+		if err != nil {
+			return err
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		if err := setUserPassword(db, user.ID, password); err != nil {
+			return err
+		}
+		log.Printf("Changed the password of %s\n", user.Username)
+		return nil
+	case "list":
+		users, err := listUsers(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "USERNAME\tROLE\tCREATED\tLAST LOGIN")
+		for _, user := range users {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", user.Username, user.Role, user.CreatedAt, user.LastLogin)
+		}
+		return w.Flush()
+	default:
+		return usage
+	}
+}
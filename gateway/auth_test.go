@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testSession creates a user with the given role and logs it in, returning the session and CSRF tokens
+func testSession(t *testing.T, db *sql.DB, role string) (string, string) {
+	t.Helper()
+	user, err := createUser(db, "test-"+role, "correct horse", role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, csrfToken, err := createSession(db, user.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token, csrfToken
+}
+
+// authRequest sends a request through requireAuth to a handler answering 200, with the session token and the
+// CSRF header when they are not empty
+func authRequest(db *sql.DB, method string, path string, token string, csrfToken string) *httptest.ResponseRecorder {
+	handler := requireAuth(db, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: token})
+	}
+	if csrfToken != "" {
+		req.Header.Set(csrfHeader, csrfToken)
+	}
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestRequireAuthRoles(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	type session struct{ token, csrf string }
+	sessions := map[string]session{}
+	for _, role := range []string{roleViewer, roleOperator, roleAdmin} {
+		token, csrfToken := testSession(t, db, role)
+		sessions[role] = session{token, csrfToken}
+	}
+
+	tests := []struct {
+		path  string
+		read  string // lowest role allowed to GET
+		write string // lowest role allowed to POST
+	}{
+		{"/_events", roleViewer, roleOperator},
+		{"/_alerts/1", roleViewer, roleOperator},
+		{"/_rules", roleViewer, roleOperator},
+		{"/_devices/cam-1", roleViewer, roleOperator},
+		{"/users", roleAdmin, roleAdmin},
+		{"/_users/1", roleAdmin, roleAdmin},
+		{"/devices/settings/cam-1", roleAdmin, roleAdmin},
+		{"/_devices/settings/cam-1", roleAdmin, roleAdmin},
+		{"/_rollouts", roleOperator, roleAdmin},
+		{"/_settings_changes/1/revert", roleOperator, roleAdmin},
+		{"/_callbacks/1", roleOperator, roleAdmin},
+		{"/_channels", roleOperator, roleAdmin},
+		{"/_me", roleViewer, roleViewer},
+		{"/logout", roleViewer, roleViewer},
+	}
+
+	for _, test := range tests {
+		for role, s := range sessions {
+			for _, method := range []string{http.MethodGet, http.MethodPost, http.MethodPut, http.MethodDelete} {
+				needed := test.write
+				if method == http.MethodGet {
+					needed = test.read
+				}
+				want := http.StatusOK
+				if roleRanks[role] < roleRanks[needed] {
+					want = http.StatusForbidden
+				}
+				if rec := authRequest(db, method, test.path, s.token, s.csrf); rec.Code != want {
+					t.Errorf("%s %s as %s = %d, want %d", method, test.path, role, rec.Code, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRequireAuthCSRF(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	token, csrfToken := testSession(t, db, roleAdmin)
+
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		csrf   string
+		want   int
+	}{
+		{"read without token", http.MethodGet, "/_events", "", http.StatusOK},
+		{"write with token", http.MethodPost, "/_rules", csrfToken, http.StatusOK},
+		{"write without token", http.MethodPost, "/_rules", "", http.StatusForbidden},
+		{"write with wrong token", http.MethodPost, "/_rules", "not-the-token", http.StatusForbidden},
+		{"write with truncated token", http.MethodDelete, "/_rules/1", csrfToken[:len(csrfToken)-1], http.StatusForbidden},
+		{"GET that changes state without token", http.MethodGet, "/_dismiss_alert?id=1", "", http.StatusForbidden},
+		{"GET that changes state with token", http.MethodGet, "/_dismiss_alert?id=1", csrfToken, http.StatusOK},
+	}
+	for _, test := range tests {
+		if rec := authRequest(db, test.method, test.path, token, test.csrf); rec.Code != test.want {
+			t.Errorf("%s: %s %s = %d, want %d", test.name, test.method, test.path, rec.Code, test.want)
+		}
+	}
+
+	// The token of one session is no good for another
+	otherToken, _ := testSession(t, db, roleOperator)
+	if rec := authRequest(db, http.MethodPost, "/_rules", otherToken, csrfToken); rec.Code != http.StatusForbidden {
+		t.Errorf("CSRF token of another session = %d, want %d", rec.Code, http.StatusForbidden)
+	}
+}
+
+func TestRequireAuthWithoutSession(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	token, csrfToken := testSession(t, db, roleAdmin)
+
+	expired, expiredCSRF := testSession(t, db, roleViewer)
+	if _, err := db.Exec("UPDATE sessions SET expires_at = ? WHERE token_hash = ?", time.Now().Add(-time.Minute).Unix(), hashToken(expired)); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string][2]string{
+		"no session":      {"", ""},
+		"unknown session": {"forged", csrfToken},
+		"expired session": {expired, expiredCSRF},
+	} {
+		// The API answers 401, pages redirect to the login form
+		if rec := authRequest(db, http.MethodGet, "/_events", s[0], ""); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: GET /_events = %d, want %d", name, rec.Code, http.StatusUnauthorized)
+		}
+		if rec := authRequest(db, http.MethodPost, "/_rules", s[0], s[1]); rec.Code != http.StatusUnauthorized {
+			t.Errorf("%s: POST /_rules = %d, want %d", name, rec.Code, http.StatusUnauthorized)
+		}
+		rec := authRequest(db, http.MethodGet, "/events?client_id=cam-1", s[0], "")
+		if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/login?next=%2Fevents%3Fclient_id%3Dcam-1" {
+			t.Errorf("%s: GET /events = %d to %q", name, rec.Code, rec.Header().Get("Location"))
+		}
+	}
+
+	// The valid session still works
+	if rec := authRequest(db, http.MethodGet, "/_events", token, ""); rec.Code != http.StatusOK {
+		t.Errorf("valid session: GET /_events = %d", rec.Code)
+	}
+}
+
+func TestRequireAuthPublicRoutes(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	tests := []struct {
+		method string
+		path   string
+		public bool
+	}{
+		{http.MethodGet, "/login", true},
+		{http.MethodPost, "/login", true},
+		{http.MethodGet, "/login?next=/rules", true},
+		{http.MethodGet, "/static/gateway.js", true},
+		{http.MethodGet, "/static/css/style.css", true},
+		{http.MethodGet, "/loginx", false},
+		{http.MethodGet, "/login/", false},
+		{http.MethodGet, "/static", false},
+		{http.MethodGet, "/_static/gateway.js", false},
+		{http.MethodPost, "/logout", false},
+	}
+	for _, test := range tests {
+		rec := authRequest(db, test.method, test.path, "", "")
+		if public := rec.Code == http.StatusOK; public != test.public {
+			t.Errorf("%s %s = %d, public %v, want %v", test.method, test.path, rec.Code, public, test.public)
+		}
+	}
+}
+
+func TestSameOrigin(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+		want    bool
+	}{
+		{"no browser headers", nil, true},
+		{"same origin fetch", map[string]string{"Sec-Fetch-Site": "same-origin", "Origin": "http://gateway.local:8080"}, true},
+		{"cross site fetch", map[string]string{"Sec-Fetch-Site": "cross-site", "Origin": "http://gateway.local:8080"}, false},
+		{"same site fetch", map[string]string{"Sec-Fetch-Site": "same-site"}, false},
+		{"same origin", map[string]string{"Origin": "http://gateway.local:8080"}, true},
+		{"same origin over TLS", map[string]string{"Origin": "https://gateway.local:8080"}, true},
+		{"other origin", map[string]string{"Origin": "https://evil.example"}, false},
+		{"other port", map[string]string{"Origin": "http://gateway.local:9090"}, false},
+		{"opaque origin", map[string]string{"Origin": "null"}, false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(http.MethodPost, "http://gateway.local:8080/login", strings.NewReader("username=admin"))
+		for name, value := range test.headers {
+			req.Header.Set(name, value)
+		}
+		if got := sameOrigin(req); got != test.want {
+			t.Errorf("%s: sameOrigin = %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestUpdateUser(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	admin, err := createUser(db, "alice", "correct horse", roleAdmin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	viewer, err := createUser(db, "bob", "correct horse", roleViewer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A bad password leaves the role alone too
+	if err := updateUser(db, viewer.ID, roleOperator, "short"); !errors.Is(err, errInvalidUser) {
+		t.Errorf("short password: %v", err)
+	}
+	if err := updateUser(db, viewer.ID, "root", ""); !errors.Is(err, errInvalidUser) {
+		t.Errorf("invalid role: %v", err)
+	}
+	if user, err := getUser(db, viewer.ID); err != nil || user.Role != roleViewer {
+		t.Errorf("user after rejected updates = %+v, %v", user, err)
+	}
+	if err := updateUser(db, 999, roleViewer, ""); !errors.Is(err, errUserNotFound) {
+		t.Errorf("unknown user: %v", err)
+	}
+
+	// The last admin can change their password but not lose the role
+	if err := updateUser(db, admin.ID, roleOperator, "battery staple"); !errors.Is(err, errLastAdmin) {
+		t.Errorf("demoting the last admin: %v", err)
+	}
+	if err := updateUser(db, admin.ID, roleAdmin, "battery staple"); err != nil {
+		t.Errorf("changing the password of the last admin: %v", err)
+	}
+	if _, err := authenticate(db, "alice", "battery staple"); err != nil {
+		t.Errorf("logging in with the new password: %v", err)
+	}
+	if err := deleteUser(db, admin.ID); !errors.Is(err, errLastAdmin) {
+		t.Errorf("deleting the last admin: %v", err)
+	}
+}
+
+func TestLastAdminRace(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	var ids [2]int64
+	for i, name := range []string{"alice", "bob"} {
+		user, err := createUser(db, name, "correct horse", roleAdmin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids[i] = user.ID
+	}
+
+	// Two admins removing each other at the same time must leave one admin behind
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range ids {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if i == 0 {
+				errs[i] = deleteUser(db, ids[1])
+			} else {
+				errs[i] = updateUser(db, ids[0], roleViewer, "")
+			}
+		}()
+	}
+	wg.Wait()
+
+	var admins int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users WHERE role = ?", roleAdmin).Scan(&admins); err != nil {
+		t.Fatal(err)
+	}
+	if admins != 1 {
+		t.Errorf("%d admins left, want 1 (errors %v)", admins, errs)
+	}
+	if (errs[0] == nil) == (errs[1] == nil) || !errors.Is(errors.Join(errs[0], errs[1]), errLastAdmin) {
+		t.Errorf("errors = %v, want one errLastAdmin", errs)
+	}
+}
@@ -0,0 +1,386 @@
+// This file implements the callback registry. Rules name a callback to run when they match; apart from the few
+// callbacks built into the gateway (StubStorage), callbacks are rows of the callbacks table describing an action:
+//
+//   - mqtt_publish: publish payload_template to topic_template, e.g. a "<species>_alert" event back to the device
+//   - http: send payload_template to the URL in topic_template, config may set "method" and "content_type"
+//   - notification: send payload_template as the message to the channels listed in config "notify"
+//
+// Templates use text/template and can refer to {{.ClientID}}, {{.Name}}, {{.Timestamp}}, {{.RuleID}}, {{.AlertID}},
+// {{.EventID}} and the event data, e.g. {{.Data.predicted_animal}}.
+// The json function quotes a value for use inside a JSON payload, e.g. {"client_id": {{json .ClientID}}}.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Callback action types
+const (
+	actionMQTTPublish  = "mqtt_publish"
+	actionHTTP         = "http"
+	actionNotification = "notification"
+)
+
+// callbackTimeout bounds outbound HTTP calls made by callbacks
+const callbackTimeout = 10 * time.Second
+
+// errCallbackNotFound is returned when a callback does not exist in the registry
+var errCallbackNotFound = errors.New("callback not found")
+
+// errCallbackExists is returned when a callback is saved with the name of another one
+var errCallbackExists = errors.New("a callback with this name already exists")
+
+// errCallbackInUse is returned when a callback that rules or species refer to by name would be renamed or deleted
+var errCallbackInUse = errors.New("callback is in use")
+
+// CallbackAction struct to hold a row of the callbacks table
+type CallbackAction struct {
+	ID              int64           `json:"id"`
+	Name            string          `json:"name"`
+	ActionType      string          `json:"action_type"`
+	TopicTemplate   string          `json:"topic_template"`
+	PayloadTemplate string          `json:"payload_template"`
+	Config          json.RawMessage `json:"config"`
+}
+
+// callbackConfig holds the optional settings of the http and notification action types
+type callbackConfig struct {
+	Method      string   `json:"method"`
+	ContentType string   `json:"content_type"`
+	Notify      []string `json:"notify"`
+}
+
+// callbackTemplateData is what topic and payload templates are rendered with
+type callbackTemplateData struct {
+	ClientID  string
+	Name      string
+	Timestamp int64
+	RuleID    int
+	AlertID   int64
+	EventID   int64
+	Data      map[string]interface{}
+}
+
+var callbackTemplateFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+func parseCallbackTemplate(name string, text string) (*template.Template, error) {
+	return template.New(name).Funcs(callbackTemplateFuncs).Parse(text)
+}
+
+func renderCallbackTemplate(name string, text string, data callbackTemplateData) (string, error) {
+	tmpl, err := parseCallbackTemplate(name, text)
+	if err != nil {
+		return "", err
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, data); err != nil {
+		return "", err
+	}
+	return out.String(), nil
+}
+
+func (action CallbackAction) config() callbackConfig {
+	config := callbackConfig{Method: http.MethodPost, ContentType: "application/json"}
+	if len(action.Config) > 0 {
+		json.Unmarshal(action.Config, &config)
+	}
+	return config
+}
+
+// validateCallbackAction checks a callback coming from the API, including that its templates render
+func validateCallbackAction(db *sql.DB, action CallbackAction) error {
+	if action.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if _, ok := StubStorage[action.Name]; ok {
+		return fmt.Errorf("%s is a built-in callback", action.Name)
+	}
+	if len(action.Config) > 0 {
+		var config callbackConfig
+		if err := json.Unmarshal(action.Config, &config); err != nil {
+			return fmt.Errorf("invalid config: %v", err)
+		}
+	}
+
+	sample := callbackTemplateData{ClientID: "00:00:00:00:00:00", Name: action.Name, Timestamp: time.Now().Unix(), Data: map[string]interface{}{}}
+	topic, err := renderCallbackTemplate("topic", action.TopicTemplate, sample)
+	if err != nil {
+		return fmt.Errorf("invalid topic_template: %v", err)
+	}
+	if _, err := renderCallbackTemplate("payload", action.PayloadTemplate, sample); err != nil {
+		return fmt.Errorf("invalid payload_template: %v", err)
+	}
+
+	switch action.ActionType {
+	case actionMQTTPublish:
+		if topic == "" {
+			return fmt.Errorf("topic_template is required for %s", action.ActionType)
+		}
+	case actionHTTP:
+		if err := validateHTTPURL(topic); err != nil {
+			return fmt.Errorf("topic_template must render to a URL for %s: %v", action.ActionType, err)
+		}
+	case actionNotification:
+		config := action.config()
+		if len(config.Notify) == 0 {
+			return fmt.Errorf("config.notify must list at least one channel for %s", action.ActionType)
+		}
+		for _, name := range config.Notify {
+			if _, err := getChannelByName(db, name); err != nil {
+				return fmt.Errorf("unknown notification channel %s: %v", name, err)
+			}
+		}
+	default:
+		return fmt.Errorf("invalid action_type: %s", action.ActionType)
+	}
+	return nil
+}
+
+// runCallbackAction renders the templates of a registry callback and performs its action
+func runCallbackAction(ac *ActionContext, action CallbackAction) error {
+	data := callbackTemplateData{
+		ClientID:  ac.ClientID,
+		Name:      action.Name,
+		Timestamp: time.Now().Unix(),
+		EventID:   ac.EventID,
+		AlertID:   ac.AlertID,
+		Data:      ac.Data,
+	}
+	if ac.Rule != nil {
+		data.RuleID = ac.Rule.RuleID
+	}
+	topic, err := renderCallbackTemplate("topic", action.TopicTemplate, data)
+	if err != nil {
+		return err
+	}
+	payload, err := renderCallbackTemplate("payload", action.PayloadTemplate, data)
+	if err != nil {
+		return err
+	}
+
+	switch action.ActionType {
+	case actionMQTTPublish:
+		token := mqttClient.Publish(topic, 0, false, payload)
+		if !token.WaitTimeout(callbackTimeout) {
+			return fmt.Errorf("timed out publishing to %s", topic)
+		}
+		return token.Error()
+	case actionHTTP:
+		config := action.config()
+		ctx, cancel := context.WithTimeout(ac, callbackTimeout)
+		defer cancel()
+
+		req, err := http.NewRequestWithContext(ctx, strings.ToUpper(config.Method), topic, strings.NewReader(payload))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", config.ContentType)
+		return doNotificationRequest(req)
+	case actionNotification:
+		notification := Notification{
+			AlertID:  ac.AlertID,
+			ClientID: ac.ClientID,
+			Subject:  notificationSubject,
+			Message:  payload,
+		}
+		if ac.Rule != nil {
+			notification.RuleID = int64(ac.Rule.RuleID)
+		}
+		notifyChannels(ac.DB, action.config().Notify, notification)
+		return nil
+	}
+	return fmt.Errorf("invalid action_type: %s", action.ActionType)
+}
+
+// callbackExists reports whether name is a built-in callback or a registry callback
+func callbackExists(db *sql.DB, name string) (bool, error) {
+	if _, ok := StubStorage[name]; ok {
+		return true, nil
+	}
+	_, err := getCallbackActionByName(db, name)
+	if errors.Is(err, errCallbackNotFound) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Callback storage
+
+const callbackColumns = "id, name, action_type, topic_template, payload_template, config"
+
+func scanCallbackAction(row scanner) (CallbackAction, error) {
+	var action CallbackAction
+	var config string
+	if err := row.Scan(&action.ID, &action.Name, &action.ActionType, &action.TopicTemplate, &action.PayloadTemplate, &config); err != nil {
+		return action, err
+	}
+	action.Config = json.RawMessage(config)
+	return action, nil
+}
+
+func loadCallbackActions(db *sql.DB) ([]CallbackAction, error) {
+	rows, err := db.Query("SELECT " + callbackColumns + " FROM callbacks ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	actions := []CallbackAction{}
+	for rows.Next() {
+		action, err := scanCallbackAction(rows)
+		if err != nil {
+			return nil, err
+		}
+		actions = append(actions, action)
+	}
+	return actions, rows.Err()
+}
+
+func getCallbackAction(db *sql.DB, id int64) (CallbackAction, error) {
+	action, err := scanCallbackAction(db.QueryRow("SELECT "+callbackColumns+" FROM callbacks WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return action, errCallbackNotFound
+	}
+	return action, err
+}
+
+func getCallbackActionByName(db *sql.DB, name string) (CallbackAction, error) {
+	action, err := scanCallbackAction(db.QueryRow("SELECT "+callbackColumns+" FROM callbacks WHERE name = ?", name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return action, errCallbackNotFound
+	}
+	return action, err
+}
+
+func callbackConfigText(action CallbackAction) string {
+	if len(action.Config) == 0 {
+		return "{}"
+	}
+	return string(action.Config)
+}
+
+func insertCallbackAction(db *sql.DB, action CallbackAction) (int64, error) {
+	result, err := db.Exec(
+		"INSERT INTO callbacks (name, action_type, topic_template, payload_template, config) VALUES (?, ?, ?, ?, ?)",
+		action.Name, action.ActionType, action.TopicTemplate, action.PayloadTemplate, callbackConfigText(action),
+	)
+	if isUniqueViolation(err) {
+		return 0, errCallbackExists
+	} else if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// callbackReferences returns the rules and species that refer to a callback by name, as "rule <id>" and
+// "species <name>"
+func callbackReferences(tx *sql.Tx, name string) ([]string, error) {
+	rows, err := tx.Query(
+		"SELECT 'rule ' || rule_id FROM rules WHERE callback = ? UNION ALL SELECT 'species ' || name FROM species WHERE callback = ?",
+		name, name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var references []string
+	for rows.Next() {
+		var reference string
+		if err := rows.Scan(&reference); err != nil {
+			return nil, err
+		}
+		references = append(references, reference)
+	}
+	return references, rows.Err()
+}
+
+// callbackName returns the name of the callback with the given ID
+func callbackName(tx *sql.Tx, id int64) (string, error) {
+	var name string
+	err := tx.QueryRow("SELECT name FROM callbacks WHERE id = ?", id).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return name, errCallbackNotFound
+	}
+	return name, err
+}
+
+// checkCallbackUnused returns errCallbackInUse when rules or species refer to the callback by name
+func checkCallbackUnused(tx *sql.Tx, name string) error {
+	references, err := callbackReferences(tx, name)
+	if err != nil {
+		return err
+	}
+	if len(references) > 0 {
+		return fmt.Errorf("%w: %s is used by %s", errCallbackInUse, name, strings.Join(references, ", "))
+	}
+	return nil
+}
+
+// updateCallbackAction saves a callback. A rename is refused while rules or species refer to the old name.
+func updateCallbackAction(db *sql.DB, action CallbackAction) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name, err := callbackName(tx, action.ID)
+	if err != nil {
+		return err
+	}
+	if name != action.Name {
+		if err := checkCallbackUnused(tx, name); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec(
+		"UPDATE callbacks SET name = ?, action_type = ?, topic_template = ?, payload_template = ?, config = ? WHERE id = ?",
+		action.Name, action.ActionType, action.TopicTemplate, action.PayloadTemplate, callbackConfigText(action), action.ID,
+	)
+	if isUniqueViolation(err) {
+		return errCallbackExists
+	}
+	if err := expectOneRow(result, err, errCallbackNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteCallbackAction deletes a callback, refused while rules or species refer to it
+func deleteCallbackAction(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name, err := callbackName(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkCallbackUnused(tx, name); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM callbacks WHERE id = ?", id)
+	if err := expectOneRow(result, err, errCallbackNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,112 @@
+// This file implements the clock skew detection. The local_timestamp of a device message is only as good as the
+// device clock: an ESP32 that never reached an NTP server counts from the 1970 epoch, and one that did drifts over
+// time. The gateway compares every local_timestamp with the time it received the message:
+//
+//	unsynced: local_timestamp is before plausibleAfter, the device clock was never set
+//	skewed:   local_timestamp differs from received_at by more than clock.max_skew
+//
+// The offset is stored on the event and on its device, flagged events keep their local_timestamp but should be
+// ordered by received_at. A device whose clock is unsynced or skewed gets a "clock drift" alert, resolved by the
+// first message with a plausible timestamp.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Timestamp flags of events
+const (
+	timestampUnsynced = "unsynced"
+	timestampSkewed   = "skewed"
+)
+
+// plausibleAfter is the earliest local_timestamp taken as a real time, 2020-01-01 UTC
+const plausibleAfter = 1577836800
+
+// clockDriftAlert is the alert type raised when the clock of a device is unsynced or skewed
+const clockDriftAlert = "clock drift"
+
+// checkTimestamp returns the clock offset of a message received at receivedAt in seconds, positive when the
+// device clock is ahead, and its timestamp flag, empty when the timestamp is plausible
+func checkTimestamp(localTimestamp int64, receivedAt int64, maxSkew time.Duration) (int64, string) {
+	offset := localTimestamp - receivedAt
+	switch {
+	case localTimestamp < plausibleAfter:
+		return offset, timestampUnsynced
+	case time.Duration(abs(offset))*time.Second > maxSkew:
+		return offset, timestampSkewed
+	}
+	return offset, ""
+}
+
+func abs(n int64) int64 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// updateDeviceClock records the clock offset of a device and raises or resolves its clock drift alert
+func updateDeviceClock(db *sql.DB, clientID string, offset int64, flag string, eventID int64) error {
+	now := time.Now().Unix()
+	if _, err := db.Exec("UPDATE devices SET clock_offset = ?, clock_checked_at = ? WHERE client_id = ?", offset, now, clientID); err != nil {
+		return err
+	}
+
+	alertID, err := findClockDriftAlert(db, clientID)
+	if err != nil {
+		return err
+	}
+	switch {
+	case flag == "" && alertID != 0:
+		_, err := db.Exec(
+			"UPDATE alerts SET state = ?, resolved_by = ?, resolved_at = ? WHERE id = ?",
+			alertResolved, healthActor, now, alertID,
+		)
+		return err
+	case flag == "":
+		return nil
+	case alertID != 0:
+		return recordAlertOccurrence(db, alertID)
+	}
+
+	message := fmt.Sprintf("The clock of device %s is %s by %s", clientID, clockDirection(offset), time.Duration(abs(offset))*time.Second)
+	if flag == timestampUnsynced {
+		message = fmt.Sprintf("The clock of device %s is not set, it reports %s", clientID, formatTimestamp(offset+now))
+	}
+	alertID, err = createAlert(db, clockDriftAlert, clientID, 0, eventID, message)
+	if err != nil {
+		return err
+	}
+	notifyChannels(db, currentConfig().Clock.Notify, Notification{
+		AlertID:  alertID,
+		ClientID: clientID,
+		Subject:  "Device clock drift",
+		Message:  message,
+	})
+	return nil
+}
+
+func clockDirection(offset int64) string {
+	if offset < 0 {
+		return "behind"
+	}
+	return "ahead"
+}
+
+// findClockDriftAlert returns the active clock drift alert of a device, 0 if there is none
+func findClockDriftAlert(db *sql.DB, clientID string) (int64, error) {
+	var alertID int64
+	err := db.QueryRow(
+		"SELECT id FROM alerts WHERE type = ? AND client_id = ? AND state IN (?, ?) ORDER BY id DESC LIMIT 1",
+		clockDriftAlert, clientID, alertOpen, alertAcknowledged,
+	).Scan(&alertID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return alertID, err
+}
@@ -0,0 +1,315 @@
+// This file implements the retention of the events table. A compaction runs every retention.interval:
+//
+//	telemetry older than retention.telemetry is rolled up into telemetry_hourly and deleted
+//	intrusions older than retention.intrusion are deleted, with their YOLO verdicts
+//	hourly aggregates older than retention.aggregates are deleted, if set
+//
+// The age of an event is taken from received_at, local_timestamp only for events stored before it existed, so a
+// device with an unset clock does not lose its events early. Events of open or acknowledged alerts are kept.
+// Events are deleted in batches so the MQTT handler is never blocked for long, and every run is reported in compactions.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// compactionBatch is the number of events deleted per transaction
+const compactionBatch = 5000
+
+// eventTime is the SQL expression for the age of an event
+const eventTime = "COALESCE(received_at, local_timestamp, 0)"
+
+var errCompactionRunning = errors.New("a compaction is already running")
+
+// compactionMu keeps the scheduled and the manual compactions apart
+var compactionMu sync.Mutex
+
+// Compaction is the report of a compaction run, a row of the compactions table
+type Compaction struct {
+	ID                int64  `json:"id"`
+	StartedAt         string `json:"started_at"`
+	FinishedAt        string `json:"finished_at"`
+	TelemetryRolledUp int64  `json:"telemetry_rolled_up"` // raw telemetry events rolled up and deleted
+	HoursUpdated      int64  `json:"hours_updated"`       // telemetry_hourly rows inserted or merged into
+	IntrusionsDeleted int64  `json:"intrusions_deleted"`
+	VerdictsDeleted   int64  `json:"verdicts_deleted"`
+	AggregatesDeleted int64  `json:"aggregates_deleted"`
+	KeptPastRetention int64  `json:"kept_past_retention"` // events of active alerts, and the verdicts of their intrusions
+	DatabaseBytes     int64  `json:"database_bytes"`
+	FreeBytes         int64  `json:"free_bytes"` // space freed inside the database file, reused before it grows again
+	Error             string `json:"error,omitempty"`
+}
+
+// TelemetryHour is a row of the telemetry_hourly table
+type TelemetryHour struct {
+	ClientID      string   `json:"client_id"`
+	Hour          string   `json:"hour"`
+	Samples       int64    `json:"samples"`
+	LoudnessMin   *float64 `json:"loudness_min"`
+	LoudnessMax   *float64 `json:"loudness_max"`
+	LoudnessAvg   *float64 `json:"loudness_avg"`
+	MovementCount int64    `json:"movement_count"`
+}
+
+// runCompaction applies the retention policy once and stores the report
+func runCompaction(db *sql.DB) (Compaction, error) {
+	if !compactionMu.TryLock() {
+		return Compaction{}, errCompactionRunning
+	}
+	defer compactionMu.Unlock()
+
+	policy := currentConfig().Retention
+	started := time.Now()
+	report := Compaction{StartedAt: formatTimestamp(started.Unix())}
+	err := compact(db, policy, started, &report)
+	if err != nil {
+		report.Error = err.Error()
+	}
+	finished := time.Now()
+	report.FinishedAt = formatTimestamp(finished.Unix())
+
+	result, dbErr := db.Exec(
+		`INSERT INTO compactions (started_at, finished_at, telemetry_rolled_up, hours_updated, intrusions_deleted, verdicts_deleted,
+		aggregates_deleted, kept_past_retention, database_bytes, free_bytes, error) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		started.Unix(), finished.Unix(), report.TelemetryRolledUp, report.HoursUpdated, report.IntrusionsDeleted, report.VerdictsDeleted,
+		report.AggregatesDeleted, report.KeptPastRetention, report.DatabaseBytes, report.FreeBytes, nullableString(report.Error),
+	)
+	if dbErr != nil {
+		log.Printf("Error storing the compaction report: %v\n", dbErr)
+	} else {
+		report.ID, _ = result.LastInsertId()
+	}
+	if err == nil {
+		log.Printf("Compaction: %s\n", report.Summary())
+	}
+	return report, err
+}
+
+func compact(db *sql.DB, policy RetentionConfig, now time.Time, report *Compaction) error {
+	// Only whole hours are rolled up
+	telemetryCutoff := now.Add(-policy.Telemetry).Truncate(time.Hour).Unix()
+	intrusionCutoff := now.Add(-policy.Intrusion).Unix()
+
+	var err error
+	if report.TelemetryRolledUp, report.HoursUpdated, err = rollUpTelemetry(db, telemetryCutoff); err != nil {
+		return fmt.Errorf("rolling up telemetry: %v", err)
+	}
+	if report.IntrusionsDeleted, err = deleteEvents(db, "event = ? AND "+eventTime+" < ?", eventIntrusion, intrusionCutoff); err != nil {
+		return fmt.Errorf("deleting intrusions: %v", err)
+	}
+	// A verdict goes with its intrusion, unless that is kept for an alert
+	report.VerdictsDeleted, err = deleteEvents(db,
+		"event = ? AND "+eventTime+" < ? AND NOT EXISTS (SELECT 1 FROM events parent WHERE parent.id = events.parent_event_id)",
+		eventYoloVerdict, intrusionCutoff,
+	)
+	if err != nil {
+		return fmt.Errorf("deleting YOLO verdicts: %v", err)
+	}
+
+	// Alerts outlive their events
+	_, err = db.Exec("UPDATE alerts SET event_id = NULL WHERE event_id IS NOT NULL AND NOT EXISTS (SELECT 1 FROM events WHERE events.id = alerts.event_id)")
+	if err != nil {
+		return fmt.Errorf("clearing deleted events from alerts: %v", err)
+	}
+
+	if policy.Aggregates > 0 {
+		result, err := db.Exec("DELETE FROM telemetry_hourly WHERE hour < ?", now.Add(-policy.Aggregates).Unix())
+		if err != nil {
+			return fmt.Errorf("deleting hourly aggregates: %v", err)
+		}
+		report.AggregatesDeleted, _ = result.RowsAffected()
+	}
+
+	err = db.QueryRow(
+		"SELECT COUNT(*) FROM events WHERE (event = ? AND "+eventTime+" < ?) OR (event IN (?, ?) AND "+eventTime+" < ?)",
+		eventTelemetry, telemetryCutoff, eventIntrusion, eventYoloVerdict, intrusionCutoff,
+	).Scan(&report.KeptPastRetention)
+	if err != nil {
+		return err
+	}
+
+	var pageSize, pageCount, freePages int64
+	for pragma, dest := range map[string]*int64{"page_size": &pageSize, "page_count": &pageCount, "freelist_count": &freePages} {
+		if err := db.QueryRow("PRAGMA " + pragma).Scan(dest); err != nil {
+			return err
+		}
+	}
+	report.DatabaseBytes = pageSize * pageCount
+	report.FreeBytes = pageSize * freePages
+	return nil
+}
+
+// activeAlertEvents selects the events referenced by open or acknowledged alerts
+var activeAlertEvents = fmt.Sprintf("SELECT event_id FROM alerts WHERE event_id IS NOT NULL AND state IN ('%s', '%s')", alertOpen, alertAcknowledged)
+
+// rollUpTelemetry merges the telemetry received before cutoff into telemetry_hourly and deletes it, returning the
+// number of events rolled up and of hourly rows written
+func rollUpTelemetry(db *sql.DB, cutoff int64) (int64, int64, error) {
+	where := "event = ? AND " + eventTime + " < ? AND id NOT IN (" + activeAlertEvents + ")"
+	var rolledUp, hours int64
+	for {
+		tx, err := db.Begin()
+		if err != nil {
+			return rolledUp, hours, err
+		}
+
+		// The batch is every matching event up to the ID of the compactionBatch-th one
+		var lastID sql.NullInt64
+		err = tx.QueryRow("SELECT MAX(id) FROM (SELECT id FROM events WHERE "+where+" ORDER BY id LIMIT ?)", eventTelemetry, cutoff, compactionBatch).Scan(&lastID)
+		if err != nil || !lastID.Valid {
+			tx.Rollback()
+			return rolledUp, hours, err
+		}
+
+		result, err := tx.Exec(`
+		INSERT INTO telemetry_hourly (client_id, hour, samples, loudness_samples, loudness_min, loudness_max, loudness_sum, movement_count)
+		SELECT client_id, t - t % 3600, COUNT(*), COUNT(loudness), MIN(loudness), MAX(loudness), TOTAL(loudness), SUM(movement)
+		FROM (
+			SELECT COALESCE(client_id, '') AS client_id, `+eventTime+` AS t,
+				CASE WHEN json_type(data, '$.loudness') IN ('integer', 'real') THEN json_extract(data, '$.loudness') END AS loudness,
+				COALESCE(json_type(data, '$.movement_detected') = 'true', 0) AS movement
+			FROM (SELECT client_id, received_at, local_timestamp, CASE WHEN json_valid(data) THEN data END AS data FROM events WHERE `+where+` AND id <= ?)
+		)
+		WHERE true
+		GROUP BY client_id, t - t % 3600
+		ON CONFLICT (client_id, hour) DO UPDATE SET
+			samples = samples + excluded.samples,
+			loudness_samples = loudness_samples + excluded.loudness_samples,
+			loudness_min = CASE WHEN loudness_min IS NULL OR excluded.loudness_min < loudness_min THEN excluded.loudness_min ELSE loudness_min END,
+			loudness_max = CASE WHEN loudness_max IS NULL OR excluded.loudness_max > loudness_max THEN excluded.loudness_max ELSE loudness_max END,
+			loudness_sum = loudness_sum + excluded.loudness_sum,
+			movement_count = movement_count + excluded.movement_count`,
+			eventTelemetry, cutoff, lastID.Int64,
+		)
+		if err != nil {
+			tx.Rollback()
+			return rolledUp, hours, err
+		}
+		n, _ := result.RowsAffected()
+		hours += n
+
+		result, err = tx.Exec("DELETE FROM events WHERE "+where+" AND id <= ?", eventTelemetry, cutoff, lastID.Int64)
+		if err != nil {
+			tx.Rollback()
+			return rolledUp, hours, err
+		}
+		if err := tx.Commit(); err != nil {
+			return rolledUp, hours, err
+		}
+		n, _ = result.RowsAffected()
+		rolledUp += n
+		if n < compactionBatch {
+			return rolledUp, hours, nil
+		}
+	}
+}
+
+// deleteEvents deletes the events matching where, except those of active alerts, in batches
+func deleteEvents(db *sql.DB, where string, args ...interface{}) (int64, error) {
+	var deleted int64
+	for {
+		result, err := db.Exec(
+			"DELETE FROM events WHERE id IN (SELECT id FROM events WHERE "+where+" AND id NOT IN ("+activeAlertEvents+") ORDER BY id LIMIT ?)",
+			append(args, compactionBatch)...,
+		)
+		if err != nil {
+			return deleted, err
+		}
+		n, _ := result.RowsAffected()
+		deleted += n
+		if n < compactionBatch {
+			return deleted, nil
+		}
+	}
+}
+
+// Summary describes the report in one line
+func (c Compaction) Summary() string {
+	return fmt.Sprintf("rolled up %d telemetry events into %d hourly rows, deleted %d intrusions, %d YOLO verdicts and %d hourly rows, kept %d events past their retention for active alerts; database %d KiB, %d KiB free",
+		c.TelemetryRolledUp, c.HoursUpdated, c.IntrusionsDeleted, c.VerdictsDeleted, c.AggregatesDeleted, c.KeptPastRetention, c.DatabaseBytes>>10, c.FreeBytes>>10)
+}
+
+// listCompactions returns the latest compaction reports, newest first
+func listCompactions(db *sql.DB, limit int) ([]Compaction, error) {
+	rows, err := db.Query(
+		`SELECT id, started_at, finished_at, telemetry_rolled_up, hours_updated, intrusions_deleted, verdicts_deleted,
+		aggregates_deleted, kept_past_retention, database_bytes, free_bytes, error FROM compactions ORDER BY id DESC LIMIT ?`, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	compactions := []Compaction{}
+	for rows.Next() {
+		var c Compaction
+		var startedAt, finishedAt int64
+		var compactionErr sql.NullString
+		err := rows.Scan(&c.ID, &startedAt, &finishedAt, &c.TelemetryRolledUp, &c.HoursUpdated, &c.IntrusionsDeleted, &c.VerdictsDeleted,
+			&c.AggregatesDeleted, &c.KeptPastRetention, &c.DatabaseBytes, &c.FreeBytes, &compactionErr)
+		if err != nil {
+			return nil, err
+		}
+		c.StartedAt = formatTimestamp(startedAt)
+		c.FinishedAt = formatTimestamp(finishedAt)
+		c.Error = compactionErr.String
+		compactions = append(compactions, c)
+	}
+	return compactions, rows.Err()
+}
+
+// listTelemetryHours returns the hourly telemetry aggregates, newest first. from and to are Unix seconds, 0 does not filter.
+func listTelemetryHours(db *sql.DB, clientID string, from int64, to int64, limit int) ([]TelemetryHour, error) {
+	query := `SELECT client_id, hour, samples, loudness_min, loudness_max,
+		CASE WHEN loudness_samples > 0 THEN loudness_sum / loudness_samples END, movement_count FROM telemetry_hourly WHERE 1 = 1`
+	var args []interface{}
+	if clientID != "" {
+		query += " AND client_id = ?"
+		args = append(args, clientID)
+	}
+	if from != 0 {
+		query += " AND hour >= ?"
+		args = append(args, from)
+	}
+	if to != 0 {
+		query += " AND hour < ?"
+		args = append(args, to)
+	}
+	query += " ORDER BY hour DESC, client_id LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	hours := []TelemetryHour{}
+	for rows.Next() {
+		var h TelemetryHour
+		var hour int64
+		var loudnessMin, loudnessMax, loudnessAvg sql.NullFloat64
+		if err := rows.Scan(&h.ClientID, &hour, &h.Samples, &loudnessMin, &loudnessMax, &loudnessAvg, &h.MovementCount); err != nil {
+			return nil, err
+		}
+		h.Hour = formatTimestamp(hour)
+		h.LoudnessMin = nullableFloat(loudnessMin)
+		h.LoudnessMax = nullableFloat(loudnessMax)
+		h.LoudnessAvg = nullableFloat(loudnessAvg)
+		hours = append(hours, h)
+	}
+	return hours, rows.Err()
+}
+
+func nullableFloat(value sql.NullFloat64) *float64 {
+	if !value.Valid {
+		return nil
+	}
+	return &value.Float64
+}
@@ -0,0 +1,345 @@
+// This file implements the gateway configuration. Settings are resolved in this order, later sources win:
+//
+//	built-in defaults < YAML file (-config or GATEWAY_CONFIG) < GATEWAY_* environment variables < command line flags
+//
+// The configuration is validated before the gateway starts. On SIGHUP it is resolved again from the same sources;
+// the settings that can change at runtime (see reloadConfig) are applied, the rest only take effect after a restart.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds all settings of the gateway
+type Config struct {
+	MQTT      MQTTConfig      `yaml:"mqtt"`
+	Database  DatabaseConfig  `yaml:"database"`
+	HTTP      HTTPConfig      `yaml:"http"`
+	YOLO      YOLOConfig      `yaml:"yolo"`
+	Health    HealthConfig    `yaml:"health"`
+	Snapshots SnapshotsConfig `yaml:"snapshots"`
+	Clock     ClockConfig     `yaml:"clock"`
+	Retention RetentionConfig `yaml:"retention"`
+	Devices   DevicesConfig   `yaml:"devices"`
+}
+
+type MQTTConfig struct {
+	Broker   string `yaml:"broker"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	ClientID string `yaml:"client_id"`
+	Topic    string `yaml:"topic"`
+}
+
+type DatabaseConfig struct {
+	Path string `yaml:"path"`
+}
+
+type HTTPConfig struct {
+	Listen string `yaml:"listen"`
+}
+
+type YOLOConfig struct {
+	URL       string `yaml:"url"`
+	Workers   int    `yaml:"workers"`
+	QueueSize int    `yaml:"queue_size"`
+}
+
+// HealthConfig holds the health check settings. The thresholds count consecutive failed checks.
+type HealthConfig struct {
+	Interval      time.Duration `yaml:"interval"`
+	DegradedAfter int           `yaml:"degraded_after"`
+	OfflineAfter  int           `yaml:"offline_after"`
+	Concurrency   int           `yaml:"concurrency"` // devices checked at the same time
+	Notify        []string      `yaml:"notify"`      // channels notified when a device goes offline
+}
+
+type SnapshotsConfig struct {
+	Retention time.Duration `yaml:"retention"`
+}
+
+// RetentionConfig holds how long events are kept, see compaction.go
+type RetentionConfig struct {
+	Telemetry  time.Duration `yaml:"telemetry"`  // raw telemetry, rolled up into hourly aggregates when deleted
+	Intrusion  time.Duration `yaml:"intrusion"`  // intrusions and their YOLO verdicts
+	Aggregates time.Duration `yaml:"aggregates"` // hourly telemetry aggregates, 0 keeps them forever
+	Interval   time.Duration `yaml:"interval"`   // time between compactions
+}
+
+// DevicesConfig holds the settings of the requests to the devices, see device_http.go
+type DevicesConfig struct {
+	Timeout time.Duration `yaml:"timeout"` // deadline of each request, snapshots have their own
+}
+
+// ClockConfig holds the clock skew detection settings, see clock.go
+type ClockConfig struct {
+	MaxSkew time.Duration `yaml:"max_skew"`
+	Notify  []string      `yaml:"notify"` // channels notified when the clock of a device drifts
+}
+
+// defaultConfig returns the settings used when nothing else is configured
+func defaultConfig() *Config {
+	return &Config{
+		MQTT: MQTTConfig{
+			Broker:   "tcp://127.0.0.1:1883",
+			ClientID: "go-subscriber",
+			Topic:    "uol/uol-cm3070-mod11",
+		},
+		Database: DatabaseConfig{Path: "client_data.db"},
+		HTTP:     HTTPConfig{Listen: "0.0.0.0:8080"},
+		YOLO: YOLOConfig{
+			URL:       "http://localhost:8081/infer",
+			Workers:   2,
+			QueueSize: 32,
+		},
+		Health: HealthConfig{
+			Interval:      30 * time.Second,
+			DegradedAfter: 1,
+			OfflineAfter:  3,
+			Concurrency:   8,
+		},
+		Snapshots: SnapshotsConfig{Retention: 30 * 24 * time.Hour},
+		Clock:     ClockConfig{MaxSkew: 5 * time.Minute},
+		Retention: RetentionConfig{
+			Telemetry: 7 * 24 * time.Hour,
+			Intrusion: 365 * 24 * time.Hour,
+			Interval:  time.Hour,
+		},
+		Devices: DevicesConfig{Timeout: 5 * time.Second},
+	}
+}
+
+// configSetting is a setting that can be overridden by an environment variable and a command line flag
+type configSetting struct {
+	flag   string
+	env    string
+	usage  string
+	field  func(*Config) interface{} // pointer to the field in the config
+	secret bool                      // environment or file only, flags show up in the process list
+}
+
+var configSettings = []configSetting{
+	{"mqtt-broker", "GATEWAY_MQTT_BROKER", "MQTT broker URL", func(c *Config) interface{} { return &c.MQTT.Broker }, false},
+	{"mqtt-username", "GATEWAY_MQTT_USERNAME", "MQTT username", func(c *Config) interface{} { return &c.MQTT.Username }, true},
+	{"mqtt-password", "GATEWAY_MQTT_PASSWORD", "MQTT password", func(c *Config) interface{} { return &c.MQTT.Password }, true},
+	{"mqtt-client-id", "GATEWAY_MQTT_CLIENT_ID", "MQTT client ID", func(c *Config) interface{} { return &c.MQTT.ClientID }, false},
+	{"mqtt-topic", "GATEWAY_MQTT_TOPIC", "MQTT topic the devices publish to", func(c *Config) interface{} { return &c.MQTT.Topic }, false},
+	{"db", "GATEWAY_DB_PATH", "path of the SQLite database", func(c *Config) interface{} { return &c.Database.Path }, false},
+	{"listen", "GATEWAY_HTTP_LISTEN", "address of the web interface", func(c *Config) interface{} { return &c.HTTP.Listen }, false},
+	{"yolo-url", "GATEWAY_YOLO_URL", "endpoint of the YOLO inference service", func(c *Config) interface{} { return &c.YOLO.URL }, false},
+	{"yolo-workers", "GATEWAY_YOLO_WORKERS", "number of inference workers", func(c *Config) interface{} { return &c.YOLO.Workers }, false},
+	{"yolo-queue-size", "GATEWAY_YOLO_QUEUE_SIZE", "maximum number of queued inference jobs", func(c *Config) interface{} { return &c.YOLO.QueueSize }, false},
+	{"health-interval", "GATEWAY_HEALTH_INTERVAL", "time between device health checks", func(c *Config) interface{} { return &c.Health.Interval }, false},
+	{"health-degraded-after", "GATEWAY_HEALTH_DEGRADED_AFTER", "failed health checks before a device is degraded", func(c *Config) interface{} { return &c.Health.DegradedAfter }, false},
+	{"health-offline-after", "GATEWAY_HEALTH_OFFLINE_AFTER", "failed health checks before a device is offline", func(c *Config) interface{} { return &c.Health.OfflineAfter }, false},
+	{"health-concurrency", "GATEWAY_HEALTH_CONCURRENCY", "number of devices checked at the same time", func(c *Config) interface{} { return &c.Health.Concurrency }, false},
+	{"health-notify", "GATEWAY_HEALTH_NOTIFY", "comma separated channels notified when a device goes offline", func(c *Config) interface{} { return &c.Health.Notify }, false},
+	{"snapshot-retention", "GATEWAY_SNAPSHOT_RETENTION", "how long unused snapshots are kept", func(c *Config) interface{} { return &c.Snapshots.Retention }, false},
+	{"clock-max-skew", "GATEWAY_CLOCK_MAX_SKEW", "largest difference between a device clock and the gateway before events are flagged", func(c *Config) interface{} { return &c.Clock.MaxSkew }, false},
+	{"clock-notify", "GATEWAY_CLOCK_NOTIFY", "comma separated channels notified when the clock of a device drifts", func(c *Config) interface{} { return &c.Clock.Notify }, false},
+	{"retention-telemetry", "GATEWAY_RETENTION_TELEMETRY", "how long raw telemetry is kept before it is rolled up into hourly aggregates", func(c *Config) interface{} { return &c.Retention.Telemetry }, false},
+	{"retention-intrusion", "GATEWAY_RETENTION_INTRUSION", "how long intrusions and their YOLO verdicts are kept", func(c *Config) interface{} { return &c.Retention.Intrusion }, false},
+	{"retention-aggregates", "GATEWAY_RETENTION_AGGREGATES", "how long hourly telemetry aggregates are kept, 0 keeps them forever", func(c *Config) interface{} { return &c.Retention.Aggregates }, false},
+	{"retention-interval", "GATEWAY_RETENTION_INTERVAL", "time between compactions of the events table", func(c *Config) interface{} { return &c.Retention.Interval }, false},
+	{"device-timeout", "GATEWAY_DEVICE_TIMEOUT", "deadline of each health check and settings request to a device", func(c *Config) interface{} { return &c.Devices.Timeout }, false},
+}
+
+// setConfigValue parses value into the config field pointed to by field
+func setConfigValue(field interface{}, value string) error {
+	switch field := field.(type) {
+	case *string:
+		*field = value
+	case *int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+		*field = n
+	case *time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return fmt.Errorf("%q is not a duration", value)
+		}
+		*field = d
+	case *[]string:
+		*field = []string{}
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				*field = append(*field, item)
+			}
+		}
+	default:
+		return fmt.Errorf("unsupported setting type %T", field)
+	}
+	return nil
+}
+
+// ConfigSource remembers where the configuration came from, so it can be resolved again on SIGHUP
+type ConfigSource struct {
+	Path  string
+	Flags map[string]string // flags given on the command line, by name
+}
+
+// parseFlags reads the command line into a ConfigSource and returns the arguments after the flags
+func parseFlags(args []string) (ConfigSource, []string, error) {
+	source := ConfigSource{Path: os.Getenv("GATEWAY_CONFIG"), Flags: map[string]string{}}
+
+	fs := flag.NewFlagSet("uol-gateway", flag.ContinueOnError)
+	fs.StringVar(&source.Path, "config", source.Path, "path of the YAML configuration file")
+	for _, setting := range configSettings {
+		if setting.secret {
+			continue
+		}
+		name := setting.flag
+		fs.Func(name, setting.usage+" (env "+setting.env+")", func(value string) error {
+			if err := setConfigValue(setting.field(defaultConfig()), value); err != nil {
+				return err
+			}
+			source.Flags[name] = value
+			return nil
+		})
+	}
+	if err := fs.Parse(args); err != nil {
+		return source, nil, err
+	}
+	return source, fs.Args(), nil
+}
+
+// loadConfig resolves and validates the configuration from its sources
+func loadConfig(source ConfigSource) (*Config, error) {
+	config := defaultConfig()
+
+	if source.Path != "" {
+		data, err := os.ReadFile(source.Path)
+		if err != nil {
+			return nil, err
+		}
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil && !errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("%s: %v", source.Path, err)
+		}
+	}
+
+	for _, setting := range configSettings {
+		if value, ok := os.LookupEnv(setting.env); ok {
+			if err := setConfigValue(setting.field(config), value); err != nil {
+				return nil, fmt.Errorf("%s: %v", setting.env, err)
+			}
+		}
+		if value, ok := source.Flags[setting.flag]; ok {
+			if err := setConfigValue(setting.field(config), value); err != nil {
+				return nil, fmt.Errorf("-%s: %v", setting.flag, err)
+			}
+		}
+	}
+
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// validate reports every invalid setting at once
+func (c *Config) validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	broker, err := url.Parse(c.MQTT.Broker)
+	check(err == nil && broker.Host != "", "mqtt.broker: %q is not a URL", c.MQTT.Broker)
+	if err == nil {
+		switch broker.Scheme {
+		case "tcp", "ssl", "tls", "mqtt", "mqtts", "ws", "wss":
+		default:
+			check(false, "mqtt.broker: unsupported scheme %q", broker.Scheme)
+		}
+	}
+	check(c.MQTT.Password == "" || c.MQTT.Username != "", "mqtt.password is set without mqtt.username")
+	check(c.MQTT.ClientID != "", "mqtt.client_id is required")
+	check(c.MQTT.Topic != "", "mqtt.topic is required")
+
+	check(c.Database.Path != "", "database.path is required")
+
+	_, _, err = net.SplitHostPort(c.HTTP.Listen)
+	check(err == nil, "http.listen: %q is not a host:port address", c.HTTP.Listen)
+
+	yoloURL, err := url.Parse(c.YOLO.URL)
+	check(err == nil && (yoloURL.Scheme == "http" || yoloURL.Scheme == "https") && yoloURL.Host != "", "yolo.url: %q is not an http(s) URL", c.YOLO.URL)
+	check(c.YOLO.Workers > 0, "yolo.workers must be positive")
+	check(c.YOLO.QueueSize > 0, "yolo.queue_size must be positive")
+
+	check(c.Health.Interval >= time.Second, "health.interval must be at least 1s")
+	check(c.Health.DegradedAfter > 0, "health.degraded_after must be positive")
+	check(c.Health.OfflineAfter >= c.Health.DegradedAfter, "health.offline_after must not be less than health.degraded_after")
+	check(c.Health.Concurrency > 0, "health.concurrency must be positive")
+
+	check(c.Snapshots.Retention > 0, "snapshots.retention must be positive")
+
+	check(c.Clock.MaxSkew >= time.Second, "clock.max_skew must be at least 1s")
+
+	check(c.Retention.Telemetry >= time.Hour, "retention.telemetry must be at least 1h")
+	check(c.Retention.Intrusion >= time.Hour, "retention.intrusion must be at least 1h")
+	check(c.Retention.Aggregates >= 0, "retention.aggregates must not be negative")
+	check(c.Retention.Interval >= time.Minute, "retention.interval must be at least 1m")
+
+	check(c.Devices.Timeout >= 100*time.Millisecond, "devices.timeout must be at least 100ms")
+
+	return errors.Join(errs...)
+}
+
+// activeConfig is the configuration in use, replaced as a whole on reload
+var activeConfig atomic.Pointer[Config]
+
+func init() {
+	activeConfig.Store(defaultConfig())
+}
+
+// currentConfig returns the configuration in use. Callers must not modify it.
+func currentConfig() *Config {
+	return activeConfig.Load()
+}
+
+// reloadConfig resolves the configuration again and applies the settings that can change at runtime: the YOLO URL,
+// the health check, snapshot retention, clock skew, retention and device request settings. Everything else,
+// including the credentials, is kept until the next restart.
+func reloadConfig(source ConfigSource) error {
+	next, err := loadConfig(source)
+	if err != nil {
+		return err
+	}
+	current := currentConfig()
+
+	reloaded := *current
+	reloaded.YOLO.URL = next.YOLO.URL
+	reloaded.Health = next.Health
+	reloaded.Snapshots = next.Snapshots
+	reloaded.Clock = next.Clock
+	reloaded.Retention = next.Retention
+	reloaded.Devices = next.Devices
+
+	if next.MQTT != current.MQTT || next.Database != current.Database || next.HTTP != current.HTTP ||
+		next.YOLO.Workers != current.YOLO.Workers || next.YOLO.QueueSize != current.YOLO.QueueSize {
+		log.Printf("MQTT, database, HTTP and YOLO worker settings changed, they take effect after a restart\n")
+	}
+	activeConfig.Store(&reloaded)
+	return nil
+}
@@ -0,0 +1,63 @@
+// This file implements the HTTP client for the requests the gateway makes to the devices: /healthz, /get-settings,
+// /update-settings and /capture. An ESP32 can accept a connection and never answer, so every request has a deadline
+// of devices.timeout, and a request made on behalf of an incoming one is also cancelled when that one is. The client
+// is shared, so the connections to a device are kept alive and reused instead of opened for every request.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxDeviceResponse is the largest response read from a device besides snapshots
+const maxDeviceResponse = 64 << 10
+
+// deviceClient sends every request to the devices. It has no timeout of its own, deviceRequest sets one per call.
+var deviceClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   5 * time.Second,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 2, // the ESP32 web server handles few connections at once
+		IdleConnTimeout:     90 * time.Second,
+	},
+}
+
+// deviceRequest sends a request to the device at ip, a POST of form when form is not nil, and passes the response
+// to handle. The request is cancelled with ctx or after devices.timeout. What handle leaves of the body is drained,
+// so the connection can be reused.
+func deviceRequest(ctx context.Context, ip string, path string, form url.Values, handle func(*http.Response) error) error {
+	ctx, cancel := context.WithTimeout(ctx, currentConfig().Devices.Timeout)
+	defer cancel()
+
+	method, body := http.MethodGet, io.Reader(nil)
+	if form != nil {
+		method, body = http.MethodPost, strings.NewReader(form.Encode())
+	}
+	req, err := http.NewRequestWithContext(ctx, method, fmt.Sprintf("http://%s%s", ip, path), body)
+	if err != nil {
+		return err
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+
+	resp, err := deviceClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		io.Copy(io.Discard, io.LimitReader(resp.Body, maxDeviceResponse))
+		resp.Body.Close()
+	}()
+	return handle(resp)
+}
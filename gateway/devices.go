@@ -0,0 +1,197 @@
+// This file implements the device registry. Every device that registers over MQTT is stored in the devices table,
+// together with the addresses it used, so the gateway knows its devices again right after a restart instead of
+// waiting for each ESP32 to re-register. gatewayState (see state.go) keeps the in-memory view used on hot paths
+// and is rebuilt from the table at startup.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	// errDeviceNotFound is returned when a device is not in the registry
+	errDeviceNotFound = errors.New("device not found")
+	// errInvalidDeviceInfo wraps the validation errors of updateDeviceInfo
+	errInvalidDeviceInfo = errors.New("invalid device info")
+)
+
+// Device struct to hold a row of the devices table
+type Device struct {
+	ID        string          `json:"client_id"`
+	IP        string          `json:"ip"`
+	Type      string          `json:"device_type"`
+	Firmware  string          `json:"firmware,omitempty"`
+	Name      string          `json:"name"`
+	Location  string          `json:"location"`
+	Group     string          `json:"group"`
+	Latitude  *float64        `json:"latitude"`
+	Longitude *float64        `json:"longitude"`
+	FirstSeen string          `json:"first_seen"`
+	LastSeen  string          `json:"last_seen"`
+	IPHistory []DeviceAddress `json:"ip_history,omitempty"`
+
+	// HealthState is online, degraded, offline or decommissioned, see health.go
+	HealthState         string `json:"health_state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+
+	// ClockOffset is the difference between the device clock and the gateway in seconds at ClockCheckedAt, see clock.go
+	ClockOffset    *int64 `json:"clock_offset"`
+	ClockCheckedAt string `json:"clock_checked_at,omitempty"`
+}
+
+// DeviceAddress is an IP address a device registered with
+type DeviceAddress struct {
+	IP        string `json:"ip"`
+	FirstSeen string `json:"first_seen"`
+	LastSeen  string `json:"last_seen"`
+}
+
+const deviceColumns = "client_id, ip, device_type, firmware, name, location, device_group, latitude, longitude, first_seen, last_seen, health_state, consecutive_failures, clock_offset, clock_checked_at"
+
+func scanDevice(row scanner) (Device, error) {
+	var device Device
+	var firmware sql.NullString
+	var latitude, longitude sql.NullFloat64
+	var firstSeen, lastSeen int64
+	var clockOffset, clockCheckedAt sql.NullInt64
+	if err := row.Scan(&device.ID, &device.IP, &device.Type, &firmware, &device.Name, &device.Location, &device.Group, &latitude, &longitude, &firstSeen, &lastSeen, &device.HealthState, &device.ConsecutiveFailures, &clockOffset, &clockCheckedAt); err != nil {
+		return device, err
+	}
+	if clockOffset.Valid {
+		device.ClockOffset = &clockOffset.Int64
+		device.ClockCheckedAt = formatTimestamp(clockCheckedAt.Int64)
+	}
+	if latitude.Valid && longitude.Valid {
+		device.Latitude, device.Longitude = &latitude.Float64, &longitude.Float64
+	}
+	device.Firmware = firmware.String
+	device.FirstSeen = formatTimestamp(firstSeen)
+	device.LastSeen = formatTimestamp(lastSeen)
+	return device, nil
+}
+
+func loadDevices(db *sql.DB) ([]Device, error) {
+	rows, err := db.Query("SELECT " + deviceColumns + " FROM devices ORDER BY client_id")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []Device{}
+	for rows.Next() {
+		device, err := scanDevice(rows)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, rows.Err()
+}
+
+// getDevice returns a device including the addresses it registered with, most recent first
+func getDevice(db *sql.DB, clientID string) (Device, error) {
+	device, err := scanDevice(db.QueryRow("SELECT "+deviceColumns+" FROM devices WHERE client_id = ?", clientID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return device, errDeviceNotFound
+	} else if err != nil {
+		return device, err
+	}
+
+	rows, err := db.Query("SELECT ip, first_seen, last_seen FROM device_addresses WHERE client_id = ? ORDER BY last_seen DESC", clientID)
+	if err != nil {
+		return device, err
+	}
+	defer rows.Close()
+
+	device.IPHistory = []DeviceAddress{}
+	for rows.Next() {
+		var address DeviceAddress
+		var firstSeen, lastSeen int64
+		if err := rows.Scan(&address.IP, &firstSeen, &lastSeen); err != nil {
+			return device, err
+		}
+		address.FirstSeen = formatTimestamp(firstSeen)
+		address.LastSeen = formatTimestamp(lastSeen)
+		device.IPHistory = append(device.IPHistory, address)
+	}
+	return device, rows.Err()
+}
+
+// registerDevice records a registration: the device is added on first sight, otherwise its address, type and firmware are updated
+func registerDevice(db *sql.DB, client ClientInfo, firmware string) error {
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO devices (client_id, ip, device_type, firmware, first_seen, last_seen) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (client_id) DO UPDATE SET ip = excluded.ip, device_type = excluded.device_type,
+			firmware = COALESCE(excluded.firmware, firmware), last_seen = excluded.last_seen`,
+		client.ID, client.IP, client.Type, nullableString(firmware), now, now,
+	)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO device_addresses (client_id, ip, first_seen, last_seen) VALUES (?, ?, ?, ?)
+		ON CONFLICT (client_id, ip) DO UPDATE SET last_seen = excluded.last_seen`,
+		client.ID, client.IP, now, now,
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// touchDevice updates when a device was last heard from
+func touchDevice(db *sql.DB, clientID string) error {
+	_, err := db.Exec("UPDATE devices SET last_seen = ? WHERE client_id = ?", time.Now().Unix(), clientID)
+	return err
+}
+
+// updateDeviceInfo sets the operator-maintained fields of a device. The coordinates are both set or both nil,
+// a nil group keeps the current one.
+func updateDeviceInfo(db *sql.DB, clientID string, name string, location string, group *string, latitude *float64, longitude *float64) error {
+	if (latitude == nil) != (longitude == nil) {
+		return fmt.Errorf("%w: latitude and longitude must be set together", errInvalidDeviceInfo)
+	}
+	if latitude != nil && (*latitude < -90 || *latitude > 90 || *longitude < -180 || *longitude > 180) {
+		return fmt.Errorf("%w: coordinates out of range: %v, %v", errInvalidDeviceInfo, *latitude, *longitude)
+	}
+	result, err := db.Exec(
+		"UPDATE devices SET name = ?, location = ?, device_group = COALESCE(?, device_group), latitude = ?, longitude = ? WHERE client_id = ?",
+		name, location, group, latitude, longitude, clientID,
+	)
+	return expectOneRow(result, err, errDeviceNotFound)
+}
+
+// loadClientData rebuilds the in-memory clients of gatewayState from the registry
+func loadClientData(db *sql.DB) error {
+	devices, err := loadDevices(db)
+	if err != nil {
+		return err
+	}
+	for _, device := range devices {
+		gatewayState.SetClient(ClientInfo{
+			ID:   device.ID,
+			IP:   device.IP,
+			Type: device.Type,
+		})
+	}
+	return nil
+}
+
+// nullableString maps an empty string to NULL
+func nullableString(value string) interface{} {
+	if value == "" {
+		return nil
+	}
+	return value
+}
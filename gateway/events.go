@@ -0,0 +1,313 @@
+// This file implements queries over the events table. Results are paged with an opaque cursor that encodes the
+// sort value and ID of the last event returned, so pages stay stable while new events arrive, unlike OFFSET paging.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Event struct to hold a row of the events table
+type Event struct {
+	ID             int64                  `json:"id"`
+	ClientID       string                 `json:"client_id"`
+	Type           string                 `json:"type"`
+	LocalTimestamp string                 `json:"local_timestamp"`
+	ReceivedAt     string                 `json:"received_at,omitempty"`
+	Event          string                 `json:"event"`
+	Data           map[string]interface{} `json:"data"`
+	ParentEventID  int64                  `json:"parent_event_id,omitempty"` // yolo_verdict events point at the intrusion they classify
+	SnapshotHash   string                 `json:"snapshot,omitempty"`
+	ClockOffset    *int64                 `json:"clock_offset,omitempty"`   // local_timestamp - received_at in seconds
+	TimestampFlag  string                 `json:"timestamp_flag,omitempty"` // unsynced or skewed when local_timestamp cannot be trusted, see clock.go
+
+	// Unix seconds of LocalTimestamp and ReceivedAt, 0 when unknown
+	localUnix    int64
+	receivedUnix int64
+}
+
+// Sort orders of the events query
+var eventSortColumns = map[string]string{
+	"id":              "id",
+	"local_timestamp": "local_timestamp",
+	"received_at":     "COALESCE(received_at, 0)",
+}
+
+// EventFilter selects and orders events. Zero values do not filter.
+type EventFilter struct {
+	ClientID      string
+	Event         string // event type, e.g. telemetry, intrusion or yolo_verdict
+	From, To      int64  // local_timestamp range in Unix seconds, To is exclusive
+	ReceivedFrom  int64  // received_at range in Unix seconds, ReceivedTo is exclusive
+	ReceivedTo    int64
+	TimestampFlag string  // unsynced or skewed, "any" for both and "none" for plausible timestamps
+	Species       string  // predicted_animal of intrusions or species of YOLO verdicts
+	MinConfidence float64 // predicted_confidence of intrusions or confidence of YOLO verdicts, 0-100
+	Sort          string  // a key of eventSortColumns
+	Descending    bool
+	Cursor        string
+	Limit         int // 0 means no limit
+}
+
+// eventCursor is the position after the last event of a page
+type eventCursor struct {
+	Value int64 `json:"v"`
+	ID    int64 `json:"id"`
+}
+
+const eventColumns = "id, client_id, type, local_timestamp, received_at, event, data, parent_event_id, snapshot_hash, clock_offset, timestamp_flag"
+
+// parseEventFilter reads an EventFilter from the query parameters client_id, event, from, to, received_from,
+// received_to, timestamp_flag, species, min_confidence, sort, order, cursor and limit
+func parseEventFilter(query url.Values) (EventFilter, error) {
+	filter := EventFilter{
+		ClientID:      query.Get("client_id"),
+		Event:         query.Get("event"),
+		TimestampFlag: query.Get("timestamp_flag"),
+		Species:       query.Get("species"),
+		Sort:          query.Get("sort"),
+		Cursor:        query.Get("cursor"),
+	}
+	switch filter.TimestampFlag {
+	case "", "any", "none", timestampUnsynced, timestampSkewed:
+	default:
+		return filter, fmt.Errorf("invalid timestamp_flag: %s", filter.TimestampFlag)
+	}
+
+	var err error
+	for name, dest := range map[string]*int64{"from": &filter.From, "to": &filter.To, "received_from": &filter.ReceivedFrom, "received_to": &filter.ReceivedTo} {
+		if *dest, err = parseTimeParam(query.Get(name)); err != nil {
+			return filter, fmt.Errorf("invalid %s: %v", name, err)
+		}
+	}
+	if value := query.Get("min_confidence"); value != "" {
+		if filter.MinConfidence, err = strconv.ParseFloat(value, 64); err != nil {
+			return filter, fmt.Errorf("invalid min_confidence: %s", value)
+		}
+	}
+
+	if filter.Sort == "" {
+		filter.Sort = "id"
+	}
+	if _, ok := eventSortColumns[filter.Sort]; !ok {
+		return filter, fmt.Errorf("invalid sort: %s", filter.Sort)
+	}
+	switch query.Get("order") {
+	case "", "desc":
+		filter.Descending = true
+	case "asc":
+	default:
+		return filter, fmt.Errorf("invalid order: %s", query.Get("order"))
+	}
+
+	if value := query.Get("limit"); value != "" {
+		if filter.Limit, err = strconv.Atoi(value); err != nil || filter.Limit < 1 {
+			return filter, fmt.Errorf("invalid limit: %s", value)
+		}
+	}
+	return filter, nil
+}
+
+// parseTimeParam accepts Unix seconds, RFC 3339 or a local date and time as sent by an HTML datetime-local input
+func parseTimeParam(value string) (int64, error) {
+	if value == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return unix, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t.Unix(), nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, fmt.Errorf("%q is not a time", value)
+}
+
+// eventQuery builds the SQL for a filter
+func eventQuery(filter EventFilter) (string, []interface{}, error) {
+	sortColumn, ok := eventSortColumns[filter.Sort]
+	if filter.Sort == "" {
+		sortColumn, ok = "id", true
+	}
+	if !ok {
+		return "", nil, fmt.Errorf("invalid sort: %s", filter.Sort)
+	}
+
+	where := " WHERE 1 = 1"
+	var args []interface{}
+	if filter.ClientID != "" {
+		where += " AND client_id = ?"
+		args = append(args, filter.ClientID)
+	}
+	if filter.Event != "" {
+		where += " AND event = ?"
+		args = append(args, filter.Event)
+	}
+	if filter.From != 0 {
+		where += " AND local_timestamp >= ?"
+		args = append(args, filter.From)
+	}
+	if filter.To != 0 {
+		where += " AND local_timestamp < ?"
+		args = append(args, filter.To)
+	}
+	if filter.ReceivedFrom != 0 {
+		where += " AND received_at >= ?"
+		args = append(args, filter.ReceivedFrom)
+	}
+	if filter.ReceivedTo != 0 {
+		where += " AND received_at < ?"
+		args = append(args, filter.ReceivedTo)
+	}
+	switch filter.TimestampFlag {
+	case "":
+	case "any":
+		where += " AND timestamp_flag IS NOT NULL"
+	case "none":
+		where += " AND timestamp_flag IS NULL"
+	default:
+		where += " AND timestamp_flag = ?"
+		args = append(args, filter.TimestampFlag)
+	}
+	if filter.Species != "" {
+		where += " AND LOWER(COALESCE(json_extract(data, '$.species'), json_extract(data, '$.predicted_animal'))) = ?"
+		args = append(args, strings.ToLower(filter.Species))
+	}
+	if filter.MinConfidence != 0 {
+		where += " AND COALESCE(json_extract(data, '$.confidence'), json_extract(data, '$.predicted_confidence')) >= ?"
+		args = append(args, filter.MinConfidence)
+	}
+
+	direction, comparison := "ASC", ">"
+	if filter.Descending {
+		direction, comparison = "DESC", "<"
+	}
+	if filter.Cursor != "" {
+		cursor, err := decodeEventCursor(filter.Cursor)
+		if err != nil {
+			return "", nil, err
+		}
+		where += fmt.Sprintf(" AND (%s %s ? OR (%s = ? AND id %s ?))", sortColumn, comparison, sortColumn, comparison)
+		args = append(args, cursor.Value, cursor.Value, cursor.ID)
+	}
+
+	query := "SELECT " + eventColumns + " FROM events" + where + fmt.Sprintf(" ORDER BY %s %s, id %s", sortColumn, direction, direction)
+	if filter.Limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, filter.Limit)
+	}
+	return query, args, nil
+}
+
+func scanEvent(row scanner) (Event, error) {
+	var event Event
+	var clientID, eventType, data, snapshotHash, timestampFlag sql.NullString
+	var localTimestamp, receivedAt, parentEventID, clockOffset sql.NullInt64
+	if err := row.Scan(&event.ID, &clientID, &eventType, &localTimestamp, &receivedAt, &event.Event, &data, &parentEventID, &snapshotHash, &clockOffset, &timestampFlag); err != nil {
+		return event, err
+	}
+	event.ClientID = clientID.String
+	event.Type = eventType.String
+	event.localUnix = localTimestamp.Int64
+	event.LocalTimestamp = formatTimestamp(localTimestamp.Int64)
+	if receivedAt.Valid {
+		event.receivedUnix = receivedAt.Int64
+		event.ReceivedAt = formatTimestamp(receivedAt.Int64)
+	}
+	event.ParentEventID = parentEventID.Int64
+	event.SnapshotHash = snapshotHash.String
+	if clockOffset.Valid {
+		event.ClockOffset = &clockOffset.Int64
+	}
+	event.TimestampFlag = timestampFlag.String
+	if data.Valid && data.String != "" {
+		if err := json.Unmarshal([]byte(data.String), &event.Data); err != nil {
+			return event, fmt.Errorf("event %d has invalid data: %v", event.ID, err)
+		}
+	}
+	return event, nil
+}
+
+// eachEvent calls fn for every event matching the filter without loading them all into memory
+func eachEvent(db *sql.DB, filter EventFilter, fn func(Event) error) error {
+	query, args, err := eventQuery(filter)
+	if err != nil {
+		return err
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		event, err := scanEvent(rows)
+		if err != nil {
+			return err
+		}
+		if err := fn(event); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// listEvents returns one page of events and the cursor of the next page, empty on the last page
+func listEvents(db *sql.DB, filter EventFilter) ([]Event, string, error) {
+	if filter.Limit < 1 {
+		filter.Limit = 50
+	}
+	pageSize := filter.Limit
+	filter.Limit++ // one more to know whether there is a next page
+
+	events := []Event{}
+	err := eachEvent(db, filter, func(event Event) error {
+		events = append(events, event)
+		return nil
+	})
+	if err != nil || len(events) <= pageSize {
+		return events, "", err
+	}
+
+	events = events[:pageSize]
+	last := events[pageSize-1]
+	cursor := eventCursor{ID: last.ID, Value: last.ID}
+	switch filter.Sort {
+	case "local_timestamp":
+		cursor.Value = last.localUnix
+	case "received_at":
+		cursor.Value = last.receivedUnix
+	}
+	return events, encodeEventCursor(cursor), nil
+}
+
+func encodeEventCursor(cursor eventCursor) string {
+	data, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+func decodeEventCursor(value string) (eventCursor, error) {
+	var cursor eventCursor
+	data, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return cursor, errInvalidCursor
+	}
+	if err := json.Unmarshal(data, &cursor); err != nil {
+		return cursor, errInvalidCursor
+	}
+	return cursor, nil
+}
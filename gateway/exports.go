@@ -0,0 +1,341 @@
+// This file implements the exports of the events table and the alert history as CSV, NDJSON or GeoJSON, served
+// by /_export/events and /_export/alerts and by `uol-gateway export`. Records are streamed from the database to
+// the writer one by one, so an export of any size never loads the whole table into memory.
+//
+// GeoJSON features are placed at the coordinates of their device; events of devices without coordinates have a
+// null geometry.
+//
+// Messages, device names and telemetry come from devices and users, so a CSV cell that a spreadsheet would run as a
+// formula is prefixed with a quote.
+
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Export formats
+const (
+	exportCSV     = "csv"
+	exportNDJSON  = "ndjson"
+	exportGeoJSON = "geojson"
+)
+
+var exportContentTypes = map[string]string{
+	exportCSV:     "text/csv; charset=utf-8",
+	exportNDJSON:  "application/x-ndjson",
+	exportGeoJSON: "application/geo+json",
+}
+
+// exportWriter writes the records of an export in one format
+type exportWriter interface {
+	// Write writes one record, row holds its CSV columns and value its JSON representation
+	Write(clientID string, row []string, value interface{}) error
+	Close() error
+}
+
+func newExportWriter(w io.Writer, format string, header []string, devices map[string]Device) (exportWriter, error) {
+	switch format {
+	case exportCSV:
+		writer := csv.NewWriter(w)
+		return &csvExportWriter{writer: writer}, writer.Write(header)
+	case exportNDJSON:
+		return &ndjsonExportWriter{encoder: json.NewEncoder(w)}, nil
+	case exportGeoJSON:
+		writer := bufio.NewWriter(w)
+		_, err := writer.WriteString(`{"type":"FeatureCollection","features":[`)
+		return &geojsonExportWriter{writer: writer, devices: devices}, err
+	default:
+		return nil, fmt.Errorf("unknown export format: %s", format)
+	}
+}
+
+type csvExportWriter struct {
+	writer *csv.Writer
+}
+
+func (w *csvExportWriter) Write(clientID string, row []string, value interface{}) error {
+	escaped := make([]string, len(row))
+	for i, cell := range row {
+		escaped[i] = escapeCSVFormula(cell)
+	}
+	return w.writer.Write(escaped)
+}
+
+var csvNumberRegex = regexp.MustCompile(`^[+-]?[0-9]+(\.[0-9]+)?$`)
+
+// escapeCSVFormula prefixes a cell starting with a formula character with a quote. Numbers, such as a negative clock
+// offset, cannot be formulas and are kept as they are.
+func escapeCSVFormula(cell string) string {
+	if cell == "" || !strings.ContainsRune("=+-@\t\r", rune(cell[0])) {
+		return cell
+	}
+	if csvNumberRegex.MatchString(cell) {
+		return cell
+	}
+	return "'" + cell
+}
+
+func (w *csvExportWriter) Close() error {
+	w.writer.Flush()
+	return w.writer.Error()
+}
+
+type ndjsonExportWriter struct {
+	encoder *json.Encoder
+}
+
+func (w *ndjsonExportWriter) Write(clientID string, row []string, value interface{}) error {
+	return w.encoder.Encode(value)
+}
+
+func (w *ndjsonExportWriter) Close() error {
+	return nil
+}
+
+type geojsonExportWriter struct {
+	writer   *bufio.Writer
+	devices  map[string]Device
+	features int
+}
+
+// geojsonPoint is a GeoJSON geometry, coordinates are longitude first
+type geojsonPoint struct {
+	Type        string     `json:"type"`
+	Coordinates [2]float64 `json:"coordinates"`
+}
+
+type geojsonFeature struct {
+	Type       string        `json:"type"`
+	Geometry   *geojsonPoint `json:"geometry"`
+	Properties interface{}   `json:"properties"`
+}
+
+func (w *geojsonExportWriter) Write(clientID string, row []string, value interface{}) error {
+	feature := geojsonFeature{Type: "Feature", Properties: value}
+	if device, ok := w.devices[clientID]; ok && device.Latitude != nil {
+		feature.Geometry = &geojsonPoint{Type: "Point", Coordinates: [2]float64{*device.Longitude, *device.Latitude}}
+	}
+	data, err := json.Marshal(feature)
+	if err != nil {
+		return err
+	}
+	if w.features > 0 {
+		if err := w.writer.WriteByte(','); err != nil {
+			return err
+		}
+	}
+	w.features++
+	_, err = w.writer.Write(data)
+	return err
+}
+
+func (w *geojsonExportWriter) Close() error {
+	if _, err := w.writer.WriteString("]}\n"); err != nil {
+		return err
+	}
+	return w.writer.Flush()
+}
+
+// exportDevices returns the registered devices by client ID, for the GeoJSON coordinates
+func exportDevices(db *sql.DB, format string) (map[string]Device, error) {
+	devices := map[string]Device{}
+	if format != exportGeoJSON {
+		return devices, nil
+	}
+	list, err := loadDevices(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, device := range list {
+		devices[device.ID] = device
+	}
+	return devices, nil
+}
+
+var eventExportHeader = []string{"id", "client_id", "type", "event", "local_timestamp", "received_at", "clock_offset", "timestamp_flag", "parent_event_id", "snapshot", "data"}
+
+// exportEvents writes the events matching the filter to w
+func exportEvents(db *sql.DB, w io.Writer, format string, filter EventFilter) error {
+	devices, err := exportDevices(db, format)
+	if err != nil {
+		return err
+	}
+	writer, err := newExportWriter(w, format, eventExportHeader, devices)
+	if err != nil {
+		return err
+	}
+
+	err = eachEvent(db, filter, func(event Event) error {
+		data, _ := json.Marshal(event.Data)
+		parentEventID := ""
+		if event.ParentEventID != 0 {
+			parentEventID = strconv.FormatInt(event.ParentEventID, 10)
+		}
+		clockOffset := ""
+		if event.ClockOffset != nil {
+			clockOffset = strconv.FormatInt(*event.ClockOffset, 10)
+		}
+		row := []string{strconv.FormatInt(event.ID, 10), event.ClientID, event.Type, event.Event, event.LocalTimestamp, event.ReceivedAt, clockOffset, event.TimestampFlag, parentEventID, event.SnapshotHash, string(data)}
+		return writer.Write(event.ClientID, row, event)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+var alertExportHeader = []string{"id", "alert_type", "client_id", "rule_id", "event_id", "message", "state", "timestamp", "last_seen", "occurrences", "acknowledged_by", "acknowledged_at", "resolved_by", "resolved_at", "escalation_level", "action_name", "action_status", "action_error", "snapshot"}
+
+// exportAlerts writes the alerts matching the filter to w
+func exportAlerts(db *sql.DB, w io.Writer, format string, filter AlertFilter) error {
+	devices, err := exportDevices(db, format)
+	if err != nil {
+		return err
+	}
+	writer, err := newExportWriter(w, format, alertExportHeader, devices)
+	if err != nil {
+		return err
+	}
+
+	optionalID := func(id *int64) string {
+		if id == nil {
+			return ""
+		}
+		return strconv.FormatInt(*id, 10)
+	}
+	err = eachAlert(db, filter, func(alert Alert) error {
+		row := []string{
+			strconv.FormatInt(alert.ID, 10), alert.Type, alert.ClientID, optionalID(alert.RuleID), optionalID(alert.EventID),
+			alert.Message, alert.State, alert.Timestamp, alert.LastSeen, strconv.Itoa(alert.Occurrences),
+			alert.AcknowledgedBy, alert.AcknowledgedAt, alert.ResolvedBy, alert.ResolvedAt, strconv.Itoa(alert.EscalationLevel),
+			alert.ActionName, alert.ActionStatus, alert.ActionError, alert.SnapshotHash,
+		}
+		return writer.Write(alert.ClientID, row, alert)
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+// exportFilterParams are the filter query parameters accepted by each export, also offered as flags by the export command
+var exportFilterParams = map[string][]string{
+	"events": {"client_id", "event", "from", "to", "received_from", "received_to", "timestamp_flag", "species", "min_confidence", "sort", "order", "limit"},
+	"alerts": {"state", "client_id", "type", "from", "to"},
+}
+
+// runExport writes the export of table ("events" or "alerts") selected by the query parameters to w.
+// Events are exported oldest first unless order is given.
+func runExport(db *sql.DB, w io.Writer, table string, format string, query url.Values) error {
+	switch table {
+	case "events":
+		filter, err := parseEventFilter(query)
+		if err != nil {
+			return err
+		}
+		if query.Get("order") == "" {
+			filter.Descending = false
+		}
+		return exportEvents(db, w, format, filter)
+	case "alerts":
+		filter, err := parseAlertFilter(query)
+		if err != nil {
+			return err
+		}
+		return exportAlerts(db, w, format, filter)
+	default:
+		return fmt.Errorf("unknown export: %s", table)
+	}
+}
+
+// validateExport checks the parts of an export request that can fail before anything is written
+func validateExport(table string, format string, query url.Values) error {
+	if _, ok := exportContentTypes[format]; !ok {
+		return fmt.Errorf("unknown export format: %s", format)
+	}
+	switch table {
+	case "events":
+		filter, err := parseEventFilter(query)
+		if err != nil {
+			return err
+		}
+		if filter.Cursor != "" {
+			if _, err := decodeEventCursor(filter.Cursor); err != nil {
+				return err
+			}
+		}
+		return nil
+	case "alerts":
+		_, err := parseAlertFilter(query)
+		return err
+	default:
+		return fmt.Errorf("unknown export: %s", table)
+	}
+}
+
+// runExportCommand implements `uol-gateway export events|alerts [-format csv|ndjson|geojson] [-o file] [filters]`,
+// the filters are the query parameters of the export endpoints given as flags, e.g. -client_id or -from
+func runExportCommand(db *sql.DB, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: export events|alerts [-format csv|ndjson|geojson] [-o file] [filters]")
+	}
+	table := args[0]
+	params, ok := exportFilterParams[table]
+	if !ok {
+		return fmt.Errorf("unknown export: %s", table)
+	}
+
+	fs := flag.NewFlagSet("export "+table, flag.ContinueOnError)
+	format := fs.String("format", exportCSV, "csv, ndjson or geojson")
+	output := fs.String("o", "", "output file, standard output by default")
+	query := url.Values{}
+	for _, param := range params {
+		name := param
+		fs.Func(name, "filter by "+name, func(value string) error {
+			query.Set(name, value)
+			return nil
+		})
+	}
+	if err := fs.Parse(args[1:]); err != nil {
+		return err
+	}
+	if err := validateExport(table, *format, query); err != nil {
+		return err
+	}
+
+	if *output == "" {
+		buffered := bufio.NewWriter(os.Stdout)
+		if err := runExport(db, buffered, table, *format, query); err != nil {
+			return err
+		}
+		return buffered.Flush()
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		return err
+	}
+	buffered := bufio.NewWriter(file)
+	if err := runExport(db, buffered, table, *format, query); err != nil {
+		file.Close()
+		return err
+	}
+	if err := buffered.Flush(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
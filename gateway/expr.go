@@ -0,0 +1,477 @@
+// This file implements the small expression language used by rules with the "expression_trigger" trigger.
+// An expression is evaluated against the "data" map of an event, for example:
+//
+//	movement_detected && predicted_confidence > 70 && predicted_animal in ["bear", "wolf"]
+//
+// Supported syntax:
+//   - literals: numbers (70, 0.5), strings ("bear" or 'bear'), true, false and lists (["bear", "wolf"])
+//   - identifiers: keys of the event data map (a missing key evaluates to null)
+//   - comparison: ==, !=, <, <=, >, >=
+//   - membership: in, not in (right hand side must be a list literal)
+//   - logical: &&, ||, ! and parentheses
+//
+// Expressions are validated when a rule is saved, so a broken expression never reaches the matcher. The matcher
+// parses the expression of a rule on its first event and reuses the tree until the expression changes.
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// exprNode is a node of a parsed expression tree
+type exprNode interface {
+	eval(data map[string]interface{}) interface{}
+}
+
+type exprLiteral struct {
+	value interface{}
+}
+
+type exprIdent struct {
+	name string
+}
+
+type exprList struct {
+	items []exprNode
+}
+
+type exprNot struct {
+	operand exprNode
+}
+
+type exprBinary struct {
+	op          string
+	left, right exprNode
+}
+
+type exprIn struct {
+	negate bool
+	left   exprNode
+	list   *exprList
+}
+
+// parseExpression parses src and returns the root of the expression tree
+func parseExpression(src string) (exprNode, error) {
+	tokens, err := tokenizeExpression(src)
+	if err != nil {
+		return nil, err
+	}
+	if len(tokens) == 1 {
+		return nil, fmt.Errorf("empty expression")
+	}
+
+	p := &exprParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+	}
+	return node, nil
+}
+
+// cachedExpression is a parsed rule expression together with its source
+type cachedExpression struct {
+	src  string
+	node exprNode
+}
+
+// ruleExpressions holds the parsed expressions of the rules by rule ID
+var ruleExpressions = struct {
+	mu    sync.Mutex
+	rules map[int]cachedExpression
+}{rules: make(map[int]cachedExpression)}
+
+// ruleExpression returns the parsed expression of a rule, parsing it only when the rule is new or its expression
+// changed. Parse errors are not cached.
+func ruleExpression(ruleID int, src string) (exprNode, error) {
+	ruleExpressions.mu.Lock()
+	defer ruleExpressions.mu.Unlock()
+	if cached, ok := ruleExpressions.rules[ruleID]; ok && cached.src == src {
+		return cached.node, nil
+	}
+	node, err := parseExpression(src)
+	if err != nil {
+		delete(ruleExpressions.rules, ruleID)
+		return nil, err
+	}
+	ruleExpressions.rules[ruleID] = cachedExpression{src: src, node: node}
+	return node, nil
+}
+
+// evaluateExpression evaluates a parsed expression against the event data and reports whether it holds
+func evaluateExpression(node exprNode, data map[string]interface{}) bool {
+	return truthy(node.eval(data))
+}
+
+// Tokenizer
+
+type tokenKind int
+
+const (
+	tokEOF tokenKind = iota
+	tokNumber
+	tokString
+	tokIdent
+	tokOp
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  int
+}
+
+func tokenizeExpression(src string) ([]token, error) {
+	var tokens []token
+	i := 0
+	for i < len(src) {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c >= '0' && c <= '9' || c == '.' || c == '-' && i+1 < len(src) && (src[i+1] >= '0' && src[i+1] <= '9' || src[i+1] == '.') && prevAllowsSign(tokens):
+			start := i
+			i++
+			for i < len(src) && (src[i] >= '0' && src[i] <= '9' || src[i] == '.') {
+				i++
+			}
+			if _, err := strconv.ParseFloat(src[start:i], 64); err != nil {
+				return nil, fmt.Errorf("invalid number %q at position %d", src[start:i], start)
+			}
+			tokens = append(tokens, token{kind: tokNumber, text: src[start:i], pos: start})
+		case c == '"' || c == '\'':
+			start := i
+			i++
+			var sb strings.Builder
+			for i < len(src) && src[i] != c {
+				if src[i] == '\\' && i+1 < len(src) {
+					i++
+				}
+				sb.WriteByte(src[i])
+				i++
+			}
+			if i >= len(src) {
+				return nil, fmt.Errorf("unterminated string at position %d", start)
+			}
+			i++
+			tokens = append(tokens, token{kind: tokString, text: sb.String(), pos: start})
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			start := i
+			for i < len(src) && (src[i] == '_' || src[i] >= 'a' && src[i] <= 'z' || src[i] >= 'A' && src[i] <= 'Z' || src[i] >= '0' && src[i] <= '9') {
+				i++
+			}
+			tokens = append(tokens, token{kind: tokIdent, text: src[start:i], pos: start})
+		default:
+			if i+1 < len(src) {
+				switch two := src[i : i+2]; two {
+				case "&&", "||", "==", "!=", "<=", ">=":
+					tokens = append(tokens, token{kind: tokOp, text: two, pos: i})
+					i += 2
+					continue
+				}
+			}
+			switch c {
+			case '<', '>', '!', '(', ')', '[', ']', ',':
+				tokens = append(tokens, token{kind: tokOp, text: string(c), pos: i})
+				i++
+			default:
+				return nil, fmt.Errorf("unexpected character %q at position %d", c, i)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokEOF, text: "end of expression", pos: len(src)}), nil
+}
+
+// prevAllowsSign reports whether a '-' at the current position starts a negative number rather than being an operator
+func prevAllowsSign(tokens []token) bool {
+	if len(tokens) == 0 {
+		return true
+	}
+	prev := tokens[len(tokens)-1]
+	return prev.kind == tokOp && prev.text != ")" && prev.text != "]" || prev.kind == tokIdent && prev.text == "in"
+}
+
+// Parser
+
+type exprParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *exprParser) peek() token {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() token {
+	tok := p.tokens[p.pos]
+	if tok.kind != tokEOF {
+		p.pos++
+	}
+	return tok
+}
+
+func (p *exprParser) expect(text string) error {
+	tok := p.next()
+	if tok.kind != tokOp || tok.text != text {
+		return fmt.Errorf("expected %q but found %q at position %d", text, tok.text, tok.pos)
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokOp && tok.text == "||"; tok = p.peek() {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for tok := p.peek(); tok.kind == tokOp && tok.text == "&&"; tok = p.peek() {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = &exprBinary{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseNot() (exprNode, error) {
+	if tok := p.peek(); tok.kind == tokOp && tok.text == "!" {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return &exprNot{operand: operand}, nil
+	}
+	return p.parseComparison()
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parsePrimary()
+	if err != nil {
+		return nil, err
+	}
+
+	tok := p.peek()
+	switch {
+	case tok.kind == tokOp && (tok.text == "==" || tok.text == "!=" || tok.text == "<" || tok.text == "<=" || tok.text == ">" || tok.text == ">="):
+		p.next()
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		return &exprBinary{op: tok.text, left: left, right: right}, nil
+	case tok.kind == tokIdent && (tok.text == "in" || tok.text == "not"):
+		p.next()
+		negate := tok.text == "not"
+		if negate {
+			if in := p.next(); in.kind != tokIdent || in.text != "in" {
+				return nil, fmt.Errorf("expected \"in\" after \"not\" at position %d", in.pos)
+			}
+		}
+		right, err := p.parsePrimary()
+		if err != nil {
+			return nil, err
+		}
+		list, ok := right.(*exprList)
+		if !ok {
+			return nil, fmt.Errorf("right hand side of \"in\" must be a list at position %d", tok.pos)
+		}
+		return &exprIn{negate: negate, left: left, list: list}, nil
+	}
+	return left, nil
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		value, _ := strconv.ParseFloat(tok.text, 64)
+		return &exprLiteral{value: value}, nil
+	case tokString:
+		return &exprLiteral{value: tok.text}, nil
+	case tokIdent:
+		switch tok.text {
+		case "true":
+			return &exprLiteral{value: true}, nil
+		case "false":
+			return &exprLiteral{value: false}, nil
+		case "null":
+			return &exprLiteral{value: nil}, nil
+		case "in", "not":
+			return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+		}
+		return &exprIdent{name: tok.text}, nil
+	case tokOp:
+		switch tok.text {
+		case "(":
+			node, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(")"); err != nil {
+				return nil, err
+			}
+			return node, nil
+		case "[":
+			list := &exprList{}
+			if next := p.peek(); next.kind == tokOp && next.text == "]" {
+				p.next()
+				return list, nil
+			}
+			for {
+				item, err := p.parsePrimary()
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := item.(*exprLiteral); !ok {
+					return nil, fmt.Errorf("list items must be literals at position %d", p.peek().pos)
+				}
+				list.items = append(list.items, item)
+				sep := p.next()
+				if sep.kind == tokOp && sep.text == "]" {
+					return list, nil
+				}
+				if sep.kind != tokOp || sep.text != "," {
+					return nil, fmt.Errorf("expected \",\" or \"]\" but found %q at position %d", sep.text, sep.pos)
+				}
+			}
+		}
+	}
+	return nil, fmt.Errorf("unexpected %q at position %d", tok.text, tok.pos)
+}
+
+// Evaluation
+
+func (n *exprLiteral) eval(data map[string]interface{}) interface{} {
+	return n.value
+}
+
+func (n *exprIdent) eval(data map[string]interface{}) interface{} {
+	return data[n.name]
+}
+
+func (n *exprList) eval(data map[string]interface{}) interface{} {
+	values := make([]interface{}, len(n.items))
+	for i, item := range n.items {
+		values[i] = item.eval(data)
+	}
+	return values
+}
+
+func (n *exprNot) eval(data map[string]interface{}) interface{} {
+	return !truthy(n.operand.eval(data))
+}
+
+func (n *exprIn) eval(data map[string]interface{}) interface{} {
+	value := n.left.eval(data)
+	for _, item := range n.list.items {
+		if equalValues(value, item.eval(data)) {
+			return !n.negate
+		}
+	}
+	return n.negate
+}
+
+func (n *exprBinary) eval(data map[string]interface{}) interface{} {
+	switch n.op {
+	case "&&":
+		return truthy(n.left.eval(data)) && truthy(n.right.eval(data))
+	case "||":
+		return truthy(n.left.eval(data)) || truthy(n.right.eval(data))
+	case "==":
+		return equalValues(n.left.eval(data), n.right.eval(data))
+	case "!=":
+		return !equalValues(n.left.eval(data), n.right.eval(data))
+	}
+
+	// Ordering operators only hold when both sides are numbers or both sides are strings
+	left, right := n.left.eval(data), n.right.eval(data)
+	var cmp int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		cmp = strings.Compare(l, r)
+	default:
+		return false
+	}
+
+	switch n.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+func equalValues(a, b interface{}) bool {
+	switch av := a.(type) {
+	case float64:
+		bv, ok := b.(float64)
+		return ok && av == bv
+	case string:
+		bv, ok := b.(string)
+		return ok && av == bv
+	case bool:
+		bv, ok := b.(bool)
+		return ok && av == bv
+	case nil:
+		return b == nil
+	}
+	return false
+}
+
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case float64:
+		return v != 0
+	case string:
+		return v != ""
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpressionEvaluation(t *testing.T) {
+	data := map[string]interface{}{
+		"movement_detected":    true,
+		"predicted_confidence": 82.5,
+		"predicted_animal":     "bear",
+		"temperature":          -3.0,
+		"loudness":             0.0,
+		"label":                "",
+		"count":                "5",
+	}
+
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		// Precedence: ! binds tighter than &&, && tighter than ||
+		{"true || false && false", true},
+		{"(true || false) && false", false},
+		{"false && false || true", true},
+		{"!false && false", false},
+		{"!(false && false)", true},
+		{"!!movement_detected", true},
+		{"movement_detected && predicted_confidence > 70 && predicted_animal in [\"bear\", \"wolf\"]", true},
+		{"movement_detected && predicted_confidence > 90 || predicted_animal == 'bear'", true},
+
+		// Comparisons
+		{"predicted_confidence >= 82.5", true},
+		{"predicted_confidence < 82.5", false},
+		{"predicted_confidence != 82.5", false},
+		{"predicted_animal < \"cat\"", true},
+		{"predicted_animal == \"bear\"", true},
+
+		// Membership
+		{"predicted_animal in [\"bear\", \"wolf\"]", true},
+		{"predicted_animal in [\"deer\"]", false},
+		{"predicted_animal not in [\"deer\", \"boar\"]", true},
+		{"predicted_animal not in [\"bear\"]", false},
+		{"predicted_animal in []", false},
+		{"predicted_confidence in [82.5, 90]", true},
+
+		// Negative numbers
+		{"temperature < -2", true},
+		{"temperature == -3", true},
+		{"temperature in [-3, 5]", true},
+		{"-3 == temperature", true},
+		{"temperature > -.5", false},
+
+		// Missing keys evaluate to null
+		{"missing == null", true},
+		{"missing != null", false},
+		{"missing", false},
+		{"!missing", true},
+		{"missing > 5", false},
+		{"missing < 5", false},
+		{"missing in [\"bear\"]", false},
+		{"missing not in [\"bear\"]", true},
+
+		// Type mismatches never hold, except !=
+		{"count > 3", false},
+		{"count == 5", false},
+		{"count != 5", true},
+		{"predicted_animal > 3", false},
+		{"movement_detected < true", false},
+		{"movement_detected == 1", false},
+
+		// Truthiness of bare values
+		{"loudness", false},
+		{"label", false},
+		{"predicted_animal", true},
+		{"predicted_confidence", true},
+	}
+
+	for _, test := range tests {
+		node, err := parseExpression(test.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected parse error: %v", test.expr, err)
+			continue
+		}
+		if got := evaluateExpression(node, data); got != test.want {
+			t.Errorf("%s = %v, want %v", test.expr, got, test.want)
+		}
+	}
+}
+
+func TestExpressionParseErrors(t *testing.T) {
+	tests := []struct {
+		expr string
+		want string // part of the error message
+	}{
+		{"", "empty expression"},
+		{"   ", "empty expression"},
+		{"movement_detected &&", "unexpected \"end of expression\""},
+		{"(movement_detected", "expected \")\""},
+		{"movement_detected)", "unexpected \")\""},
+		{"predicted_animal in \"bear\"", "must be a list"},
+		{"predicted_animal not [\"bear\"]", "expected \"in\" after \"not\""},
+		{"predicted_animal in [\"bear\" \"wolf\"]", "expected \",\" or \"]\""},
+		{"predicted_animal in [other]", "list items must be literals"},
+		{"\"bear", "unterminated string"},
+		{"loudness $ 3", "unexpected character"},
+		{"loudness > 1..2", "invalid number"},
+		{"loudness - 3", "unexpected character"},
+		{"loudness > 3 4", "unexpected \"4\""},
+		{"in", "unexpected \"in\""},
+	}
+
+	for _, test := range tests {
+		_, err := parseExpression(test.expr)
+		if err == nil {
+			t.Errorf("%q: expected an error", test.expr)
+			continue
+		}
+		if !strings.Contains(err.Error(), test.want) {
+			t.Errorf("%q: error %q does not contain %q", test.expr, err, test.want)
+		}
+	}
+}
+
+func TestRuleExpressionCache(t *testing.T) {
+	first, err := ruleExpression(1001, "loudness > 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	again, err := ruleExpression(1001, "loudness > 3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first != again {
+		t.Error("the expression was parsed again although it did not change")
+	}
+
+	changed, err := ruleExpression(1001, "loudness > 5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if evaluateExpression(changed, map[string]interface{}{"loudness": 4.0}) {
+		t.Error("the cached tree of the old expression was used")
+	}
+
+	if _, err := ruleExpression(1001, "loudness >"); err == nil {
+		t.Error("expected a parse error for the edited expression")
+	}
+}
@@ -1,9 +1,11 @@
 module github.com/kennycoder/uol-iot/uol-gateway
 
-go 1.23.0
+go 1.24.0
 
 require github.com/eclipse/paho.mqtt.golang v1.5.0
 
+require gopkg.in/yaml.v3 v3.0.1
+
 require (
 	github.com/gorilla/websocket v1.5.3 // indirect
 	github.com/mattn/go-sqlite3 v1.14.22
@@ -0,0 +1,220 @@
+// This file implements device health tracking. The gateway polls /healthz of every device and moves it through
+// a small state machine instead of forgetting it after one failed request:
+//
+//	online -> degraded after health.degraded_after consecutive failures
+//	degraded -> offline after health.offline_after consecutive failures, which raises a "device offline" alert
+//	degraded/offline -> online on the next successful check or registration
+//
+// Decommissioned devices are retired by an operator and no longer checked. Every transition is kept in device_health.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Device health states
+const (
+	healthOnline         = "online"
+	healthDegraded       = "degraded"
+	healthOffline        = "offline"
+	healthDecommissioned = "decommissioned"
+)
+
+// deviceOfflineAlert is the alert type raised when a device goes offline
+const deviceOfflineAlert = "device offline"
+
+// healthActor is recorded as the user resolving device offline alerts once the device is back
+const healthActor = "gateway"
+
+// HealthTransition is a row of the device_health table
+type HealthTransition struct {
+	ClientID  string `json:"client_id"`
+	FromState string `json:"from_state"`
+	ToState   string `json:"to_state"`
+	Reason    string `json:"reason"`
+	Timestamp string `json:"timestamp"`
+}
+
+// checkClients probes every device that is not decommissioned, health.concurrency at a time, so a device that
+// does not answer only holds up its own check
+func checkClients(db *sql.DB) {
+	devices, err := loadDevices(db)
+	if err != nil {
+		log.Printf("Error loading devices to check: %v\n", err)
+		return
+	}
+
+	var wg sync.WaitGroup
+	slots := make(chan struct{}, currentConfig().Health.Concurrency)
+	for _, device := range devices {
+		if device.HealthState == healthDecommissioned {
+			continue
+		}
+		wg.Add(1)
+		slots <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+
+			err := probeDevice(context.Background(), device.IP)
+			if err != nil {
+				log.Printf("Error checking health of client %s: %v\n", device.ID, err)
+			}
+			if err := recordHealthCheck(db, device.ID, err); err != nil {
+				log.Printf("Error recording health of client %s: %v\n", device.ID, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// probeDevice requests /healthz from a device
+func probeDevice(ctx context.Context, ip string) error {
+	return deviceRequest(ctx, ip, "/healthz", nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return nil
+	})
+}
+
+// recordHealthCheck applies the result of a health check to the state of a device
+func recordHealthCheck(db *sql.DB, clientID string, checkErr error) error {
+	settings := currentConfig().Health
+	return updateHealthState(db, clientID, func(state string, failures int) (string, int, string) {
+		if state == healthDecommissioned {
+			return state, failures, ""
+		}
+		if checkErr == nil {
+			return healthOnline, 0, "health check succeeded"
+		}
+
+		failures++
+		next, reason := state, fmt.Sprintf("%d consecutive failed health checks, last: %v", failures, checkErr)
+		if failures >= settings.OfflineAfter {
+			next = healthOffline
+		} else if failures >= settings.DegradedAfter && state == healthOnline {
+			next = healthDegraded
+		}
+		return next, failures, reason
+	})
+}
+
+// updateHealthState reads the state and the consecutive failures of a device and stores what next makes of them,
+// recording the transition if the state changed. It runs in one transaction, which holds the write lock from the
+// start, so concurrent checks and registrations cannot lose a transition or raise the offline alert twice.
+// Going offline raises a device offline alert, coming back resolves it.
+func updateHealthState(db *sql.DB, clientID string, next func(state string, failures int) (string, int, string)) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var from string
+	var failures int
+	err = tx.QueryRow("SELECT health_state, consecutive_failures FROM devices WHERE client_id = ?", clientID).Scan(&from, &failures)
+	if errors.Is(err, sql.ErrNoRows) {
+		return errDeviceNotFound
+	} else if err != nil {
+		return err
+	}
+
+	to, failures, reason := next(from, failures)
+	if _, err := tx.Exec("UPDATE devices SET health_state = ?, consecutive_failures = ? WHERE client_id = ?", to, failures, clientID); err != nil {
+		return err
+	}
+	if from != to {
+		_, err := tx.Exec(
+			"INSERT INTO device_health (client_id, from_state, to_state, reason, created_at) VALUES (?, ?, ?, ?, ?)",
+			clientID, from, to, reason, time.Now().Unix(),
+		)
+		if err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	if from == to {
+		return nil
+	}
+	log.Printf("Client %s is now %s (was %s): %s\n", clientID, to, from, reason)
+
+	// The alerts are written after the commit, the transaction would block their connection
+	switch {
+	case to == healthOffline:
+		message := fmt.Sprintf("Device %s is offline: %s", clientID, reason)
+		alertID, err := createAlert(db, deviceOfflineAlert, clientID, 0, 0, message)
+		if err != nil {
+			return err
+		}
+		notifyChannels(db, currentConfig().Health.Notify, Notification{
+			AlertID:  alertID,
+			ClientID: clientID,
+			Subject:  "Device offline",
+			Message:  message,
+		})
+	case from == healthOffline:
+		return resolveDeviceOfflineAlerts(db, clientID)
+	}
+	return nil
+}
+
+// resolveDeviceOfflineAlerts resolves the active device offline alerts of a device that is back
+func resolveDeviceOfflineAlerts(db *sql.DB, clientID string) error {
+	_, err := db.Exec(
+		"UPDATE alerts SET state = ?, resolved_by = ?, resolved_at = ? WHERE type = ? AND client_id = ? AND state IN (?, ?)",
+		alertResolved, healthActor, time.Now().Unix(), deviceOfflineAlert, clientID, alertOpen, alertAcknowledged,
+	)
+	return err
+}
+
+// markDeviceOnline is called when a device registers, which proves it is reachable again
+func markDeviceOnline(db *sql.DB, clientID string, reason string) error {
+	return updateHealthState(db, clientID, func(string, int) (string, int, string) {
+		return healthOnline, 0, reason
+	})
+}
+
+// setDecommissioned retires a device or puts it back into service
+func setDecommissioned(db *sql.DB, clientID string, decommissioned bool) error {
+	return updateHealthState(db, clientID, func(state string, failures int) (string, int, string) {
+		switch {
+		case decommissioned:
+			return healthDecommissioned, failures, "decommissioned by operator"
+		case state == healthDecommissioned:
+			return healthOnline, 0, "recommissioned by operator"
+		}
+		return state, failures, ""
+	})
+}
+
+// listHealthTransitions returns the health history of a device, newest first
+func listHealthTransitions(db *sql.DB, clientID string) ([]HealthTransition, error) {
+	rows, err := db.Query("SELECT client_id, from_state, to_state, reason, created_at FROM device_health WHERE client_id = ? ORDER BY id DESC", clientID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	transitions := []HealthTransition{}
+	for rows.Next() {
+		var transition HealthTransition
+		var createdAt int64
+		if err := rows.Scan(&transition.ClientID, &transition.FromState, &transition.ToState, &transition.Reason, &createdAt); err != nil {
+			return nil, err
+		}
+		transition.Timestamp = formatTimestamp(createdAt)
+		transitions = append(transitions, transition)
+	}
+	return transitions, rows.Err()
+}
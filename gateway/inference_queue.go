@@ -0,0 +1,270 @@
+// This file implements the queue in front of the YOLO backend. yolo_post_classification only enqueues a job and marks
+// its alert as queued, the worker records the result once the job is done. A fixed pool of workers sends the jobs to the inference service one at a time per worker, so a burst of
+// intrusions cannot spawn unbounded goroutines or flood the Python service. Requests for a device that already
+// has a recent job are coalesced into that job, since a new snapshot a few seconds later shows the same animal.
+
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"slices"
+	"sync"
+	"time"
+)
+
+// Inference queue settings
+const (
+	inferenceTimeout        = 20 * time.Second // per request to the inference service
+	inferenceMaxAttempts    = 3
+	inferenceBackoff        = 2 * time.Second // doubled after each failed attempt
+	inferenceCoalesceWindow = 30 * time.Second
+	inferenceJobHistory     = 100 // finished jobs kept for the status API
+)
+
+// Inference job states
+const (
+	jobQueued    = "queued"
+	jobRunning   = "running"
+	jobSucceeded = "succeeded"
+	jobFailed    = "failed"
+)
+
+var (
+	errInferenceQueueFull = errors.New("inference queue is full")
+	errJobNotFound        = errors.New("inference job not found")
+)
+
+// InferenceJob is one request to classify a snapshot of a device
+type InferenceJob struct {
+	ID         int64  `json:"id"`
+	ClientID   string `json:"client_id"`
+	EventID    int64  `json:"event_id,omitempty"`
+	AlertID    int64  `json:"alert_id,omitempty"`
+	State      string `json:"state"`
+	Attempts   int    `json:"attempts"`
+	Coalesced  int    `json:"coalesced"` // requests merged into this job
+	Outcome    string `json:"outcome,omitempty"`
+	Error      string `json:"error,omitempty"`
+	CreatedAt  string `json:"created_at"`
+	StartedAt  string `json:"started_at,omitempty"`
+	FinishedAt string `json:"finished_at,omitempty"`
+
+	deviceIP        string
+	data            map[string]interface{}
+	rule            *Rule
+	created         time.Time
+	coalescedAlerts []int64 // alerts of the requests merged into this job, which wait for its result
+}
+
+// InferenceQueueStatus is returned by the status API
+type InferenceQueueStatus struct {
+	Depth    int            `json:"depth"`
+	Capacity int            `json:"capacity"`
+	Workers  int            `json:"workers"`
+	Running  int            `json:"running"`
+	Jobs     []InferenceJob `json:"jobs"`
+}
+
+// InferenceQueue is a bounded job queue served by a pool of workers
+type InferenceQueue struct {
+	db      *sql.DB
+	jobs    chan *InferenceJob
+	workers int
+
+	mu      sync.Mutex
+	nextID  int64
+	byID    map[int64]*InferenceJob
+	order   []*InferenceJob // oldest first
+	running int
+}
+
+var inferenceQueue *InferenceQueue
+
+// newInferenceQueue creates the queue and starts its workers
+func newInferenceQueue(db *sql.DB, workers int, size int) *InferenceQueue {
+	q := &InferenceQueue{
+		db:      db,
+		jobs:    make(chan *InferenceJob, size),
+		workers: workers,
+		byID:    make(map[int64]*InferenceJob),
+	}
+	for i := 0; i < workers; i++ {
+		go q.worker()
+	}
+	return q
+}
+
+// Enqueue adds a job for the device of ac, or merges the request into a job for that device created within the coalescing window
+func (q *InferenceQueue) Enqueue(ac *ActionContext, deviceIP string) (InferenceJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for i := len(q.order) - 1; i >= 0; i-- {
+		job := q.order[i]
+		if job.ClientID != ac.ClientID || job.State == jobFailed {
+			continue
+		}
+		if time.Since(job.created) < inferenceCoalesceWindow {
+			job.Coalesced++
+			if job.State != jobSucceeded && ac.AlertID != 0 && ac.AlertID != job.AlertID && !slices.Contains(job.coalescedAlerts, ac.AlertID) {
+				job.coalescedAlerts = append(job.coalescedAlerts, ac.AlertID)
+			}
+			return *job, nil
+		}
+		break
+	}
+
+	now := time.Now()
+	q.nextID++
+	job := &InferenceJob{
+		ID:        q.nextID,
+		ClientID:  ac.ClientID,
+		EventID:   ac.EventID,
+		AlertID:   ac.AlertID,
+		State:     jobQueued,
+		CreatedAt: formatTimestamp(now.Unix()),
+		deviceIP:  deviceIP,
+		data:      ac.Data,
+		rule:      ac.Rule,
+		created:   now,
+	}
+
+	select {
+	case q.jobs <- job:
+	default:
+		return *job, errInferenceQueueFull
+	}
+
+	q.byID[job.ID] = job
+	q.order = append(q.order, job)
+	q.trim()
+	return *job, nil
+}
+
+// trim forgets the oldest finished jobs beyond inferenceJobHistory. Must be called with q.mu held.
+func (q *InferenceQueue) trim() {
+	excess := len(q.order) - inferenceJobHistory
+	kept := q.order[:0]
+	for _, job := range q.order {
+		if excess > 0 && (job.State == jobSucceeded || job.State == jobFailed) {
+			delete(q.byID, job.ID)
+			excess--
+			continue
+		}
+		kept = append(kept, job)
+	}
+	q.order = kept
+}
+
+// Status returns the queue depth and the known jobs, newest first
+func (q *InferenceQueue) Status() InferenceQueueStatus {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	status := InferenceQueueStatus{
+		Depth:    len(q.jobs),
+		Capacity: cap(q.jobs),
+		Workers:  q.workers,
+		Running:  q.running,
+		Jobs:     make([]InferenceJob, 0, len(q.order)),
+	}
+	for i := len(q.order) - 1; i >= 0; i-- {
+		status.Jobs = append(status.Jobs, *q.order[i])
+	}
+	return status
+}
+
+// Job returns a copy of the job with the given ID
+func (q *InferenceQueue) Job(id int64) (InferenceJob, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	job, ok := q.byID[id]
+	if !ok {
+		return InferenceJob{}, errJobNotFound
+	}
+	return *job, nil
+}
+
+// update changes a job under the queue lock
+func (q *InferenceQueue) update(job *InferenceJob, change func(job *InferenceJob)) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	change(job)
+}
+
+func (q *InferenceQueue) worker() {
+	for job := range q.jobs {
+		q.update(job, func(job *InferenceJob) {
+			job.State = jobRunning
+			job.StartedAt = formatTimestamp(time.Now().Unix())
+			q.running++
+		})
+
+		outcome, err := q.run(job)
+
+		var coalescedAlerts []int64
+		q.update(job, func(job *InferenceJob) {
+			coalescedAlerts = job.coalescedAlerts
+			job.State = jobSucceeded
+			job.Outcome = outcome
+			if err != nil {
+				job.State = jobFailed
+				job.Error = err.Error()
+			}
+			job.FinishedAt = formatTimestamp(time.Now().Unix())
+			q.running--
+		})
+
+		// A confirmed verdict ran the species callback, which recorded its own result on the alert of the job
+		if job.AlertID != 0 && outcome != verdictConfirmed {
+			recordActionResult(q.db, job.AlertID, "yolo_post_classification", err)
+		}
+		for _, alertID := range coalescedAlerts {
+			recordActionResult(q.db, alertID, "yolo_post_classification", err)
+		}
+	}
+}
+
+// run classifies the snapshot of a job, retrying failed requests with exponential backoff,
+// and runs the species callback when the verdict is confirmed
+func (q *InferenceQueue) run(job *InferenceJob) (string, error) {
+	ac := &ActionContext{
+		DB:       q.db,
+		ClientID: job.ClientID,
+		EventID:  job.EventID,
+		Data:     job.data,
+		Rule:     job.rule,
+		AlertID:  job.AlertID,
+	}
+
+	var prediction yoloResponse
+	var err error
+	backoff := inferenceBackoff
+	for attempt := 1; attempt <= inferenceMaxAttempts; attempt++ {
+		q.update(job, func(job *InferenceJob) { job.Attempts = attempt })
+
+		ctx, cancel := context.WithTimeout(context.Background(), inferenceTimeout)
+		prediction, err = requestYoloInference(ctx, job.deviceIP)
+		cancel()
+		if err == nil {
+			break
+		}
+
+		log.Printf("Error running inference job %d for %s (attempt %d/%d): %v\n", job.ID, job.ClientID, attempt, inferenceMaxAttempts, err)
+		if attempt < inferenceMaxAttempts {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+	}
+	if err != nil {
+		return "", fmt.Errorf("inference failed after %d attempts: %w", inferenceMaxAttempts, err)
+	}
+
+	log.Printf("### Response from backup YOLO model: %s (%.2f)", prediction.TopLabel, prediction.Confidence)
+	return handleYoloPrediction(ac, prediction)
+}
@@ -3,7 +3,7 @@ The code includes features for client registration, telemetry data storage, rule
 It also provides a web interface for viewing device information, alerts, events, and settings.
 */
 
-// The code uses several structs to represent different data types, such as ClientInfo, ActiveAlerts, Rule.
+// The code uses several structs to represent different data types, such as ClientInfo, Alert, Rule.
 // Each struct has fields that correspond to the data it represents.
 // For example, the ClientInfo struct has fields for the IP address and type of the client device. Other structs have similar mappings to the objects (usually external coming via MQTT) with which the code interacts
 // The code also defines methods for working with these structs, such as saveTelemetryData, handleRegistration, and matchRuleAndExecuteCallback.
@@ -12,19 +12,21 @@ It also provides a web interface for viewing device information, alerts, events,
 package main
 
 import (
-	"bytes"
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"html/template"
-	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"reflect"
+	"os"
+	"os/signal"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
 	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
@@ -38,105 +40,159 @@ type ClientInfo struct {
 	Type string `json:"device_type"`
 }
 
-// ActiveAlerts struct to hold active alert data
-type ActiveAlerts struct {
-	Id        int    `json:"id"`
-	Type      string `json:"alert_type"`
-	ClientID  string `json:"client_id"`
-	Timestamp string `json:"timestamp"`
-	Message   string `json:"message"`
-}
-
 type Rule struct {
-	RuleID        int     `json:"rule_id"`
-	ClientID      string  `json:"client_id"`
-	ParameterName string  `json:"parameter_name"`
-	MinRange      float64 `json:"min_range"`
-	MaxRange      float64 `json:"max_range"`
-	Trigger       string  `json:"trigger"`
-	Callback      string  `json:"callback"`
+	RuleID        int      `json:"rule_id"`
+	ClientID      string   `json:"client_id"`
+	ParameterName string   `json:"parameter_name"`
+	MinRange      float64  `json:"min_range"`
+	MaxRange      float64  `json:"max_range"`
+	Trigger       string   `json:"trigger"`
+	Callback      string   `json:"callback"`
+	Expression    string   `json:"expression"`
+	Enabled       bool     `json:"enabled"`
+	Notify        []string `json:"notify"`
+
+	// CooldownSeconds silences the rule after it fired, per device or for all devices depending on CooldownScope
+	CooldownSeconds int              `json:"cooldown_seconds"`
+	CooldownScope   string           `json:"cooldown_scope"`
+	Escalation      []EscalationTier `json:"escalation"`
 }
 
 var mqttOptions *mqtt.ClientOptions
 var mqttClient mqtt.Client
 
-// Global map to store client data
-var clientData = make(map[string]ClientInfo)
-
-var activeAlerts []ActiveAlerts
-
-// StubStorage is a variable of type stubMapping, used to store references to callback functions.
-type stubMapping map[string]interface{}
+// StubStorage is a variable of type stubMapping, used to store references to the callback actions built into the gateway.
+// All other callbacks live in the callbacks table, see callbacks.go.
+type stubMapping map[string]Action
 
 var StubStorage = stubMapping{}
 
 func main() {
-	StubStorage = map[string]interface{}{
-		"yolo_post_classification": yolo_post_classification,
-		"fox_callback":             fox_callback,
-		"bear_callback":            bear_callback,
-		"wolf_callback":            wolf_callback,
-		"deer_callback":            deer_callback,
-		"crocodile_callback":       crocodile_callback,
+	source, args, err := parseFlags(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	} else if err != nil {
+		log.Fatalf("Error parsing command line: %v", err)
+	}
+	if len(args) > 0 && args[0] != "migrate" && args[0] != "export" && args[0] != "compact" && args[0] != "user" {
+		log.Fatalf("Unknown command: %s", args[0])
+	}
+	config, err := loadConfig(source)
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
 	}
+	activeConfig.Store(config)
+
+	// Apply the settings that can change at runtime on SIGHUP
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			if err := reloadConfig(source); err != nil {
+				log.Printf("Error reloading configuration, keeping the current one:\n%v\n", err)
+				continue
+			}
+			log.Printf("Configuration reloaded\n")
+		}
+	}()
 
 	// Initialize SQLite database
-	db, err := sql.Open("sqlite3", "client_data.db")
+	db, err := openDatabase(config.Database.Path)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
 
-	// MQTT client setup
-	mqttOptions = mqtt.NewClientOptions()
-	mqttOptions.AddBroker("tcp://127.0.0.1:1883")
-	mqttOptions.SetUsername("mod11")
-	mqttOptions.SetPassword("mod11pwd")
-	mqttOptions.SetClientID("go-subscriber")
-	mqttOptions.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
-		// This function is called when a message is received on any subscribed topic
-		fmt.Printf("Topic: %s\n", msg.Topic())
-		fmt.Printf("Message: %s\n", msg.Payload())
-
-		// Parse the MQTT message payload
-		var eventPayload map[string]interface{}
-		if err := json.Unmarshal(msg.Payload(), &eventPayload); err != nil {
-			log.Printf("Error parsing MQTT message: %v\n", err)
-			return
+	if len(args) > 0 && args[0] == "migrate" {
+		if err := runMigrateCommand(db, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	// A new database is created from scratch, an existing one gets the migrations it is missing
+	if err := migrateUp(db, 0); err != nil {
+		log.Fatalf("Error migrating the database: %v", err)
+	}
+	if len(args) > 0 && args[0] == "export" {
+		if err := runExportCommand(db, args[1:]); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "compact" {
+		if _, err := runCompaction(db); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if len(args) > 0 && args[0] == "user" {
+		if err := runUserCommand(db, args[1:]); err != nil {
+			log.Fatal(err)
 		}
+		return
+	}
+	if err := ensureAdmin(db); err != nil {
+		log.Fatalf("Error creating the admin user: %v", err)
+	}
+
+	StubStorage = stubMapping{
+		"yolo_post_classification": ActionFunc(yolo_post_classification),
+	}
+	inferenceQueue = newInferenceQueue(db, config.YOLO.Workers, config.YOLO.QueueSize)
 
-		// Determine the event type from the payload
-		eventType := eventPayload["event"].(string)
+	// Devices registered before a restart are known right away, they do not need to re-register
+	if err := loadClientData(db); err != nil {
+		log.Fatalf("Error loading devices: %v", err)
+	}
+	if err := interruptRollouts(db); err != nil {
+		log.Fatalf("Error marking interrupted rollouts: %v", err)
+	}
 
-		switch eventType {
-		case "telemetry", "intrusion":
-			// Save telemetry or fall event data to the database
-			if err := saveTelemetryData(db, eventPayload); err != nil {
-				log.Printf("Error saving event data: %v\n", err)
-			}
+	// Periodically check the health of the devices
+	go func() {
+		for {
+			checkClients(db)
+			time.Sleep(currentConfig().Health.Interval)
+		}
+	}()
 
-			// Marshal the "data" field from eventPayload into JSON format
-			dataJSON, err := json.Marshal(eventPayload["data"])
-			if err != nil {
-				return
-			}
+	// Periodically escalate and auto-expire alerts nobody acknowledged or resolved
+	go func() {
+		for {
+			escalateAlerts(db)
+			expireAlerts(db)
+			time.Sleep(time.Minute)
+		}
+	}()
 
-			// Match the received data against user-defined rules and execute callbacks if necessary
-			err = matchRuleAndExecuteCallback(db, eventPayload["client_id"].(string), dataJSON)
-			if err != nil {
-				log.Printf("Error: %v", err)
-			}
+	// Delete snapshots past their retention
+	go func() {
+		for {
+			pruneSnapshots(db)
+			time.Sleep(time.Hour)
+		}
+	}()
 
-		case "registration":
-			// Handle client registration events
-			if err := handleRegistration(eventPayload); err != nil {
-				log.Printf("Error registering client: %v\n", err)
+	// Roll up and delete events past their retention
+	go func() {
+		for {
+			if _, err := runCompaction(db); err != nil {
+				log.Printf("Error compacting events: %v\n", err)
 			}
-
-		default:
-			fmt.Printf("Unknown event type: %s.\n", eventType)
+			time.Sleep(currentConfig().Retention.Interval)
 		}
+	}()
 
+	// MQTT client setup
+	mqttOptions = mqtt.NewClientOptions()
+	mqttOptions.AddBroker(config.MQTT.Broker)
+	mqttOptions.SetUsername(config.MQTT.Username)
+	mqttOptions.SetPassword(config.MQTT.Password)
+	mqttOptions.SetClientID(config.MQTT.ClientID)
+	mqttOptions.SetDefaultPublishHandler(func(client mqtt.Client, msg mqtt.Message) {
+		// This function is called when a message is received on any subscribed topic, rejected messages are logged
+		// and kept as dead letters by handleMessage
+		handleMessage(db, msg.Topic(), msg.Payload())
 	})
 
 	mqttClient = mqtt.NewClient(mqttOptions)
@@ -144,7 +200,7 @@ func main() {
 		log.Fatal(token.Error())
 	}
 
-	if token := mqttClient.Subscribe("uol/uol-cm3070-mod11", 0, nil); token.Wait() && token.Error() != nil {
+	if token := mqttClient.Subscribe(config.MQTT.Topic, 0, nil); token.Wait() && token.Error() != nil {
 		log.Fatal(token.Error())
 	}
 
@@ -159,6 +215,56 @@ func main() {
 		tmpl := template.Must(template.ParseFiles("templates/users.html"))
 		tmpl.Execute(w, nil)
 	})
+	http.HandleFunc("/login", func(w http.ResponseWriter, req *http.Request) {
+		tmpl := template.Must(template.ParseFiles("templates/login.html"))
+		data := struct {
+			Next  string
+			Error string
+		}{
+			Next: safeRedirect(req.FormValue("next")),
+		}
+
+		if req.Method == http.MethodPost {
+			if !sameOrigin(req) {
+				log.Printf("Rejected cross-site login from %s\n", req.RemoteAddr)
+				http.Error(w, "Forbidden: cross-site login", http.StatusForbidden)
+				return
+			}
+			user, err := authenticate(db, req.PostFormValue("username"), req.PostFormValue("password"))
+			if err == nil {
+				var token, csrfToken string
+				token, csrfToken, err = createSession(db, user.ID)
+				if err == nil {
+					setSessionCookies(w, req, token, csrfToken)
+					http.Redirect(w, req, data.Next, http.StatusSeeOther)
+					return
+				}
+			}
+			if errors.Is(err, errInvalidCredentials) {
+				log.Printf("Failed login for %q from %s\n", req.PostFormValue("username"), req.RemoteAddr)
+				w.WriteHeader(http.StatusUnauthorized)
+			} else {
+				log.Printf("Error logging in: %v\n", err)
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			data.Error = errInvalidCredentials.Error()
+		}
+		tmpl.Execute(w, data)
+	})
+	http.HandleFunc("/logout", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if cookie, err := req.Cookie(sessionCookie); err == nil {
+			if err := deleteSession(db, cookie.Value); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		setSessionCookies(w, req, "", "")
+		w.WriteHeader(http.StatusOK)
+	})
 	http.HandleFunc("/devices", func(w http.ResponseWriter, req *http.Request) {
 		tmpl := template.Must(template.ParseFiles("templates/devices.html"))
 		tmpl.Execute(w, nil)
@@ -192,8 +298,18 @@ func main() {
 
 	// Api endpoints
 	http.HandleFunc("/_devices", func(w http.ResponseWriter, req *http.Request) {
-		// return contents of clientData as json
-		jsonData, err := json.Marshal(clientData)
+		// return the registered devices as json, keyed by client ID
+		list, err := loadDevices(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		devices := make(map[string]Device, len(list))
+		for _, device := range list {
+			devices[device.ID] = device
+		}
+
+		jsonData, err := json.Marshal(devices)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -202,14 +318,948 @@ func main() {
 		w.Write(jsonData)
 	})
 
+	http.HandleFunc("/_devices/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /_devices/<client id> with its IP history, PUT to set its name, location, group and coordinates,
+		// GET /_devices/<client id>/health for its health history, POST /_devices/<client id>/decommission or recommission
+		deviceID, action, _ := strings.Cut(req.URL.Path[len("/_devices/"):], "/")
+		if !macRegex.MatchString(deviceID) {
+			http.Error(w, "invalid device ID: "+deviceID, http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case action == "health" && req.Method == http.MethodGet:
+			transitions, err := listHealthTransitions(db, deviceID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(transitions)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case (action == "decommission" || action == "recommission") && req.Method == http.MethodPost:
+			err := setDecommissioned(db, deviceID, action == "decommission")
+			if errors.Is(err, errDeviceNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			return
+		case action == "health" || action == "decommission" || action == "recommission":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		case action != "":
+			http.Error(w, "Invalid device path", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			device, err := getDevice(db, deviceID)
+			if errors.Is(err, errDeviceNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(device)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+		case http.MethodPut:
+			var info struct {
+				Name      string   `json:"name"`
+				Location  string   `json:"location"`
+				Group     *string  `json:"group"`
+				Latitude  *float64 `json:"latitude"`
+				Longitude *float64 `json:"longitude"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&info); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			err := updateDeviceInfo(db, deviceID, info.Name, info.Location, info.Group, info.Latitude, info.Longitude)
+			if errors.Is(err, errDeviceNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if errors.Is(err, errInvalidDeviceInfo) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
 	http.HandleFunc("/_alerts", func(w http.ResponseWriter, req *http.Request) {
+		// return the open and acknowledged alerts
+		alerts, err := listActiveAlerts(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(alerts)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_alerts/history", func(w http.ResponseWriter, req *http.Request) {
+		// paginated alert history, optionally filtered by state and client_id
+		query := req.URL.Query()
+		page, err := strconv.Atoi(query.Get("page"))
+		if err != nil || page < 1 {
+			page = 1
+		}
+		pageSize, err := strconv.Atoi(query.Get("page_size"))
+		if err != nil || pageSize < 1 || pageSize > 500 {
+			pageSize = 50
+		}
+
+		alerts, total, err := listAlertHistory(db, query.Get("state"), query.Get("client_id"), page, pageSize)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(map[string]interface{}{
+			"alerts":    alerts,
+			"page":      page,
+			"page_size": pageSize,
+			"total":     total,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_alerts/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /_alerts/<id> returns a single alert, POST /_alerts/<id>/acknowledge and /_alerts/<id>/resolve change its state
+		alertID, action, err := getPathId(req, "/_alerts/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case action == "" && req.Method == http.MethodGet:
+			alert, err := getAlert(db, alertID)
+			if errors.Is(err, errAlertNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(alert)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case action == "acknowledge" && req.Method == http.MethodPost:
+			err = acknowledgeAlert(db, alertID, alertActor(req))
+		case action == "resolve" && req.Method == http.MethodPost:
+			err = resolveAlert(db, alertID, alertActor(req))
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, errAlertNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, errInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/_dismiss_alert", func(w http.ResponseWriter, req *http.Request) {
+		// kept for older dashboards, dismissing an alert resolves it
+		idStr := req.URL.Query().Get("id")
+		if idStr == "" {
+			http.Error(w, "Missing id parameter", http.StatusBadRequest)
+			return
+		}
+
+		alertID, err := strconv.ParseInt(idStr, 10, 64)
+		if err != nil {
+			http.Error(w, "Invalid id parameter", http.StatusBadRequest)
+			return
+		}
+
+		err = resolveAlert(db, alertID, alertActor(req))
+		if errors.Is(err, errAlertNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, errInvalidTransition) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// return success
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/_events", func(w http.ResponseWriter, req *http.Request) {
+		// one page of events, filtered and sorted by the query parameters, see parseEventFilter
+		filter, err := parseEventFilter(req.URL.Query())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter.Limit > 500 {
+			filter.Limit = 500
+		}
+
+		events, nextCursor, err := listEvents(db, filter)
+		if errors.Is(err, errInvalidCursor) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(map[string]interface{}{
+			"events":      events,
+			"next_cursor": nextCursor,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_export/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /_export/events or /_export/alerts, streamed as ?format=csv (default), ndjson or geojson
+		table := strings.TrimPrefix(req.URL.Path, "/_export/")
+		query := req.URL.Query()
+		format := query.Get("format")
+		if format == "" {
+			format = exportCSV
+		}
+		if err := validateExport(table, format, query); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", exportContentTypes[format])
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", table+"-"+time.Now().Format("20060102-150405")+"."+format))
+		// The status is already sent once streaming starts, so a failure can only cut the export short
+		if err := runExport(db, w, table, format, query); err != nil {
+			log.Printf("Error exporting %s: %v\n", table, err)
+		}
+	})
+
+	http.HandleFunc("/_telemetry/hourly", func(w http.ResponseWriter, req *http.Request) {
+		// hourly aggregates of the compacted telemetry, newest first, filtered by client_id and a from/to range of hours
+		query := req.URL.Query()
+		from, err := parseTimeParam(query.Get("from"))
+		if err != nil {
+			http.Error(w, "invalid from: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		to, err := parseTimeParam(query.Get("to"))
+		if err != nil {
+			http.Error(w, "invalid to: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		limit := 500
+		if value := query.Get("limit"); value != "" {
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 5000 {
+				http.Error(w, "invalid limit: "+value, http.StatusBadRequest)
+				return
+			}
+		}
 
-		// update activeAlerts and set id value equal to its index in array
-		for i := range activeAlerts {
-			activeAlerts[i].Id = i
+		hours, err := listTelemetryHours(db, query.Get("client_id"), from, to, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonData, err := json.Marshal(hours)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_retention", func(w http.ResponseWriter, req *http.Request) {
+		// the retention policy and the reports of the latest compactions
+		compactions, err := listCompactions(db, 20)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		policy := currentConfig().Retention
+		jsonData, err := json.Marshal(map[string]interface{}{
+			"policy": map[string]string{
+				"telemetry":  policy.Telemetry.String(),
+				"intrusion":  policy.Intrusion.String(),
+				"aggregates": policy.Aggregates.String(),
+				"interval":   policy.Interval.String(),
+			},
+			"compactions": compactions,
+		})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_retention/compact", func(w http.ResponseWriter, req *http.Request) {
+		// POST runs a compaction right away and returns its report
+		if req.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		report, err := runCompaction(db)
+		if errors.Is(err, errCompactionRunning) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonData, err := json.Marshal(report)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_me", func(w http.ResponseWriter, req *http.Request) {
+		// GET returns the logged in user, PUT with current_password and password changes their password
+		session, _ := requestSession(req)
+		switch req.Method {
+		case http.MethodGet:
+			jsonData, err := json.Marshal(session.User)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+		case http.MethodPut:
+			var change struct {
+				CurrentPassword string `json:"current_password"`
+				Password        string `json:"password"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if _, err := authenticate(db, session.User.Username, change.CurrentPassword); errors.Is(err, errInvalidCredentials) {
+				http.Error(w, "The current password is wrong", http.StatusForbidden)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := setUserPassword(db, session.User.ID, change.Password); errors.Is(err, errInvalidUser) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			// Changing the password ends every session, start a new one for this browser
+			token, csrfToken, err := createSession(db, session.User.ID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			setSessionCookies(w, req, token, csrfToken)
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/_users", func(w http.ResponseWriter, req *http.Request) {
+		// GET lists the users, POST creates one from username, password and role
+		switch req.Method {
+		case http.MethodGet:
+			users, err := listUsers(db)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			jsonData, err := json.Marshal(users)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+		case http.MethodPost:
+			var newUser struct {
+				Username string `json:"username"`
+				Password string `json:"password"`
+				Role     string `json:"role"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&newUser); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			user, err := createUser(db, newUser.Username, newUser.Password, newUser.Role)
+			if errors.Is(err, errUserExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if errors.Is(err, errInvalidUser) {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			jsonData, err := json.Marshal(user)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonData)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/_users/", func(w http.ResponseWriter, req *http.Request) {
+		// PUT /_users/<id> sets the role and/or resets the password, DELETE removes the user
+		userID, _, err := getPathId(req, "/_users/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodPut:
+			var change struct {
+				Role     string `json:"role"`
+				Password string `json:"password"`
+			}
+			if err := json.NewDecoder(req.Body).Decode(&change); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateUser(db, userID, change.Role, change.Password)
+		case http.MethodDelete:
+			err = deleteUser(db, userID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		switch {
+		case errors.Is(err, errUserNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+		case errors.Is(err, errLastAdmin):
+			http.Error(w, err.Error(), http.StatusConflict)
+		case errors.Is(err, errInvalidUser):
+			http.Error(w, err.Error(), http.StatusBadRequest)
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	})
+
+	http.HandleFunc("/_rules", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			// create a new rule
+			rule := Rule{Enabled: true}
+			if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateRuleForSave(db, rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			ruleID, err := insertRule(db, rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			rule.RuleID = int(ruleID)
+
+			jsonData, err := json.Marshal(rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonData)
+			return
+		} else if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// return contents of the rules table as json
+		rules, err := loadRules(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(rules)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_rules/", func(w http.ResponseWriter, req *http.Request) {
+		// GET, PUT and DELETE /_rules/<id>, POST /_rules/<id>/enable and /_rules/<id>/disable
+		ruleID, action, err := getPathId(req, "/_rules/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case action == "" && req.Method == http.MethodGet:
+			rule, err := getRule(db, ruleID)
+			if errors.Is(err, errRuleNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(rule)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case action == "" && req.Method == http.MethodPut:
+			rule := Rule{Enabled: true}
+			if err := json.NewDecoder(req.Body).Decode(&rule); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			rule.RuleID = int(ruleID)
+			if err := validateRuleForSave(db, rule); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateRule(db, rule)
+		case action == "" && req.Method == http.MethodDelete:
+			err = deleteRule(db, ruleID)
+		case action == "enable" && req.Method == http.MethodPost:
+			err = setRuleEnabled(db, ruleID, true)
+		case action == "disable" && req.Method == http.MethodPost:
+			err = setRuleEnabled(db, ruleID, false)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, errRuleNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/_callbacks", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			// register a new callback
+			var action CallbackAction
+			if err := json.NewDecoder(req.Body).Decode(&action); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateCallbackAction(db, action); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			actionID, err := insertCallbackAction(db, action)
+			if errors.Is(err, errCallbackExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			action.ID = actionID
+
+			jsonData, err := json.Marshal(action)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonData)
+			return
+		} else if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		// return the callbacks rules can use, built-in ones first
+		actions, err := loadCallbackActions(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		builtins := make([]string, 0, len(StubStorage))
+		for name := range StubStorage {
+			builtins = append(builtins, name)
+		}
+		sort.Strings(builtins)
+
+		callbacks := make([]CallbackAction, 0, len(builtins)+len(actions))
+		for _, name := range builtins {
+			callbacks = append(callbacks, CallbackAction{Name: name, ActionType: "builtin"})
+		}
+		callbacks = append(callbacks, actions...)
+
+		jsonData, err := json.Marshal(callbacks)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_callbacks/", func(w http.ResponseWriter, req *http.Request) {
+		// GET, PUT and DELETE /_callbacks/<id>
+		actionID, action, err := getPathId(req, "/_callbacks/")
+		if err != nil || action != "" {
+			http.Error(w, "Invalid callback path", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			callback, err := getCallbackAction(db, actionID)
+			if errors.Is(err, errCallbackNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(callback)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case http.MethodPut:
+			var callback CallbackAction
+			if err := json.NewDecoder(req.Body).Decode(&callback); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			callback.ID = actionID
+			if err := validateCallbackAction(db, callback); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateCallbackAction(db, callback)
+		case http.MethodDelete:
+			err = deleteCallbackAction(db, actionID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, errCallbackNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, errCallbackInUse) || errors.Is(err, errCallbackExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/_species", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			// add a species and the YOLO labels that map to it
+			var species Species
+			if err := json.NewDecoder(req.Body).Decode(&species); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateSpecies(db, species); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			speciesID, err := insertSpecies(db, species)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			species.ID = speciesID
+
+			jsonData, err := json.Marshal(species)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonData)
+			return
+		} else if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		list, err := loadSpecies(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(list)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_species/", func(w http.ResponseWriter, req *http.Request) {
+		// GET, PUT and DELETE /_species/<id>
+		speciesID, action, err := getPathId(req, "/_species/")
+		if err != nil || action != "" {
+			http.Error(w, "Invalid species path", http.StatusBadRequest)
+			return
+		}
+
+		switch req.Method {
+		case http.MethodGet:
+			species, err := getSpecies(db, speciesID)
+			if errors.Is(err, errSpeciesNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			jsonData, err := json.Marshal(species)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case http.MethodPut:
+			var species Species
+			if err := json.NewDecoder(req.Body).Decode(&species); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			species.ID = speciesID
+			if err := validateSpecies(db, species); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateSpecies(db, species)
+		case http.MethodDelete:
+			err = deleteSpecies(db, speciesID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if errors.Is(err, errSpeciesNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
+	http.HandleFunc("/snapshots/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /snapshots/<hash> and /snapshots/<hash>/thumb
+		hash, variant, _ := strings.Cut(req.URL.Path[len("/snapshots/"):], "/")
+		if variant != "" && variant != "thumb" {
+			http.Error(w, "Invalid snapshot path", http.StatusBadRequest)
+			return
+		}
+
+		file, err := openSnapshot(hash, variant == "thumb")
+		if errors.Is(err, errSnapshotNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer file.Close()
+
+		// Snapshots are content-addressed, the image behind a hash never changes
+		w.Header().Set("Content-Type", "image/jpeg")
+		w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		http.ServeContent(w, req, "", time.Time{}, file)
+	})
+
+	http.HandleFunc("/_inference", func(w http.ResponseWriter, req *http.Request) {
+		// return the depth of the YOLO inference queue and the recent jobs
+		jsonData, err := json.Marshal(inferenceQueue.Status())
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_inference/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /_inference/<job id>
+		jobID, action, err := getPathId(req, "/_inference/")
+		if err != nil || action != "" {
+			http.Error(w, "Invalid inference job path", http.StatusBadRequest)
+			return
+		}
+
+		job, err := inferenceQueue.Job(jobID)
+		if errors.Is(err, errJobNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+
+		jsonData, err := json.Marshal(job)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_channels", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == http.MethodPost {
+			// create a new notification channel
+			var channel NotificationChannel
+			if err := json.NewDecoder(req.Body).Decode(&channel); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			channel, err := keepChannelSecrets(channel, nil)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateChannel(channel); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			channelID, err := insertChannel(db, channel)
+			if errors.Is(err, errChannelExists) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			channel.ID = channelID
+
+			jsonData, err := json.Marshal(channel.Redacted())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+			w.Write(jsonData)
+			return
+		} else if req.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		channels, err := loadChannels(db)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for i := range channels {
+			channels[i] = channels[i].Redacted()
 		}
 
-		jsonData, err := json.Marshal(activeAlerts)
+		jsonData, err := json.Marshal(channels)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -218,72 +1268,97 @@ func main() {
 		w.Write(jsonData)
 	})
 
-	http.HandleFunc("/_dismiss_alert", func(w http.ResponseWriter, req *http.Request) {
-		// get the index from the get parameter
-		indexStr := req.URL.Query().Get("index")
-		if indexStr == "" {
-			http.Error(w, "Missing index parameter", http.StatusBadRequest)
+	http.HandleFunc("/_channels/", func(w http.ResponseWriter, req *http.Request) {
+		// GET, PUT and DELETE /_channels/<id>, POST /_channels/<id>/test sends a test notification
+		channelID, action, err := getPathId(req, "/_channels/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
 
-		// convert the index string to an integer
-		index, err := strconv.Atoi(indexStr)
-		if err != nil {
-			http.Error(w, "Invalid index parameter", http.StatusBadRequest)
+		switch {
+		case action == "" && req.Method == http.MethodGet, action == "test" && req.Method == http.MethodPost:
+			channel, err := getChannel(db, channelID)
+			if errors.Is(err, errChannelNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			if action == "test" {
+				err := deliverNotification(db, channel, Notification{Subject: notificationSubject, Message: "Test notification from the gateway."})
+				if err != nil {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+
+			jsonData, err := json.Marshal(channel.Redacted())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
+			return
+		case action == "" && req.Method == http.MethodPut:
+			var channel NotificationChannel
+			if err := json.NewDecoder(req.Body).Decode(&channel); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+			channel.ID = channelID
+			current, err := getChannel(db, channelID)
+			if errors.Is(err, errChannelNotFound) {
+				http.Error(w, err.Error(), http.StatusNotFound)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if channel, err = keepChannelSecrets(channel, &current); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if err := validateChannel(channel); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			err = updateChannel(db, channel)
+		case action == "" && req.Method == http.MethodDelete:
+			err = deleteChannel(db, channelID)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
 
-		// check if the index is valid
-		if index < 0 || index >= len(activeAlerts) {
-			http.Error(w, "Invalid index parameter", http.StatusBadRequest)
+		if errors.Is(err, errChannelNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if errors.Is(err, errChannelInUse) || errors.Is(err, errChannelExists) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-
-		// remove the alert from the array
-		activeAlerts = append(activeAlerts[:index], activeAlerts[index+1:]...)
-
-		// return success
 		w.WriteHeader(http.StatusOK)
 	})
 
-	// endpoint for /_events that fetches the data from client_events table containing id, client_id, type, local_timestamp, event and data)
-	http.HandleFunc("/_events", func(w http.ResponseWriter, req *http.Request) {
-		// return contents of clientData as json
-		rows, err := db.Query("SELECT id, client_id, type, local_timestamp, event, data FROM events ORDER BY id DESC LIMIT 10")
+	http.HandleFunc("/_notifications", func(w http.ResponseWriter, req *http.Request) {
+		// latest notification delivery attempts, optionally for a single alert_id
+		alertID, _ := strconv.ParseInt(req.URL.Query().Get("alert_id"), 10, 64)
+		attempts, err := listNotificationAttempts(db, alertID, 100)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
-
-		var events []map[string]interface{}
-		for rows.Next() {
-			var id int
-			var clientID, eventType, event, data string
-			var localTimestamp int64
-			if err := rows.Scan(&id, &clientID, &eventType, &localTimestamp, &event, &data); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			// Convert the data field to a map
-			var dataMap map[string]interface{}
-			if err := json.Unmarshal([]byte(data), &dataMap); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-
-			events = append(events, map[string]interface{}{
-				"id":              id,
-				"client_id":       clientID,
-				"type":            eventType,
-				"local_timestamp": time.Unix(localTimestamp, 0).Format("2006-01-02 15:04:05"),
-				"event":           event,
-				"data":            dataMap,
-			})
-		}
 
-		jsonData, err := json.Marshal(events)
+		jsonData, err := json.Marshal(attempts)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -292,26 +1367,26 @@ func main() {
 		w.Write(jsonData)
 	})
 
-	http.HandleFunc("/_rules", func(w http.ResponseWriter, req *http.Request) {
-		// return contents of clientData as json
-		rows, err := db.Query("SELECT rule_id, client_id, parameter_name, min_range, max_range, trigger, callback FROM rules")
+	http.HandleFunc("/_messages", func(w http.ResponseWriter, req *http.Request) {
+		// MQTT messages accepted by event and rejected by reason since the gateway started
+		jsonData, err := json.Marshal(messageCounters.Stats())
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		defer rows.Close()
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
 
-		var rules []Rule
-		for rows.Next() {
-			var rule Rule
-			if err := rows.Scan(&rule.RuleID, &rule.ClientID, &rule.ParameterName, &rule.MinRange, &rule.MaxRange, &rule.Trigger, &rule.Callback); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
-			rules = append(rules, rule)
+	http.HandleFunc("/_dead_letters", func(w http.ResponseWriter, req *http.Request) {
+		// latest rejected MQTT messages, optionally only those with the given reason
+		letters, err := listDeadLetters(db, req.URL.Query().Get("reason"), 100)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 
-		jsonData, err := json.Marshal(rules)
+		jsonData, err := json.Marshal(letters)
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
@@ -320,47 +1395,56 @@ func main() {
 		w.Write(jsonData)
 	})
 
+	http.HandleFunc("/_dead_letters/", func(w http.ResponseWriter, req *http.Request) {
+		// DELETE /_dead_letters/<id> once a rejected message has been looked into
+		id, action, err := getPathId(req, "/_dead_letters/")
+		if err != nil || action != "" {
+			http.Error(w, "Invalid dead letter path", http.StatusBadRequest)
+			return
+		}
+		if req.Method != http.MethodDelete {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err := deleteDeadLetter(db, id); errors.Is(err, errDeadLetterNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+
 	http.HandleFunc("/_devices/settings/", func(w http.ResponseWriter, req *http.Request) {
-		// getting and setting the settings
+		// getting and setting the settings, secrets are write-only, see settings.go
 		deviceID, _ := getDeviceId(req, "/_devices/settings/")
 
 		if req.Method == http.MethodGet {
-			clientInfo, ok := clientData[deviceID]
+			clientInfo, ok := gatewayState.Client(deviceID)
 			if !ok {
 				http.Error(w, "Device not found", http.StatusNotFound)
 				return
 			}
 
 			// Fetch settings from the device
-			resp, err := http.Get(fmt.Sprintf("http://%s/get-settings", clientInfo.IP))
+			settings, err := fetchDeviceSettings(req.Context(), clientInfo.IP)
 			if err != nil {
+				log.Printf("Error fetching settings of %s: %v\n", deviceID, err)
 				http.Error(w, "Error fetching settings from device", http.StatusInternalServerError)
 				return
 			}
-			defer resp.Body.Close()
 
-			// Passthrough the response
-			w.Header().Set("Content-Type", "application/json")
-			if _, err := io.Copy(w, resp.Body); err != nil {
-				http.Error(w, "Error copying response", http.StatusInternalServerError)
+			jsonData, err := json.Marshal(redactSettings(settings))
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(jsonData)
 		} else if req.Method == http.MethodPost {
-			var settingsData struct {
-				DeviceID          string `json:"device_id"`
-				SSID              string `json:"ssid"`
-				Password          string `json:"password"`
-				Gateway           string `json:"gateway"`
-				NoiseThreshold    int    `json:"noise_threshold"`
-				TelemetryInterval int    `json:"telemetry_interval"`
-				MQTTBroker        string `json:"mqtt_broker"`
-				MQTTTopic         string `json:"mqtt_topic"`
-				MQTTTopicSub      string `json:"mqtt_topic_sub"`
-				MQTTUsername      string `json:"mqtt_username"`
-				MQTTPassword      string `json:"mqtt_password"`
-				MQTTPort          int    `json:"mqtt_port"`
-			}
-
+			var settingsData DeviceSettings
 			err := json.NewDecoder(req.Body).Decode(&settingsData)
 			if err != nil {
 				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
@@ -369,181 +1453,358 @@ func main() {
 
 			settingsData.DeviceID = deviceID
 
-			clientInfo, ok := clientData[settingsData.DeviceID]
+			clientInfo, ok := gatewayState.Client(settingsData.DeviceID)
 			if !ok {
 				http.Error(w, "Device not found", http.StatusNotFound)
 				return
 			}
 
-			settingsPayload, err := json.Marshal(settingsData)
+			// The current settings go into the history, and secrets left blank keep the values the device has
+			var previous *DeviceSettings
+			current, err := fetchDeviceSettings(req.Context(), clientInfo.IP)
+			if err != nil && (settingsData.Password == "" || settingsData.MQTTPassword == "") {
+				log.Printf("Error fetching settings of %s: %v\n", deviceID, err)
+				http.Error(w, "Error fetching the current settings to keep the blank passwords", http.StatusInternalServerError)
+				return
+			} else if err != nil {
+				log.Printf("Error fetching settings of %s, the change is recorded without them: %v\n", deviceID, err)
+			} else {
+				settingsData.keepSecrets(current)
+				if settings, err := mergeSettings(deviceID, current, nil); err == nil {
+					previous = &settings
+				}
+			}
+
+			redacted, _ := json.Marshal(settingsData.Redacted())
+			log.Printf("Updating settings of %s: %s\n", deviceID, redacted)
+
+			// Send the settings update request to the device
+			response, err := applyDeviceSettings(req.Context(), db, clientInfo.IP, previous, settingsData, settingsOrigin{Actor: alertActor(req), Source: settingsManual})
 			if err != nil {
-				http.Error(w, "Error creating settings payload", http.StatusInternalServerError)
+				log.Printf("Error updating settings of %s: %v\n", deviceID, err)
+				if errors.Is(err, errSettingsRejected) {
+					http.Error(w, err.Error(), http.StatusBadGateway)
+					return
+				}
+				http.Error(w, "Error updating device settings", http.StatusInternalServerError)
+				return
+			}
+
+			// Pass the device's response through
+			w.Header().Set("Content-Type", "application/json")
+			w.Write(response)
+		} else {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+	})
+
+	http.HandleFunc("/_settings_changes", func(w http.ResponseWriter, req *http.Request) {
+		// the latest settings changes, of one device with ?client_id=, see settings_history.go
+		query := req.URL.Query()
+		clientID := query.Get("client_id")
+		if clientID != "" && !macRegex.MatchString(clientID) {
+			http.Error(w, "invalid device ID: "+clientID, http.StatusBadRequest)
+			return
+		}
+		limit := 100
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 || limit > 1000 {
+				http.Error(w, "invalid limit: "+value, http.StatusBadRequest)
 				return
 			}
+		}
 
-			log.Println(string(settingsPayload))
+		changes, err := listSettingsChanges(db, clientID, limit)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
-			// Create a URL encoded form
-			data := url.Values{}
-			data.Set("settings", string(settingsPayload))
+		jsonData, err := json.Marshal(changes)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
 
-			// Send the settings update request to the device
-			resp, err := http.PostForm(fmt.Sprintf("http://%s/update-settings", clientInfo.IP), data)
+	http.HandleFunc("/_settings_changes/", func(w http.ResponseWriter, req *http.Request) {
+		// GET /_settings_changes/<id>, POST /_settings_changes/<id>/revert to push the settings before it back
+		changeID, action, err := getPathId(req, "/_settings_changes/")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var change SettingsChange
+		switch {
+		case action == "" && req.Method == http.MethodGet:
+			change, err = getSettingsChange(db, changeID)
+		case action == "revert" && req.Method == http.MethodPost:
+			change, err = revertSettingsChange(req.Context(), db, changeID, alertActor(req))
+		case action == "" || action == "revert":
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		default:
+			http.Error(w, "Invalid settings change path", http.StatusBadRequest)
+			return
+		}
+
+		switch {
+		case errors.Is(err, errSettingsChangeNotFound), errors.Is(err, errDeviceNotFound):
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		case errors.Is(err, errPreviousUnknown):
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		case errors.Is(err, errSettingsRejected):
+			log.Printf("Error with settings change %d: %v\n", changeID, err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		case err != nil:
+			log.Printf("Error with settings change %d: %v\n", changeID, err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 
+		jsonData, err := json.Marshal(change)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
+	})
+
+	http.HandleFunc("/_rollouts", func(w http.ResponseWriter, req *http.Request) {
+		// GET the latest settings rollouts, POST to start one, see rollouts.go
+		switch req.Method {
+		case http.MethodGet:
+			rollouts, err := listRollouts(db, 50)
 			if err != nil {
-				http.Error(w, "Error updating device settings", http.StatusInternalServerError)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
 				return
 			}
-			defer resp.Body.Close()
 
-			// Passthrough the device's response
+			jsonData, err := json.Marshal(rollouts)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
 			w.Header().Set("Content-Type", "application/json")
-			if _, err := io.Copy(w, resp.Body); err != nil {
-				http.Error(w, "Error copying response", http.StatusInternalServerError)
+			w.Write(jsonData)
+		case http.MethodPost:
+			var request RolloutRequest
+			if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+				http.Error(w, "Invalid request payload: "+err.Error(), http.StatusBadRequest)
 				return
 			}
-		} else {
+
+			rollout, err := startRollout(db, request, alertActor(req))
+			if errors.Is(err, errRolloutRunning) {
+				http.Error(w, err.Error(), http.StatusConflict)
+				return
+			} else if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+
+			jsonData, err := json.Marshal(rollout)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusAccepted)
+			w.Write(jsonData)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+
+	http.HandleFunc("/_rollouts/", func(w http.ResponseWriter, req *http.Request) {
+		// GET a rollout with the state of each of its devices
+		rolloutID, action, err := getPathId(req, "/_rollouts/")
+		if err != nil || action != "" {
+			http.Error(w, "Invalid rollout path", http.StatusBadRequest)
+			return
+		}
+		if req.Method != http.MethodGet {
 			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
 			return
 		}
+
+		rollout, err := getRollout(db, rolloutID)
+		if errors.Is(err, errRolloutNotFound) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonData, err := json.Marshal(rollout)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(jsonData)
 	})
 
 	go func() {
-		log.Fatal(http.ListenAndServe("0.0.0.0:8080", nil))
+		log.Fatal(http.ListenAndServe(config.HTTP.Listen, requireAuth(db, http.DefaultServeMux)))
 	}()
 
 	select {} // Keep the program running indefinitely
 }
 
-// Function to save event data to the database
-func saveTelemetryData(db *sql.DB, eventPayload map[string]interface{}) error {
+// handleMessage processes an event published by a device: telemetry and intrusions are stored and matched
+// against the rules, registrations update the device registry. Messages that fail validation are dead-lettered.
+func handleMessage(db *sql.DB, topic string, payload []byte) {
+	msg, err := parseDeviceMessage(payload)
+	if err != nil {
+		rejectMessage(db, topic, payload, msg.ClientID, err)
+		return
+	}
+
+	switch msg.Event {
+	case eventTelemetry, eventIntrusion:
+		telemetry, err := msg.telemetry()
+		if err != nil {
+			rejectMessage(db, topic, payload, msg.ClientID, err)
+			return
+		}
+		messageCounters.Accept(msg.Event)
+
+		// Save telemetry or intrusion event data to the database
+		if err := touchDevice(db, msg.ClientID); err != nil {
+			log.Printf("Error updating device: %v\n", err)
+		}
+		eventID, err := saveTelemetryData(db, telemetry)
+		if err != nil {
+			// The rules would raise alerts for an event that does not exist
+			log.Printf("Error saving event data: %v\n", err)
+			return
+		}
+
+		// Match the received data against user-defined rules and execute callbacks if necessary
+		if err := matchRuleAndExecuteCallback(db, msg.ClientID, eventID, telemetry.Data); err != nil {
+			log.Printf("Error: %v", err)
+		}
 
-	clientID := eventPayload["client_id"].(string)
-	/*if _, ok := clientData[clientID]; !ok {
-		return fmt.Errorf("received data from non registrered client: %s", clientId)
-	}*/
-	// TODO: remove
+	case eventRegistration:
+		registration, err := msg.registration()
+		if err != nil {
+			rejectMessage(db, topic, payload, msg.ClientID, err)
+			return
+		}
+		messageCounters.Accept(msg.Event)
 
-	// Extract data from the eventPayload map
-	deviceType := eventPayload["device_type"].(string)
-	localTimestamp := int64(eventPayload["local_timestamp"].(float64)) // Assuming timestamp is a number
+		// Handle client registration events
+		if err := handleRegistration(db, registration); err != nil {
+			log.Printf("Error registering client: %v\n", err)
+		}
+	}
+}
 
+// Function to save event data to the database, returns the ID of the new events row
+func saveTelemetryData(db *sql.DB, msg TelemetryMessage) (int64, error) {
 	// Convert "data" field to JSON string
-	dataJSON, err := json.Marshal(eventPayload["data"])
+	dataJSON, err := json.Marshal(msg.Data)
 	if err != nil {
-		return err
+		return 0, err
 	}
 
+	// Compare the device clock with the time the message arrived
+	receivedAt := time.Now().Unix()
+	clockOffset, timestampFlag := checkTimestamp(msg.LocalTimestamp, receivedAt, currentConfig().Clock.MaxSkew)
+
 	// Insert data into the database
 	insertSQL := `
-	INSERT INTO events (client_id, type, local_timestamp, event, data)
-	VALUES (?, ?, ?, ?, ?);
+	INSERT INTO events (client_id, type, local_timestamp, received_at, event, data, clock_offset, timestamp_flag)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?);
 	`
-	_, err = db.Exec(insertSQL, clientID, deviceType, localTimestamp, eventPayload["event"].(string), string(dataJSON))
-	return err
+	result, err := db.Exec(insertSQL, msg.ClientID, msg.DeviceType, msg.LocalTimestamp, receivedAt, msg.Event, string(dataJSON), clockOffset, nullableString(timestampFlag))
+	if err != nil {
+		return 0, err
+	}
+	eventID, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if err := updateDeviceClock(db, msg.ClientID, clockOffset, timestampFlag, eventID); err != nil {
+		log.Printf("Error updating the clock of %s: %v\n", msg.ClientID, err)
+	}
+	return eventID, nil
 }
 
-func handleRegistration(eventPayload map[string]interface{}) error {
-	clientID := eventPayload["client_id"].(string)
-	deviceType := eventPayload["device_type"].(string)
-	deviceIP := eventPayload["data"].(map[string]interface{})["ip"].(string)
-
+func handleRegistration(db *sql.DB, msg RegistrationMessage) error {
 	// Store IP and Type in ClientInfo struct
-	clientData[clientID] = ClientInfo{
-		ID:   clientID,
-		IP:   deviceIP,
-		Type: deviceType,
+	client := ClientInfo{
+		ID:   msg.ClientID,
+		IP:   msg.IP,
+		Type: msg.DeviceType,
+	}
+	if err := registerDevice(db, client, msg.Firmware); err != nil {
+		return err
+	}
+	if err := markDeviceOnline(db, msg.ClientID, "registered"); err != nil {
+		return err
 	}
-	fmt.Printf("Registered client: %s (%s) Type: %s\n", clientID, deviceIP, deviceType)
+	gatewayState.SetClient(client)
+	log.Printf("Registered client: %s (%s) Type: %s\n", msg.ClientID, msg.IP, msg.DeviceType)
 
 	return nil
 }
 
-func init() {
-	go func() {
-		for {
-			checkClients()
-			time.Sleep(30 * time.Second)
-		}
-	}()
-}
-
-func checkClients() {
-	for clientID, clientInfo := range clientData {
-		// Create a new HTTP client
-		client := &http.Client{}
-
-		// Construct the URL for the health check
-		url := fmt.Sprintf("http://%s/healthz", clientInfo.IP)
-
-		// Perform the GET request
-		resp, err := client.Get(url)
-		if err != nil {
-			// Log the error and continue to the next client
-			log.Printf("Error checking health of client %s: %v\n", clientID, err)
-			log.Printf("Removed client %s from the map due to unhealthy status\n", clientID)
-			delete(clientData, clientID) // TODO REMOVE
-			continue
-		}
-		defer resp.Body.Close()
-
-		// Check if the response status code is 200 OK
-		if resp.StatusCode != http.StatusOK {
-			// Remove the client from the map
-			delete(clientData, clientID) //TODO REMOVE
-			log.Printf("Removed client %s from the map due to unhealthy status\n", clientID)
-		} else {
-			log.Printf("Client %s is healthy\n", clientID)
-		}
-	}
-}
-
-func matchRuleAndExecuteCallback(db *sql.DB, clientID string, data json.RawMessage) error {
+func matchRuleAndExecuteCallback(db *sql.DB, clientID string, eventID int64, paramValueMap map[string]interface{}) error {
 	// Query for rules matching the client ID
-	var rows *sql.Rows
-	var err error
-	rows, err = db.Query("SELECT rule_id, client_id, parameter_name, min_range, max_range, trigger, callback FROM rules")
-
+	rules, err := loadRules(db)
 	if err != nil {
 		return err
 	}
-	defer rows.Close()
 
 	// Iterate over the rules
-	for rows.Next() {
-		var rule Rule
-		err = rows.Scan(&rule.RuleID, &rule.ClientID, &rule.ParameterName, &rule.MinRange, &rule.MaxRange, &rule.Trigger, &rule.Callback)
-		if err != nil {
-			return err
+	for _, rule := range rules {
+		if !rule.Enabled {
+			continue
 		}
-
 		if rule.ClientID != "*" && rule.ClientID != clientID {
 			continue
 		}
 
-		var paramValueMap interface{}
-		err = json.Unmarshal(data, &paramValueMap)
-		if err != nil {
-			return err
-		}
-
 		// log.Printf("RULE: %s\n", rule.Trigger)
 		// log.Printf("NAME: %s\n", rule.ParameterName)
 		// log.Printf("VAL: %v\n", paramValueMap)
 
-		for key, paramValue := range paramValueMap.(map[string]interface{}) {
+		if rule.Trigger == expressionTrigger {
+			// Expressions were validated on save, a parse error here means the row was edited by hand
+			node, err := ruleExpression(rule.RuleID, rule.Expression)
+			if err != nil {
+				log.Printf("Skipping rule %d: invalid expression: %v", rule.RuleID, err)
+				continue
+			}
+			if evaluateExpression(node, paramValueMap) {
+				raiseRuleAlert(db, rule, clientID, eventID, paramValueMap, rule.Expression+" matched - alert triggered.")
+			}
+			continue
+		}
+
+		for key, paramValue := range paramValueMap {
 			if key == rule.ParameterName {
 				// Check if the parameter value matches the rule
 				switch rule.Trigger {
-				case "inside_range_trigger":
+				case insideRangeTrigger:
 					if val, ok := paramValue.(float64); ok && val >= rule.MinRange && val <= rule.MaxRange {
-						activeAlerts = append(activeAlerts, ActiveAlerts{Type: "rule trigger", ClientID: clientID, Timestamp: time.Now().Format("2006-01-02 15:04:05"), Message: key + " detected (confidence: " + strconv.FormatFloat(paramValue.(float64), 'f', -1, 64) + ") - alert triggered."})
-						go executeCallback(rule.Callback, clientID)
+						raiseRuleAlert(db, rule, clientID, eventID, paramValueMap, key+" detected (confidence: "+strconv.FormatFloat(val, 'f', -1, 64)+") - alert triggered.")
 					}
-				case "outside_range_trigger":
+				case outsideRangeTrigger:
 					if val, ok := paramValue.(float64); ok && (val < rule.MinRange || val > rule.MaxRange) {
-						activeAlerts = append(activeAlerts, ActiveAlerts{Type: "rule trigger", ClientID: clientID, Timestamp: time.Now().Format("2006-01-02 15:04:05"), Message: key + " detected (confidence: " + strconv.FormatFloat(paramValue.(float64), 'f', -1, 64) + ") - alert triggered."})
-						go executeCallback(rule.Callback, clientID)
+						raiseRuleAlert(db, rule, clientID, eventID, paramValueMap, key+" detected (confidence: "+strconv.FormatFloat(val, 'f', -1, 64)+") - alert triggered.")
 					}
 				default:
 					err = fmt.Errorf("invalid trigger: %s", rule.Trigger)
@@ -557,124 +1818,60 @@ func matchRuleAndExecuteCallback(db *sql.DB, clientID string, data json.RawMessa
 	return nil
 }
 
-func yolo_post_classification(clientID string) {
-	_clientData := clientData[clientID]
-
-	log.Printf("Invoking YOLO model")
-
-	payload := map[string]interface{}{"ip_address": _clientData.IP}
-	payloadBytes, err := json.Marshal(payload)
+// raiseRuleAlert stores an alert for a matched rule and runs the rule's callback.
+// A match that duplicates an alert still open for the same rule and device only bumps its occurrence count,
+// and a rule still in its cooldown window is ignored.
+func raiseRuleAlert(db *sql.DB, rule Rule, clientID string, eventID int64, data map[string]interface{}, message string) {
+	duplicateID, err := findDuplicateAlert(db, rule.RuleID, clientID)
 	if err != nil {
-		log.Printf("Error marshaling payload: %v", err)
+		log.Printf("Error looking up open alerts for rule %d: %v\n", rule.RuleID, err)
+	} else if duplicateID != 0 {
+		if err := recordAlertOccurrence(db, duplicateID); err != nil {
+			log.Printf("Error updating alert %d: %v\n", duplicateID, err)
+		}
 		return
 	}
 
-	resp, err := http.Post("http://localhost:8081/infer", "application/json", bytes.NewBuffer(payloadBytes))
-
+	cooling, err := inCooldown(db, rule, clientID)
 	if err != nil {
-		log.Printf("Error invoking YOLO model: %v", err)
-		return
-	}
-	defer resp.Body.Close()
-
-	var yoloResponse struct {
-		TopLabel   string  `json:"top_label"`
-		Confidence float64 `json:"confidence"`
-	}
-
-	if err := json.NewDecoder(resp.Body).Decode(&yoloResponse); err != nil {
-		log.Printf("Error decoding YOLO response: %v", err)
+		log.Printf("Error checking cooldown of rule %d: %v\n", rule.RuleID, err)
+	} else if cooling {
+		log.Printf("Rule %d matched for %s during its cooldown window, ignoring\n", rule.RuleID, clientID)
 		return
 	}
 
-	log.Printf("### Response from backup YOLO model: %s", yoloResponse.TopLabel)
-
-	switch yoloResponse.TopLabel {
-	case "fox":
-		go executeCallback("fox_callback")
-	case "bear":
-		go executeCallback("bear_callback")
-	case "wolf":
-		go executeCallback("wolf_callback")
-	case "timber_wolf":
-		go executeCallback("wolf_callback")
-	case "crocodile":
-		go executeCallback("crocodile_callback")
-	case "deer":
-		go executeCallback("deer_callback")
-	default:
-		log.Printf("Unrecognized animal: %s", yoloResponse.TopLabel)
+	alertID, err := createAlert(db, "rule trigger", clientID, int64(rule.RuleID), eventID, message)
+	if err != nil {
+		log.Printf("Error storing alert for rule %d: %v\n", rule.RuleID, err)
+	} else {
+		go captureSnapshot(db, clientID, eventID, alertID)
 	}
+	go executeCallback(&ActionContext{DB: db, ClientID: clientID, EventID: eventID, Data: data, Rule: &rule, AlertID: alertID}, rule.Callback)
+	notifyRule(db, rule, alertID, clientID, message)
 }
 
-func fox_callback(clientID string) {
-	log.Printf("Fox detected, doing stuff...")
-	mqttClient.Publish(
-		"uol/uol-cm3070-mod11/sub/"+clientID,
-		0,
-		false,
-		"{\"event\": \"fox_alert\", \"client_id\": \""+clientID+"\", \"data\": {}} }",
-	)
-
-}
-func bear_callback(clientID string) {
-	log.Printf("Bear detected, doing stuff...")
-
-	mqttClient.Publish(
-		"uol/uol-cm3070-mod11/sub/"+clientID,
-		0,
-		false,
-		"{\"event\": \"bear_alert\", \"client_id\": \""+clientID+"\", \"data\": {}} }",
-	)
-}
-func wolf_callback(clientID string) {
-	log.Printf("Wolf detected, doing stuff...")
-
-	mqttClient.Publish(
-		"uol/uol-cm3070-mod11/sub/"+clientID,
-		0,
-		false,
-		"{\"event\": \"wolf_alert\", \"client_id\": \""+clientID+"\", \"data\": {}} }",
-	)
-}
-func crocodile_callback(clientID string) {
-	log.Printf("crocodile detected, publishing to uol/uol-cm3070-mod11-%s\n", clientID)
-
-	mqttClient.Publish(
-		"uol/uol-cm3070-mod11/sub/"+clientID,
-		0,
-		false,
-		"{\"event\": \"crocodile_alert\", \"client_id\": \""+clientID+"\", \"data\": {}} }",
-	)
-}
-func deer_callback(clientID string) {
-	log.Printf("Deer detected, doing stuff...")
-
-	mqttClient.Publish(
-		"uol/uol-cm3070-mod11/sub/"+clientID,
-		0,
-		false,
-		"{\"event\": \"deer_alert\", \"client_id\": \""+clientID+"\", \"data\": {}} }",
-	)
+// getPathId extracts a numeric ID and an optional action from paths like /_alerts/12/acknowledge
+func getPathId(req *http.Request, path string) (int64, string, error) {
+	idStr, action, _ := strings.Cut(req.URL.Path[len(path):], "/")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid ID: %s", idStr)
+	}
+	return id, action, nil
 }
 
-func executeCallback(funcName string, params ...interface{}) (result interface{}, err error) {
-	f := reflect.ValueOf(StubStorage[funcName])
-	if len(params) != f.Type().NumIn() {
-		err = errors.New("the number of params is out of index")
-		return
-	}
-	in := make([]reflect.Value, len(params))
-	for k, param := range params {
-		in[k] = reflect.ValueOf(param)
+// alertActor returns who performed an alert action, the logged in user
+func alertActor(req *http.Request) string {
+	if session, ok := requestSession(req); ok {
+		return session.User.Username
 	}
-	f.Call(in)
-	return
+	return "unknown"
 }
 
-func getDeviceId(req *http.Request, path string) (string, error) {
-	macRegex := regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}$`)
+// macRegex matches device IDs, which are the MAC addresses of the ESP32s
+var macRegex = regexp.MustCompile(`^[0-9a-fA-F]{2}(:[0-9a-fA-F]{2}){5}$`)
 
+func getDeviceId(req *http.Request, path string) (string, error) {
 	// Extract the potential MAC address from the URL path
 	deviceID := req.URL.Path[len(path):]
 	// remove first character from deviceID
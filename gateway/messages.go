@@ -0,0 +1,332 @@
+// This file implements the validation of the MQTT messages published by the devices. Every message is decoded
+// into the typed struct of its event before the gateway acts on it, so a malformed message from one device is
+// rejected instead of crashing the gateway. Rejected messages are counted by reason and kept in dead_letters.
+//
+// All messages share the envelope
+//
+//	{"client_id": "<MAC>", "device_type": "...", "local_timestamp": <unix seconds>, "event": "...", "data": {...}}
+//
+// telemetry and intrusion carry flat sensor readings in data, registration carries the device's ip and
+// optionally its firmware.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// maxMessageSize is the largest payload accepted, the firmware sends a few hundred bytes
+const maxMessageSize = 16 << 10
+
+// Device events
+const (
+	eventTelemetry    = "telemetry"
+	eventIntrusion    = "intrusion"
+	eventRegistration = "registration"
+)
+
+// Reasons a message is rejected for
+const (
+	rejectTooLarge     = "too_large"
+	rejectInvalidJSON  = "invalid_json"
+	rejectMissingField = "missing_field"
+	rejectInvalidField = "invalid_field"
+	rejectUnknownEvent = "unknown_event"
+)
+
+var errDeadLetterNotFound = errors.New("dead letter not found")
+
+// MessageError is returned when a message fails validation
+type MessageError struct {
+	Reason  string // one of the reject constants
+	Message string
+}
+
+func (e *MessageError) Error() string {
+	return e.Message
+}
+
+func messageError(reason string, format string, args ...interface{}) *MessageError {
+	return &MessageError{Reason: reason, Message: fmt.Sprintf(format, args...)}
+}
+
+// DeviceMessage is the envelope of every message published by a device
+type DeviceMessage struct {
+	ClientID       string `json:"client_id"`
+	DeviceType     string `json:"device_type"`
+	LocalTimestamp int64  `json:"local_timestamp"`
+	Event          string `json:"event"`
+
+	data json.RawMessage
+}
+
+// TelemetryMessage is a telemetry or intrusion event. Data holds the sensor readings, numbers, booleans or strings.
+type TelemetryMessage struct {
+	DeviceMessage
+	Data map[string]interface{}
+}
+
+// RegistrationMessage is sent by a device when it connects
+type RegistrationMessage struct {
+	DeviceMessage
+	IP       string
+	Firmware string
+}
+
+// parseDeviceMessage decodes and validates the envelope of a message
+func parseDeviceMessage(payload []byte) (DeviceMessage, error) {
+	var msg DeviceMessage
+	if len(payload) > maxMessageSize {
+		return msg, messageError(rejectTooLarge, "message is %d bytes, the limit is %d", len(payload), maxMessageSize)
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		var syntaxErr *json.SyntaxError
+		if errors.As(err, &syntaxErr) {
+			return msg, messageError(rejectInvalidJSON, "message is not valid JSON: %v", err)
+		}
+		return msg, messageError(rejectInvalidJSON, "message is not a JSON object")
+	}
+
+	if err := decodeField(fields, "client_id", "a string", &msg.ClientID); err != nil {
+		return msg, err
+	}
+	if !macRegex.MatchString(msg.ClientID) {
+		return msg, messageError(rejectInvalidField, "client_id %q is not a MAC address", msg.ClientID)
+	}
+	if err := decodeField(fields, "event", "a string", &msg.Event); err != nil {
+		return msg, err
+	}
+	switch msg.Event {
+	case eventTelemetry, eventIntrusion, eventRegistration:
+	default:
+		return msg, messageError(rejectUnknownEvent, "unknown event type: %s", msg.Event)
+	}
+	if err := decodeField(fields, "device_type", "a string", &msg.DeviceType); err != nil {
+		return msg, err
+	}
+	if msg.DeviceType == "" {
+		return msg, messageError(rejectInvalidField, "device_type is empty")
+	}
+	if err := decodeField(fields, "local_timestamp", "an integer", &msg.LocalTimestamp); err != nil {
+		return msg, err
+	}
+	if msg.LocalTimestamp < 0 {
+		return msg, messageError(rejectInvalidField, "local_timestamp must not be negative")
+	}
+	var data map[string]json.RawMessage
+	if err := decodeField(fields, "data", "an object", &data); err != nil {
+		return msg, err
+	}
+	msg.data = fields["data"]
+	return msg, nil
+}
+
+// decodeField decodes a required field of a JSON object into dest, which must be of the described type
+func decodeField(fields map[string]json.RawMessage, name string, description string, dest interface{}) error {
+	raw, ok := fields[name]
+	if !ok || string(raw) == "null" {
+		return messageError(rejectMissingField, "%s is missing", name)
+	}
+	if err := json.Unmarshal(raw, dest); err != nil {
+		return messageError(rejectInvalidField, "%s must be %s", name, description)
+	}
+	return nil
+}
+
+// telemetry validates the data of a telemetry or intrusion event. Intrusions must carry the prediction of the edge model.
+func (msg DeviceMessage) telemetry() (TelemetryMessage, error) {
+	telemetry := TelemetryMessage{DeviceMessage: msg}
+	if err := json.Unmarshal(msg.data, &telemetry.Data); err != nil {
+		return telemetry, messageError(rejectInvalidField, "data must be an object")
+	}
+	for key, value := range telemetry.Data {
+		switch value := value.(type) {
+		case bool, string:
+		case float64:
+			if math.IsNaN(value) || math.IsInf(value, 0) {
+				return telemetry, messageError(rejectInvalidField, "data.%s is not a finite number", key)
+			}
+		default:
+			return telemetry, messageError(rejectInvalidField, "data.%s must be a number, boolean or string", key)
+		}
+	}
+
+	if msg.Event == eventIntrusion {
+		if _, ok := telemetry.Data["predicted_animal"].(string); !ok {
+			return telemetry, messageError(rejectMissingField, "data.predicted_animal is missing or not a string")
+		}
+		confidence, ok := telemetry.Data["predicted_confidence"].(float64)
+		if !ok {
+			return telemetry, messageError(rejectMissingField, "data.predicted_confidence is missing or not a number")
+		}
+		if confidence < 0 || confidence > 100 {
+			return telemetry, messageError(rejectInvalidField, "data.predicted_confidence must be between 0 and 100")
+		}
+	}
+	return telemetry, nil
+}
+
+// registration validates the data of a registration event
+func (msg DeviceMessage) registration() (RegistrationMessage, error) {
+	registration := RegistrationMessage{DeviceMessage: msg}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(msg.data, &data); err != nil {
+		return registration, messageError(rejectInvalidField, "data must be an object")
+	}
+	if err := decodeField(data, "ip", "a string", &registration.IP); err != nil {
+		return registration, prefixDataField(err)
+	}
+	// The gateway requests http://<ip>/healthz and /capture, so the address must be a plain host with an optional port
+	if u, err := url.Parse("http://" + registration.IP); registration.IP == "" || err != nil || u.Host != registration.IP {
+		return registration, messageError(rejectInvalidField, "data.ip %q is not a host address", registration.IP)
+	}
+	if err := decodeField(data, "firmware", "a string", &registration.Firmware); err != nil && !isMissingField(err) {
+		return registration, prefixDataField(err)
+	}
+	return registration, nil
+}
+
+func prefixDataField(err error) error {
+	var msgErr *MessageError
+	if errors.As(err, &msgErr) {
+		return messageError(msgErr.Reason, "data.%s", msgErr.Message)
+	}
+	return err
+}
+
+func isMissingField(err error) bool {
+	var msgErr *MessageError
+	return errors.As(err, &msgErr) && msgErr.Reason == rejectMissingField
+}
+
+// MessageCounters counts the messages handled since the gateway started
+type MessageCounters struct {
+	mu       sync.Mutex
+	since    time.Time
+	accepted map[string]int64 // by event
+	rejected map[string]int64 // by reason
+}
+
+// MessageStats is a snapshot of the counters
+type MessageStats struct {
+	Since    string           `json:"since"`
+	Accepted map[string]int64 `json:"accepted"`
+	Rejected map[string]int64 `json:"rejected"`
+}
+
+func newMessageCounters() *MessageCounters {
+	return &MessageCounters{since: time.Now(), accepted: map[string]int64{}, rejected: map[string]int64{}}
+}
+
+// messageCounters is shared by the whole gateway
+var messageCounters = newMessageCounters()
+
+func (c *MessageCounters) Accept(event string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.accepted[event]++
+}
+
+func (c *MessageCounters) Reject(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rejected[reason]++
+}
+
+func (c *MessageCounters) Stats() MessageStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	stats := MessageStats{
+		Since:    formatTimestamp(c.since.Unix()),
+		Accepted: make(map[string]int64, len(c.accepted)),
+		Rejected: make(map[string]int64, len(c.rejected)),
+	}
+	for event, n := range c.accepted {
+		stats.Accepted[event] = n
+	}
+	for reason, n := range c.rejected {
+		stats.Rejected[reason] = n
+	}
+	return stats
+}
+
+// DeadLetter is a row of the dead_letters table
+type DeadLetter struct {
+	ID         int64  `json:"id"`
+	Topic      string `json:"topic"`
+	ClientID   string `json:"client_id,omitempty"`
+	Reason     string `json:"reason"`
+	Error      string `json:"error"`
+	Payload    string `json:"payload"`
+	ReceivedAt string `json:"received_at"`
+}
+
+// rejectMessage counts a message that failed validation and stores it in dead_letters
+func rejectMessage(db *sql.DB, topic string, payload []byte, clientID string, err error) {
+	reason := rejectInvalidField
+	var msgErr *MessageError
+	if errors.As(err, &msgErr) {
+		reason = msgErr.Reason
+	}
+	messageCounters.Reject(reason)
+	log.Printf("Rejected MQTT message from %q on %s: %v\n", clientID, topic, err)
+
+	if len(payload) > maxMessageSize {
+		payload = payload[:maxMessageSize]
+	}
+	_, dbErr := db.Exec(
+		"INSERT INTO dead_letters (topic, client_id, reason, error, payload, received_at) VALUES (?, ?, ?, ?, ?, ?)",
+		topic, nullableString(clientID), reason, err.Error(), string(payload), time.Now().Unix(),
+	)
+	if dbErr != nil {
+		log.Printf("Error storing dead letter: %v\n", dbErr)
+	}
+}
+
+// listDeadLetters returns the latest rejected messages, optionally only those with the given reason
+func listDeadLetters(db *sql.DB, reason string, limit int) ([]DeadLetter, error) {
+	query := "SELECT id, topic, client_id, reason, error, payload, received_at FROM dead_letters"
+	args := []interface{}{}
+	if reason != "" {
+		query += " WHERE reason = ?"
+		args = append(args, reason)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	letters := []DeadLetter{}
+	for rows.Next() {
+		var letter DeadLetter
+		var topic, clientID sql.NullString
+		var receivedAt int64
+		if err := rows.Scan(&letter.ID, &topic, &clientID, &letter.Reason, &letter.Error, &letter.Payload, &receivedAt); err != nil {
+			return nil, err
+		}
+		letter.Topic = topic.String
+		letter.ClientID = clientID.String
+		letter.ReceivedAt = formatTimestamp(receivedAt)
+		letters = append(letters, letter)
+	}
+	return letters, rows.Err()
+}
+
+func deleteDeadLetter(db *sql.DB, id int64) error {
+	result, err := db.Exec("DELETE FROM dead_letters WHERE id = ?", id)
+	return expectOneRow(result, err, errDeadLetterNotFound)
+}
@@ -0,0 +1,354 @@
+// This file implements the schema migrations. The migrations are SQL files embedded from migrations/, named
+// <version>_<name>.up.sql and <version>_<name>.down.sql. The gateway applies the pending ones at startup, each in
+// its own transaction, and records them in schema_version. `uol-gateway migrate` applies, rolls back or lists them.
+//
+// Databases created before schema_version existed are adopted: the version is derived from the tables present.
+
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// Migration is a versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus tells whether a migration has been applied
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64 // 0 if pending
+}
+
+// legacyTables are the tables each migration created, used to find the version of a database created before
+// schema_version existed
+var legacyTables = map[int]string{
+	1: "events",
+	2: "alerts",
+	3: "species",
+	4: "snapshots",
+	5: "devices",
+}
+
+// loadMigrations reads the embedded migrations, sorted by version
+func loadMigrations() ([]Migration, error) {
+	files, err := fs.Glob(migrationFiles, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, file := range files {
+		name := strings.TrimPrefix(file, "migrations/")
+		base, direction, ok := strings.Cut(strings.TrimSuffix(name, ".sql"), ".")
+		versionString, migrationName, ok2 := strings.Cut(base, "_")
+		version, err := strconv.Atoi(versionString)
+		if !ok || !ok2 || err != nil || (direction != "up" && direction != "down") {
+			return nil, fmt.Errorf("invalid migration file name: %s", name)
+		}
+
+		data, err := migrationFiles.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		migration, ok := byVersion[version]
+		if !ok {
+			migration = &Migration{Version: version, Name: migrationName}
+			byVersion[version] = migration
+		} else if migration.Name != migrationName {
+			return nil, fmt.Errorf("migration %d has two names: %s and %s", version, migration.Name, migrationName)
+		}
+		if direction == "up" {
+			migration.Up = string(data)
+		} else {
+			migration.Down = string(data)
+		}
+	}
+
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, migration := range byVersion {
+		if migration.Up == "" || migration.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s needs both an up and a down file", migration.Version, migration.Name)
+		}
+		migrations = append(migrations, *migration)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must be consecutive from 1, found %d at position %d", migration.Version, i+1)
+		}
+	}
+	return migrations, nil
+}
+
+// ensureSchemaVersion creates the schema_version table, adopting a database created before it existed
+func ensureSchemaVersion(db *sql.DB, migrations []Migration) error {
+	exists, err := tableExists(db, "schema_version")
+	if err != nil || exists {
+		return err
+	}
+
+	// Count the migrations whose tables are already there
+	adopted := 0
+	for _, migration := range migrations {
+		table, ok := legacyTables[migration.Version]
+		if !ok {
+			break
+		}
+		exists, err := tableExists(db, table)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			break
+		}
+		adopted = migration.Version
+	}
+	for version, table := range legacyTables {
+		if version <= adopted {
+			continue
+		}
+		if exists, err := tableExists(db, table); err != nil {
+			return err
+		} else if exists {
+			return fmt.Errorf("cannot determine the schema version: table %s exists but the tables of migration %d do not", table, adopted+1)
+		}
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`CREATE TABLE schema_version (
+		version INTEGER PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at INTEGER NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+	now := time.Now().Unix()
+	for _, migration := range migrations[:adopted] {
+		if _, err := tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Name, now); err != nil {
+			return err
+		}
+	}
+	if adopted > 0 {
+		log.Printf("Adopted existing database at schema version %d\n", adopted)
+	}
+	return tx.Commit()
+}
+
+func tableExists(db *sql.DB, name string) (bool, error) {
+	var count int
+	err := db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?", name).Scan(&count)
+	return count > 0, err
+}
+
+// currentSchemaVersion returns the version of the last applied migration, 0 for an empty database
+func currentSchemaVersion(db *sql.DB) (int, error) {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	return version, err
+}
+
+// migrateUp applies the pending migrations up to and including target, 0 means all
+func migrateUp(db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureSchemaVersion(db, migrations); err != nil {
+		return err
+	}
+	if target == 0 {
+		target = len(migrations)
+	}
+	if target > len(migrations) {
+		return fmt.Errorf("unknown schema version %d, the latest is %d", target, len(migrations))
+	}
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if target < current {
+		return fmt.Errorf("the database is already at version %d, use migrate down to roll back", current)
+	}
+
+	for _, migration := range migrations[current:target] {
+		if err := applyMigration(db, migration, migration.Up, true); err != nil {
+			return fmt.Errorf("migration %d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+		log.Printf("Applied migration %d_%s\n", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// migrateDown rolls back the applied migrations above target
+func migrateDown(db *sql.DB, target int) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+	if err := ensureSchemaVersion(db, migrations); err != nil {
+		return err
+	}
+	current, err := currentSchemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if target < 0 || target > current {
+		return fmt.Errorf("cannot roll back to version %d, the database is at version %d", target, current)
+	}
+
+	for i := current - 1; i >= target; i-- {
+		migration := migrations[i]
+		if err := applyMigration(db, migration, migration.Down, false); err != nil {
+			return fmt.Errorf("rolling back migration %d_%s failed: %v", migration.Version, migration.Name, err)
+		}
+		log.Printf("Rolled back migration %d_%s\n", migration.Version, migration.Name)
+	}
+	return nil
+}
+
+// applyMigration runs one direction of a migration and records it in schema_version in the same transaction
+func applyMigration(db *sql.DB, migration Migration, script string, up bool) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(script); err != nil {
+		return err
+	}
+	if up {
+		_, err = tx.Exec("INSERT INTO schema_version (version, name, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Name, time.Now().Unix())
+	} else {
+		_, err = tx.Exec("DELETE FROM schema_version WHERE version = ?", migration.Version)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrationStatus lists every migration with the time it was applied
+func migrationStatus(db *sql.DB) ([]MigrationStatus, error) {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return nil, err
+	}
+	if err := ensureSchemaVersion(db, migrations); err != nil {
+		return nil, err
+	}
+
+	applied := map[int]int64{}
+	rows, err := db.Query("SELECT version, applied_at FROM schema_version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var version int
+		var appliedAt int64
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, migration := range migrations {
+		statuses = append(statuses, MigrationStatus{Version: migration.Version, Name: migration.Name, AppliedAt: applied[migration.Version]})
+	}
+	return statuses, nil
+}
+
+// runMigrateCommand implements `uol-gateway migrate [up [version] | down [version] | status]`.
+// up applies every pending migration, or those up to version; down rolls back the last migration, or those above version.
+func runMigrateCommand(db *sql.DB, args []string) error {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+	if len(args) > 2 || (command == "status" && len(args) > 1) {
+		return errors.New("usage: migrate [up [version] | down [version] | status]")
+	}
+	target := -1
+	if len(args) == 2 {
+		version, err := strconv.Atoi(args[1])
+		if err != nil || version < 0 {
+			return fmt.Errorf("invalid version: %s", args[1])
+		}
+		target = version
+	}
+
+	switch command {
+	case "up":
+		if target < 0 {
+			target = 0
+		}
+		return migrateUp(db, target)
+	case "down":
+		if target < 0 {
+			migrations, err := loadMigrations()
+			if err != nil {
+				return err
+			}
+			if err := ensureSchemaVersion(db, migrations); err != nil {
+				return err
+			}
+			current, err := currentSchemaVersion(db)
+			if err != nil {
+				return err
+			}
+			if current == 0 {
+				return errors.New("no migration to roll back")
+			}
+			target = current - 1
+		}
+		return migrateDown(db, target)
+	case "status":
+		statuses, err := migrationStatus(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED")
+		for _, status := range statuses {
+			applied := "pending"
+			if status.AppliedAt != 0 {
+				applied = formatTimestamp(status.AppliedAt)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\n", status.Version, status.Name, applied)
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown migrate command: %s", command)
+	}
+}
@@ -0,0 +1,22 @@
+DROP TABLE callbacks;
+DROP TABLE notifications;
+DROP TABLE notification_channels;
+DROP TABLE alerts;
+
+-- Expression rules cannot be expressed in the old schema and are dropped
+CREATE TABLE rules_old (
+    rule_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT,
+    parameter_name TEXT,
+    min_range REAL,
+    max_range REAL,
+    trigger TEXT CHECK (trigger IN ('inside_range_trigger', 'outside_range_trigger')),
+    callback TEXT
+);
+
+INSERT INTO rules_old (rule_id, client_id, parameter_name, min_range, max_range, trigger, callback)
+    SELECT rule_id, client_id, parameter_name, min_range, max_range, trigger, callback FROM rules
+    WHERE trigger != 'expression_trigger';
+
+DROP TABLE rules;
+ALTER TABLE rules_old RENAME TO rules;
@@ -0,0 +1,83 @@
+-- Rules gain expression triggers, enabling, notification and alert policies. SQLite cannot change the CHECK
+-- constraint of a column, so the table is rebuilt.
+CREATE TABLE rules_new (
+    rule_id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT,
+    parameter_name TEXT,
+    min_range REAL,
+    max_range REAL,
+    trigger TEXT CHECK (trigger IN ('inside_range_trigger', 'outside_range_trigger', 'expression_trigger')),
+    callback TEXT,
+    expression TEXT,
+    enabled INTEGER NOT NULL DEFAULT 1,
+    notify TEXT NOT NULL DEFAULT '[]',
+    cooldown_seconds INTEGER NOT NULL DEFAULT 0,
+    cooldown_scope TEXT NOT NULL DEFAULT 'device' CHECK (cooldown_scope IN ('device', 'rule')),
+    escalation TEXT NOT NULL DEFAULT '[]'
+);
+
+INSERT INTO rules_new (rule_id, client_id, parameter_name, min_range, max_range, trigger, callback)
+    SELECT rule_id, client_id, parameter_name, min_range, max_range, trigger, callback FROM rules;
+
+DROP TABLE rules;
+ALTER TABLE rules_new RENAME TO rules;
+
+CREATE TABLE alerts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    type TEXT,
+    client_id TEXT,
+    rule_id INTEGER REFERENCES rules(rule_id),
+    event_id INTEGER REFERENCES events(id),
+    message TEXT,
+    state TEXT CHECK (state IN ('open', 'acknowledged', 'resolved', 'expired')),
+    created_at INTEGER,
+    acknowledged_by TEXT,
+    acknowledged_at INTEGER,
+    resolved_by TEXT,
+    resolved_at INTEGER,
+    occurrences INTEGER NOT NULL DEFAULT 1,
+    last_seen_at INTEGER,
+    escalation_level INTEGER NOT NULL DEFAULT 0,
+    action_name TEXT,
+    action_status TEXT CHECK (action_status IN ('succeeded', 'failed')),
+    action_error TEXT,
+    action_at INTEGER
+);
+
+CREATE INDEX alerts_state ON alerts (state);
+CREATE INDEX alerts_rule_client ON alerts (rule_id, client_id);
+
+CREATE TABLE notification_channels (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    type TEXT CHECK (type IN ('smtp', 'webhook', 'sms')),
+    config TEXT NOT NULL DEFAULT '{}'
+);
+
+CREATE TABLE notifications (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    alert_id INTEGER REFERENCES alerts(id),
+    channel_id INTEGER REFERENCES notification_channels(id),
+    attempt INTEGER,
+    status TEXT CHECK (status IN ('sent', 'failed')),
+    error TEXT,
+    created_at INTEGER
+);
+
+CREATE INDEX notifications_alert_id ON notifications (alert_id);
+
+CREATE TABLE callbacks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    action_type TEXT CHECK (action_type IN ('mqtt_publish', 'http', 'notification')),
+    topic_template TEXT NOT NULL DEFAULT '',
+    payload_template TEXT NOT NULL DEFAULT '',
+    config TEXT NOT NULL DEFAULT '{}'
+);
+
+INSERT INTO callbacks (name, action_type, topic_template, payload_template) VALUES
+    ('fox_callback', 'mqtt_publish', 'uol/uol-cm3070-mod11/sub/{{.ClientID}}', '{"event": "fox_alert", "client_id": {{json .ClientID}}, "data": {}}'),
+    ('bear_callback', 'mqtt_publish', 'uol/uol-cm3070-mod11/sub/{{.ClientID}}', '{"event": "bear_alert", "client_id": {{json .ClientID}}, "data": {}}'),
+    ('wolf_callback', 'mqtt_publish', 'uol/uol-cm3070-mod11/sub/{{.ClientID}}', '{"event": "wolf_alert", "client_id": {{json .ClientID}}, "data": {}}'),
+    ('deer_callback', 'mqtt_publish', 'uol/uol-cm3070-mod11/sub/{{.ClientID}}', '{"event": "deer_alert", "client_id": {{json .ClientID}}, "data": {}}'),
+    ('crocodile_callback', 'mqtt_publish', 'uol/uol-cm3070-mod11/sub/{{.ClientID}}', '{"event": "crocodile_alert", "client_id": {{json .ClientID}}, "data": {}}');
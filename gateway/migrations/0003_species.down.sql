@@ -0,0 +1,3 @@
+ALTER TABLE events DROP COLUMN parent_event_id;
+DROP TABLE species_labels;
+DROP TABLE species;
@@ -0,0 +1,28 @@
+CREATE TABLE species (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name TEXT NOT NULL UNIQUE,
+    callback TEXT NOT NULL,
+    min_confidence REAL NOT NULL DEFAULT 50
+);
+
+CREATE TABLE species_labels (
+    label TEXT PRIMARY KEY,
+    species_id INTEGER NOT NULL REFERENCES species(id)
+);
+
+INSERT INTO species (id, name, callback) VALUES
+    (1, 'fox', 'fox_callback'),
+    (2, 'bear', 'bear_callback'),
+    (3, 'wolf', 'wolf_callback'),
+    (4, 'deer', 'deer_callback'),
+    (5, 'crocodile', 'crocodile_callback');
+
+INSERT INTO species_labels (label, species_id) VALUES
+    ('fox', 1), ('red_fox', 1), ('kit_fox', 1), ('grey_fox', 1), ('arctic_fox', 1),
+    ('bear', 2), ('brown_bear', 2), ('american_black_bear', 2), ('ice_bear', 2), ('sloth_bear', 2),
+    ('wolf', 3), ('timber_wolf', 3), ('white_wolf', 3), ('red_wolf', 3), ('coyote', 3),
+    ('deer', 4), ('impala', 4), ('hartebeest', 4),
+    ('crocodile', 5), ('african_crocodile', 5), ('american_alligator', 5);
+
+-- YOLO verdicts point at the intrusion event they judged
+ALTER TABLE events ADD COLUMN parent_event_id INTEGER REFERENCES events(id);
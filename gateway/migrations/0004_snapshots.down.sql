@@ -0,0 +1,3 @@
+ALTER TABLE alerts DROP COLUMN snapshot_hash;
+ALTER TABLE events DROP COLUMN snapshot_hash;
+DROP TABLE snapshots;
@@ -0,0 +1,12 @@
+CREATE TABLE snapshots (
+    hash TEXT PRIMARY KEY,
+    client_id TEXT,
+    size INTEGER,
+    width INTEGER,
+    height INTEGER,
+    created_at INTEGER,
+    last_used_at INTEGER
+);
+
+ALTER TABLE events ADD COLUMN snapshot_hash TEXT REFERENCES snapshots(hash);
+ALTER TABLE alerts ADD COLUMN snapshot_hash TEXT REFERENCES snapshots(hash);
@@ -0,0 +1,3 @@
+DROP TABLE device_health;
+DROP TABLE device_addresses;
+DROP TABLE devices;
@@ -0,0 +1,31 @@
+CREATE TABLE devices (
+    client_id TEXT PRIMARY KEY,
+    ip TEXT NOT NULL,
+    device_type TEXT NOT NULL,
+    firmware TEXT,
+    name TEXT NOT NULL DEFAULT '',
+    location TEXT NOT NULL DEFAULT '',
+    first_seen INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    health_state TEXT NOT NULL DEFAULT 'online' CHECK (health_state IN ('online', 'degraded', 'offline', 'decommissioned')),
+    consecutive_failures INTEGER NOT NULL DEFAULT 0
+);
+
+CREATE TABLE device_addresses (
+    client_id TEXT NOT NULL REFERENCES devices(client_id),
+    ip TEXT NOT NULL,
+    first_seen INTEGER NOT NULL,
+    last_seen INTEGER NOT NULL,
+    PRIMARY KEY (client_id, ip)
+);
+
+CREATE TABLE device_health (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT NOT NULL REFERENCES devices(client_id),
+    from_state TEXT,
+    to_state TEXT,
+    reason TEXT,
+    created_at INTEGER
+);
+
+CREATE INDEX device_health_client_id ON device_health (client_id);
@@ -0,0 +1,12 @@
+-- MQTT messages rejected by validation, kept with the reason so they can be inspected
+CREATE TABLE dead_letters (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    topic TEXT,
+    client_id TEXT,
+    reason TEXT NOT NULL,
+    error TEXT NOT NULL,
+    payload TEXT NOT NULL,
+    received_at INTEGER NOT NULL
+);
+
+CREATE INDEX dead_letters_received_at ON dead_letters (received_at);
@@ -0,0 +1,4 @@
+DROP INDEX events_received_at;
+DROP INDEX events_local_timestamp;
+DROP INDEX events_client_id;
+ALTER TABLE events DROP COLUMN received_at;
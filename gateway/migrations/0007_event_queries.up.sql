@@ -0,0 +1,6 @@
+-- When the gateway received an event, device clocks are not reliable. Events stored before this migration have none.
+ALTER TABLE events ADD COLUMN received_at INTEGER;
+
+CREATE INDEX events_client_id ON events (client_id, id);
+CREATE INDEX events_local_timestamp ON events (local_timestamp, id);
+CREATE INDEX events_received_at ON events (received_at, id);
@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP COLUMN longitude;
+ALTER TABLE devices DROP COLUMN latitude;
@@ -0,0 +1,3 @@
+-- Where a device is installed, used for the GeoJSON exports
+ALTER TABLE devices ADD COLUMN latitude REAL;
+ALTER TABLE devices ADD COLUMN longitude REAL;
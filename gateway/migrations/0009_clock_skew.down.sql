@@ -0,0 +1,5 @@
+ALTER TABLE devices DROP COLUMN clock_checked_at;
+ALTER TABLE devices DROP COLUMN clock_offset;
+DROP INDEX events_timestamp_flag;
+ALTER TABLE events DROP COLUMN timestamp_flag;
+ALTER TABLE events DROP COLUMN clock_offset;
@@ -0,0 +1,9 @@
+-- Clock offset of the device (local_timestamp - received_at, in seconds) when the event arrived and, for events whose
+-- local_timestamp cannot be trusted, why: unsynced (the device clock was never set) or skewed (beyond clock.max_skew)
+ALTER TABLE events ADD COLUMN clock_offset INTEGER;
+ALTER TABLE events ADD COLUMN timestamp_flag TEXT CHECK (timestamp_flag IN ('unsynced', 'skewed'));
+CREATE INDEX events_timestamp_flag ON events (timestamp_flag) WHERE timestamp_flag IS NOT NULL;
+
+-- Latest clock offset of each device
+ALTER TABLE devices ADD COLUMN clock_offset INTEGER;
+ALTER TABLE devices ADD COLUMN clock_checked_at INTEGER;
@@ -0,0 +1,2 @@
+DROP TABLE compactions;
+DROP TABLE telemetry_hourly;
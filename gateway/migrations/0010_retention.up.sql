@@ -0,0 +1,30 @@
+-- Hourly rollup of the raw telemetry deleted by the compaction, see compaction.go. Sums and counts are stored
+-- instead of averages so an hour compacted in several batches merges exactly.
+CREATE TABLE telemetry_hourly (
+    client_id TEXT NOT NULL,
+    hour INTEGER NOT NULL, -- start of the hour, Unix seconds
+    samples INTEGER NOT NULL,
+    loudness_samples INTEGER NOT NULL,
+    loudness_min REAL,
+    loudness_max REAL,
+    loudness_sum REAL NOT NULL,
+    movement_count INTEGER NOT NULL,
+    PRIMARY KEY (client_id, hour)
+);
+CREATE INDEX telemetry_hourly_hour ON telemetry_hourly (hour);
+
+-- Report of every compaction run
+CREATE TABLE compactions (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    started_at INTEGER NOT NULL,
+    finished_at INTEGER NOT NULL,
+    telemetry_rolled_up INTEGER NOT NULL,
+    hours_updated INTEGER NOT NULL,
+    intrusions_deleted INTEGER NOT NULL,
+    verdicts_deleted INTEGER NOT NULL,
+    aggregates_deleted INTEGER NOT NULL,
+    kept_past_retention INTEGER NOT NULL,
+    database_bytes INTEGER NOT NULL,
+    free_bytes INTEGER NOT NULL,
+    error TEXT
+);
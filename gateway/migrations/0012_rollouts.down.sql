@@ -0,0 +1,4 @@
+DROP TABLE rollout_devices;
+DROP TABLE rollouts;
+DROP INDEX devices_device_group;
+ALTER TABLE devices DROP COLUMN device_group;
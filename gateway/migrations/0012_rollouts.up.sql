@@ -0,0 +1,29 @@
+-- Devices are grouped for bulk settings rollouts, see rollouts.go
+ALTER TABLE devices ADD COLUMN device_group TEXT NOT NULL DEFAULT '';
+CREATE INDEX devices_device_group ON devices (device_group);
+
+-- A settings change pushed to a group of devices, or to all of them when device_group is NULL.
+-- settings holds the changed settings with the secrets redacted.
+CREATE TABLE rollouts (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    device_group TEXT,
+    settings TEXT NOT NULL,
+    canary INTEGER NOT NULL,
+    verify_after INTEGER NOT NULL,
+    state TEXT NOT NULL CHECK (state IN ('canary', 'rolling', 'completed', 'partial', 'aborted', 'interrupted')),
+    created_by TEXT NOT NULL,
+    created_at INTEGER NOT NULL,
+    finished_at INTEGER
+);
+
+-- The outcome of a rollout on each device, previous holds the replaced values with the secrets redacted
+CREATE TABLE rollout_devices (
+    rollout_id INTEGER NOT NULL REFERENCES rollouts(id),
+    client_id TEXT NOT NULL REFERENCES devices(client_id),
+    stage TEXT NOT NULL CHECK (stage IN ('canary', 'rest')),
+    state TEXT NOT NULL CHECK (state IN ('pending', 'applied', 'succeeded', 'failed', 'restored', 'restore_failed', 'skipped')),
+    previous TEXT,
+    error TEXT,
+    updated_at INTEGER NOT NULL,
+    PRIMARY KEY (rollout_id, client_id)
+);
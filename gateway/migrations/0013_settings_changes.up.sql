@@ -0,0 +1,14 @@
+-- Every settings change pushed to a device, see settings_history.go. previous and new are the complete settings as
+-- JSON with the secrets hashed, previous is NULL when the device could not be read before the change.
+CREATE TABLE settings_changes (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    client_id TEXT NOT NULL REFERENCES devices(client_id),
+    actor TEXT NOT NULL,
+    source TEXT NOT NULL CHECK (source IN ('manual', 'rollout', 'restore', 'revert')),
+    rollout_id INTEGER REFERENCES rollouts(id),
+    revert_of INTEGER REFERENCES settings_changes(id),
+    previous TEXT,
+    new TEXT NOT NULL,
+    created_at INTEGER NOT NULL
+);
+CREATE INDEX settings_changes_client_id ON settings_changes (client_id, id);
@@ -0,0 +1,35 @@
+-- Alerts still waiting for a queued callback lose their action status.
+CREATE TABLE alerts_new (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    type TEXT,
+    client_id TEXT,
+    rule_id INTEGER REFERENCES rules(rule_id),
+    event_id INTEGER REFERENCES events(id),
+    message TEXT,
+    state TEXT CHECK (state IN ('open', 'acknowledged', 'resolved', 'expired')),
+    created_at INTEGER,
+    acknowledged_by TEXT,
+    acknowledged_at INTEGER,
+    resolved_by TEXT,
+    resolved_at INTEGER,
+    occurrences INTEGER NOT NULL DEFAULT 1,
+    last_seen_at INTEGER,
+    escalation_level INTEGER NOT NULL DEFAULT 0,
+    action_name TEXT,
+    action_status TEXT CHECK (action_status IN ('succeeded', 'failed')),
+    action_error TEXT,
+    action_at INTEGER,
+    snapshot_hash TEXT REFERENCES snapshots(hash)
+);
+
+INSERT INTO alerts_new SELECT id, type, client_id, rule_id, event_id, message, state, created_at, acknowledged_by,
+    acknowledged_at, resolved_by, resolved_at, occurrences, last_seen_at, escalation_level,
+    CASE WHEN action_status = 'queued' THEN NULL ELSE action_name END,
+    CASE WHEN action_status = 'queued' THEN NULL ELSE action_status END,
+    action_error, action_at, snapshot_hash FROM alerts;
+
+DROP TABLE alerts;
+ALTER TABLE alerts_new RENAME TO alerts;
+
+CREATE INDEX alerts_state ON alerts (state);
+CREATE INDEX alerts_rule_client ON alerts (rule_id, client_id);
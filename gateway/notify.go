@@ -0,0 +1,669 @@
+// This file implements the notification channels rules can use to reach people instead of devices:
+// e-mail over SMTP, a generic HTTP webhook and an SMS gateway reachable over HTTP.
+// Channels are stored in the notification_channels table and referenced by name from the rule's "notify" list.
+// Every delivery attempt, successful or not, is recorded in the notifications table.
+// The passwords, tokens and credential headers of a channel are write-only in the API, like the secrets of a device:
+// reads return them blank and an update that leaves them blank keeps the stored value.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Notification channel types
+const (
+	channelSMTP    = "smtp"
+	channelWebhook = "webhook"
+	channelSMS     = "sms"
+)
+
+// Defaults for the retry policy of a channel, overridable with max_attempts and backoff_seconds in its config
+const (
+	defaultMaxAttempts    = 3
+	defaultBackoff        = 2 * time.Second
+	notificationTimeout   = 10 * time.Second
+	notificationSubject   = "Wild animal alert"
+	notificationUserAgent = "uol-gateway"
+)
+
+var (
+	// errChannelNotFound is returned when a channel ID does not exist
+	errChannelNotFound = errors.New("notification channel not found")
+	// errChannelInUse is returned when a channel that rules or callbacks refer to by name would be renamed or deleted
+	errChannelInUse = errors.New("notification channel is in use")
+	// errChannelExists is returned when a channel is saved with the name of another one
+	errChannelExists = errors.New("a notification channel with this name already exists")
+)
+
+// Notification is the message handed to a notifier
+type Notification struct {
+	AlertID  int64  `json:"alert_id"`
+	RuleID   int64  `json:"rule_id"`
+	ClientID string `json:"client_id"`
+	Subject  string `json:"subject"`
+	Message  string `json:"message"`
+}
+
+// Notifier delivers a notification over one channel. Implementations make a single attempt, retries are handled by deliverNotification.
+// A notifier with several recipients remembers who already got the notification, so a retry only reaches the others.
+type Notifier interface {
+	Notify(ctx context.Context, n Notification) error
+}
+
+// NotificationChannel struct to hold a row of the notification_channels table
+type NotificationChannel struct {
+	ID     int64           `json:"id"`
+	Name   string          `json:"name"`
+	Type   string          `json:"type"`
+	Config json.RawMessage `json:"config"`
+}
+
+// retryPolicy is the part of the channel config shared by all channel types
+type retryPolicy struct {
+	MaxAttempts    int     `json:"max_attempts"`
+	BackoffSeconds float64 `json:"backoff_seconds"`
+}
+
+// SMTPNotifier sends the notification as a plain text e-mail
+type SMTPNotifier struct {
+	Host     string   `json:"host"`
+	Port     int      `json:"port"`
+	Username string   `json:"username"`
+	Password string   `json:"password"`
+	From     string   `json:"from"`
+	To       []string `json:"to"`
+
+	delivered map[string]bool
+}
+
+// WebhookNotifier POSTs the notification as JSON to a URL
+type WebhookNotifier struct {
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+}
+
+// SMSNotifier sends the notification through an SMS gateway with an HTTP API.
+// Each recipient gets a form POST with "from", "to" and "message" fields and an optional bearer token.
+type SMSNotifier struct {
+	URL   string   `json:"url"`
+	Token string   `json:"token"`
+	From  string   `json:"from"`
+	To    []string `json:"to"`
+
+	delivered map[string]bool
+}
+
+// notificationClient sends the webhook and SMS requests
+var notificationClient = &http.Client{Timeout: notificationTimeout}
+
+// pendingRecipients returns the recipients that did not get the notification yet
+func pendingRecipients(to []string, delivered map[string]bool) []string {
+	pending := []string{}
+	for _, recipient := range to {
+		if !delivered[recipient] {
+			pending = append(pending, recipient)
+		}
+	}
+	return pending
+}
+
+// newNotifier builds the notifier described by a channel and validates its config
+func newNotifier(channel NotificationChannel) (Notifier, error) {
+	var config []byte = channel.Config
+	if len(config) == 0 {
+		config = []byte("{}")
+	}
+
+	switch channel.Type {
+	case channelSMTP:
+		n := &SMTPNotifier{Port: 25}
+		if err := json.Unmarshal(config, n); err != nil {
+			return nil, fmt.Errorf("invalid smtp config: %v", err)
+		}
+		if n.Host == "" || n.From == "" || len(n.To) == 0 {
+			return nil, fmt.Errorf("smtp channel needs host, from and to")
+		}
+		return n, nil
+	case channelWebhook:
+		n := &WebhookNotifier{}
+		if err := json.Unmarshal(config, n); err != nil {
+			return nil, fmt.Errorf("invalid webhook config: %v", err)
+		}
+		if err := validateHTTPURL(n.URL); err != nil {
+			return nil, err
+		}
+		return n, nil
+	case channelSMS:
+		n := &SMSNotifier{}
+		if err := json.Unmarshal(config, n); err != nil {
+			return nil, fmt.Errorf("invalid sms config: %v", err)
+		}
+		if err := validateHTTPURL(n.URL); err != nil {
+			return nil, err
+		}
+		if len(n.To) == 0 {
+			return nil, fmt.Errorf("sms channel needs at least one recipient in to")
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("invalid channel type: %s", channel.Type)
+}
+
+func validateHTTPURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid url: %q", rawURL)
+	}
+	return nil
+}
+
+// Notify sends one e-mail to all recipients that did not get it yet. When the server rejects some recipients the
+// e-mail is still sent to the others and the rejected ones are reported in the error.
+func (n *SMTPNotifier) Notify(ctx context.Context, notification Notification) error {
+	if n.delivered == nil {
+		n.delivered = make(map[string]bool)
+	}
+	pending := pendingRecipients(n.To, n.delivered)
+	if len(pending) == 0 {
+		return nil
+	}
+
+	addr := net.JoinHostPort(n.Host, strconv.Itoa(n.Port))
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, n.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err := client.StartTLS(&tls.Config{ServerName: n.Host}); err != nil {
+			return err
+		}
+	}
+	if n.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", n.Username, n.Password, n.Host)); err != nil {
+			return err
+		}
+	}
+
+	if err := client.Mail(n.From); err != nil {
+		return err
+	}
+	var accepted []string
+	var rejected []error
+	for _, to := range pending {
+		if err := client.Rcpt(to); err != nil {
+			rejected = append(rejected, fmt.Errorf("recipient %s: %v", to, err))
+			continue
+		}
+		accepted = append(accepted, to)
+	}
+	if len(accepted) == 0 {
+		return errors.Join(rejected...)
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\nTo: %s\r\nSubject: %s\r\nDate: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.From, strings.Join(n.To, ", "), notification.Subject, time.Now().Format(time.RFC1123Z), notification.Message)
+	if err := w.Close(); err != nil {
+		return err
+	}
+	// The server took the message, a failing QUIT does not make it undelivered
+	for _, to := range accepted {
+		n.delivered[to] = true
+	}
+	client.Quit()
+	return errors.Join(rejected...)
+}
+
+// Notify posts the notification as JSON
+func (n *WebhookNotifier) Notify(ctx context.Context, notification Notification) error {
+	body, err := json.Marshal(notification)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", notificationUserAgent)
+	for key, value := range n.Headers {
+		req.Header.Set(key, value)
+	}
+	return doNotificationRequest(req)
+}
+
+// Notify sends one SMS per recipient that did not get it yet. A failed recipient does not stop the others.
+func (n *SMSNotifier) Notify(ctx context.Context, notification Notification) error {
+	if n.delivered == nil {
+		n.delivered = make(map[string]bool)
+	}
+	var failed []error
+	for _, to := range pendingRecipients(n.To, n.delivered) {
+		form := url.Values{}
+		form.Set("from", n.From)
+		form.Set("to", to)
+		form.Set("message", notification.Subject+": "+notification.Message)
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("User-Agent", notificationUserAgent)
+		if n.Token != "" {
+			req.Header.Set("Authorization", "Bearer "+n.Token)
+		}
+		if err := doNotificationRequest(req); err != nil {
+			failed = append(failed, fmt.Errorf("sms to %s: %v", to, err))
+			continue
+		}
+		n.delivered[to] = true
+	}
+	return errors.Join(failed...)
+}
+
+// doNotificationRequest performs an outbound notification request and treats any non 2xx response as a failure
+func doNotificationRequest(req *http.Request) error {
+	resp, err := notificationClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	io.Copy(io.Discard, resp.Body)
+	return nil
+}
+
+// deliverNotification sends a notification over a channel, retrying with exponential backoff.
+// Every attempt is recorded in the notifications table.
+func deliverNotification(db *sql.DB, channel NotificationChannel, notification Notification) error {
+	notifier, err := newNotifier(channel)
+	if err != nil {
+		logNotificationAttempt(db, channel, notification, 1, err)
+		return err
+	}
+
+	policy := retryPolicy{MaxAttempts: defaultMaxAttempts, BackoffSeconds: defaultBackoff.Seconds()}
+	if len(channel.Config) > 0 {
+		json.Unmarshal(channel.Config, &policy)
+	}
+	if policy.MaxAttempts < 1 {
+		policy.MaxAttempts = 1
+	}
+	backoff := time.Duration(policy.BackoffSeconds * float64(time.Second))
+
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), notificationTimeout)
+		err = notifier.Notify(ctx, notification)
+		cancel()
+
+		logNotificationAttempt(db, channel, notification, attempt, err)
+		if err == nil || attempt >= policy.MaxAttempts {
+			return err
+		}
+
+		log.Printf("Notification over channel %s failed (attempt %d/%d): %v\n", channel.Name, attempt, policy.MaxAttempts, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func logNotificationAttempt(db *sql.DB, channel NotificationChannel, notification Notification, attempt int, err error) {
+	status, errMsg := "sent", ""
+	if err != nil {
+		status, errMsg = "failed", err.Error()
+	}
+
+	_, dbErr := db.Exec(
+		"INSERT INTO notifications (alert_id, channel_id, attempt, status, error, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		nullableID(notification.AlertID), channel.ID, attempt, status, errMsg, time.Now().Unix(),
+	)
+	if dbErr != nil {
+		log.Printf("Error logging notification attempt: %v\n", dbErr)
+	}
+}
+
+// notifyRule delivers an alert to every channel listed in the rule's notify list
+func notifyRule(db *sql.DB, rule Rule, alertID int64, clientID string, message string) {
+	notifyChannels(db, rule.Notify, Notification{
+		AlertID:  alertID,
+		RuleID:   int64(rule.RuleID),
+		ClientID: clientID,
+		Subject:  notificationSubject,
+		Message:  fmt.Sprintf("Device %s: %s", clientID, message),
+	})
+}
+
+// notifyChannels delivers a notification to the named channels in the background
+func notifyChannels(db *sql.DB, names []string, notification Notification) {
+	for _, name := range names {
+		channel, err := getChannelByName(db, name)
+		if err != nil {
+			log.Printf("Error loading notification channel %s: %v\n", name, err)
+			continue
+		}
+		go func() {
+			if err := deliverNotification(db, channel, notification); err != nil {
+				log.Printf("Notification over channel %s gave up: %v\n", channel.Name, err)
+			}
+		}()
+	}
+}
+
+// Channel storage
+
+const channelColumns = "id, name, type, config"
+
+func scanChannel(row scanner) (NotificationChannel, error) {
+	var channel NotificationChannel
+	var config string
+	if err := row.Scan(&channel.ID, &channel.Name, &channel.Type, &config); err != nil {
+		return channel, err
+	}
+	channel.Config = json.RawMessage(config)
+	return channel, nil
+}
+
+func loadChannels(db *sql.DB) ([]NotificationChannel, error) {
+	rows, err := db.Query("SELECT " + channelColumns + " FROM notification_channels ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	channels := []NotificationChannel{}
+	for rows.Next() {
+		channel, err := scanChannel(rows)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, channel)
+	}
+	return channels, rows.Err()
+}
+
+func getChannel(db *sql.DB, id int64) (NotificationChannel, error) {
+	channel, err := scanChannel(db.QueryRow("SELECT "+channelColumns+" FROM notification_channels WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return channel, errChannelNotFound
+	}
+	return channel, err
+}
+
+func getChannelByName(db *sql.DB, name string) (NotificationChannel, error) {
+	channel, err := scanChannel(db.QueryRow("SELECT "+channelColumns+" FROM notification_channels WHERE name = ?", name))
+	if errors.Is(err, sql.ErrNoRows) {
+		return channel, errChannelNotFound
+	}
+	return channel, err
+}
+
+// isSecretHeader reports whether a webhook header carries a credential
+func isSecretHeader(name string) bool {
+	return strings.EqualFold(name, "Authorization") || isSecretSetting(name) || strings.HasSuffix(strings.ToLower(name), "key")
+}
+
+// Redacted returns the channel with the secrets of its config blanked, like the settings of a device. Each secret
+// gets a <name>_set field, the webhook headers carrying credentials are blanked too.
+func (c NotificationChannel) Redacted() NotificationChannel {
+	var config map[string]interface{}
+	if err := json.Unmarshal(c.Config, &config); err != nil {
+		c.Config = json.RawMessage("{}")
+		return c
+	}
+	redacted := redactSettings(config)
+	if headers, ok := config["headers"].(map[string]interface{}); ok {
+		blanked := make(map[string]interface{}, len(headers))
+		for name, value := range headers {
+			if isSecretHeader(name) {
+				value = ""
+			}
+			blanked[name] = value
+		}
+		redacted["headers"] = blanked
+	}
+	if data, err := json.Marshal(redacted); err == nil {
+		c.Config = data
+	}
+	return c
+}
+
+// keepChannelSecrets fills the secrets and credential headers left blank in the config of a channel coming from the
+// API with the values stored in current, and drops the <name>_set fields added by Redacted. current is nil for a new
+// channel.
+func keepChannelSecrets(channel NotificationChannel, current *NotificationChannel) (NotificationChannel, error) {
+	if len(channel.Config) == 0 {
+		return channel, nil
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(channel.Config, &config); err != nil {
+		return channel, fmt.Errorf("invalid config: %v", err)
+	}
+	stored := map[string]interface{}{}
+	if current != nil && current.Type == channel.Type {
+		json.Unmarshal(current.Config, &stored)
+	}
+
+	for name := range config {
+		if base, ok := strings.CutSuffix(name, "_set"); ok && isSecretSetting(base) {
+			delete(config, name)
+		}
+	}
+	for name, value := range stored {
+		if isSecretSetting(name) && (config[name] == nil || config[name] == "") {
+			config[name] = value
+		}
+	}
+	headers, _ := config["headers"].(map[string]interface{})
+	storedHeaders, _ := stored["headers"].(map[string]interface{})
+	for name, value := range headers {
+		if value == "" && isSecretHeader(name) && storedHeaders[name] != nil {
+			headers[name] = storedHeaders[name]
+		}
+	}
+
+	data, err := json.Marshal(config)
+	if err != nil {
+		return channel, err
+	}
+	channel.Config = data
+	return channel, nil
+}
+
+// validateChannel checks a channel coming from the API
+func validateChannel(channel NotificationChannel) error {
+	if channel.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	_, err := newNotifier(channel)
+	return err
+}
+
+func insertChannel(db *sql.DB, channel NotificationChannel) (int64, error) {
+	result, err := db.Exec("INSERT INTO notification_channels (name, type, config) VALUES (?, ?, ?)", channel.Name, channel.Type, string(channel.Config))
+	if isUniqueViolation(err) {
+		return 0, errChannelExists
+	} else if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// channelReferences returns the rules and callbacks that refer to a channel by name, in their notify list, an
+// escalation tier or the notify list of a notification callback, as "rule <id>" and "callback <name>"
+func channelReferences(tx *sql.Tx, name string) ([]string, error) {
+	rows, err := tx.Query(
+		`SELECT 'rule ' || r.rule_id FROM rules r, json_each(r.notify) n WHERE n.value = ?
+		UNION SELECT 'rule ' || r.rule_id FROM rules r, json_each(r.escalation) e, json_each(e.value, '$.notify') n WHERE n.value = ?
+		UNION SELECT 'callback ' || c.name FROM callbacks c, json_each(c.config, '$.notify') n WHERE n.value = ?
+		ORDER BY 1`,
+		name, name, name,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var references []string
+	for rows.Next() {
+		var reference string
+		if err := rows.Scan(&reference); err != nil {
+			return nil, err
+		}
+		references = append(references, reference)
+	}
+	return references, rows.Err()
+}
+
+// channelName returns the name of the channel with the given ID
+func channelName(tx *sql.Tx, id int64) (string, error) {
+	var name string
+	err := tx.QueryRow("SELECT name FROM notification_channels WHERE id = ?", id).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return name, errChannelNotFound
+	}
+	return name, err
+}
+
+// checkChannelUnused returns errChannelInUse when rules or callbacks refer to the channel by name
+func checkChannelUnused(tx *sql.Tx, name string) error {
+	references, err := channelReferences(tx, name)
+	if err != nil {
+		return err
+	}
+	if len(references) > 0 {
+		return fmt.Errorf("%w: %s is used by %s", errChannelInUse, name, strings.Join(references, ", "))
+	}
+	return nil
+}
+
+// updateChannel saves a channel. A rename is refused while rules or callbacks refer to the old name.
+func updateChannel(db *sql.DB, channel NotificationChannel) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name, err := channelName(tx, channel.ID)
+	if err != nil {
+		return err
+	}
+	if name != channel.Name {
+		if err := checkChannelUnused(tx, name); err != nil {
+			return err
+		}
+	}
+
+	result, err := tx.Exec("UPDATE notification_channels SET name = ?, type = ?, config = ? WHERE id = ?", channel.Name, channel.Type, string(channel.Config), channel.ID)
+	if isUniqueViolation(err) {
+		return errChannelExists
+	}
+	if err := expectOneRow(result, err, errChannelNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// deleteChannel deletes a channel, refused while rules or callbacks refer to it
+func deleteChannel(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	name, err := channelName(tx, id)
+	if err != nil {
+		return err
+	}
+	if err := checkChannelUnused(tx, name); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM notification_channels WHERE id = ?", id)
+	if err := expectOneRow(result, err, errChannelNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// NotificationAttempt struct to hold a row of the notifications table
+type NotificationAttempt struct {
+	ID        int64  `json:"id"`
+	AlertID   *int64 `json:"alert_id"`
+	ChannelID int64  `json:"channel_id"`
+	Attempt   int    `json:"attempt"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+	Timestamp string `json:"timestamp"`
+}
+
+// listNotificationAttempts returns the latest delivery attempts, optionally only those for one alert
+func listNotificationAttempts(db *sql.DB, alertID int64, limit int) ([]NotificationAttempt, error) {
+	query := "SELECT id, alert_id, channel_id, attempt, status, error, created_at FROM notifications"
+	var args []interface{}
+	if alertID != 0 {
+		query += " WHERE alert_id = ?"
+		args = append(args, alertID)
+	}
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit)
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []NotificationAttempt{}
+	for rows.Next() {
+		var attempt NotificationAttempt
+		var alert sql.NullInt64
+		var createdAt int64
+		if err := rows.Scan(&attempt.ID, &alert, &attempt.ChannelID, &attempt.Attempt, &attempt.Status, &attempt.Error, &createdAt); err != nil {
+			return nil, err
+		}
+		if alert.Valid {
+			attempt.AlertID = &alert.Int64
+		}
+		attempt.Timestamp = formatTimestamp(createdAt)
+		attempts = append(attempts, attempt)
+	}
+	return attempts, rows.Err()
+}
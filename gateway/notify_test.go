@@ -0,0 +1,433 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testChannel stores a channel so the attempts can reference it
+func testChannel(t *testing.T, db *sql.DB, channelType string, config map[string]interface{}) NotificationChannel {
+	t.Helper()
+	data, err := json.Marshal(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	channel := NotificationChannel{Name: "test-" + channelType, Type: channelType, Config: data}
+	if channel.ID, err = insertChannel(db, channel); err != nil {
+		t.Fatal(err)
+	}
+	return channel
+}
+
+// attemptStatuses returns the status of every recorded attempt of a channel, in order, and checks their numbering
+func attemptStatuses(t *testing.T, db *sql.DB, channelID int64) []string {
+	t.Helper()
+	attempts, err := listNotificationAttempts(db, 0, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statuses := []string{}
+	for i := len(attempts) - 1; i >= 0; i-- {
+		if attempts[i].ChannelID != channelID {
+			continue
+		}
+		if attempts[i].Attempt != len(statuses)+1 {
+			t.Errorf("attempt %d is numbered %d", len(statuses)+1, attempts[i].Attempt)
+		}
+		if (attempts[i].Status == "failed") != (attempts[i].Error != "") {
+			t.Errorf("attempt %d has status %s and error %q", attempts[i].Attempt, attempts[i].Status, attempts[i].Error)
+		}
+		statuses = append(statuses, attempts[i].Status)
+	}
+	return statuses
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	var mu sync.Mutex
+	var received []Notification
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("X-Api-Key") != "secret" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected headers: %v", req.Header)
+		}
+		var n Notification
+		if err := json.NewDecoder(req.Body).Decode(&n); err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		received = append(received, n)
+		if len(received) < 3 {
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	channel := testChannel(t, db, channelWebhook, map[string]interface{}{
+		"url":             server.URL,
+		"headers":         map[string]string{"X-Api-Key": "secret"},
+		"max_attempts":    3,
+		"backoff_seconds": 0.05,
+	})
+	notification := Notification{ClientID: "cam-1", Subject: notificationSubject, Message: "bear"}
+
+	start := time.Now()
+	if err := deliverNotification(db, channel, notification); err != nil {
+		t.Fatalf("deliverNotification: %v", err)
+	}
+	// Backoff of 0.05s doubled once
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Errorf("three attempts took %v, the backoff was not applied", elapsed)
+	}
+	if len(received) != 3 || received[2] != notification {
+		t.Errorf("received %+v", received)
+	}
+	if got := attemptStatuses(t, db, channel.ID); strings.Join(got, ",") != "failed,failed,sent" {
+		t.Errorf("attempts = %v", got)
+	}
+}
+
+func TestWebhookNotifierGivesUp(t *testing.T) {
+	quietLog(t)
+
+	tests := []struct {
+		status int
+		body   string
+	}{
+		{http.StatusBadRequest, "bad payload"},
+		{http.StatusInternalServerError, "crashed"},
+		{http.StatusMultipleChoices, "choose"},
+	}
+	for _, test := range tests {
+		db := newTestDB(t)
+		requests := 0
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+			requests++
+			http.Error(w, test.body, test.status)
+		}))
+
+		channel := testChannel(t, db, channelWebhook, map[string]interface{}{"url": server.URL, "max_attempts": 2, "backoff_seconds": 0.01})
+		err := deliverNotification(db, channel, Notification{Message: "bear"})
+		server.Close()
+
+		if err == nil || !strings.Contains(err.Error(), test.body) || !strings.Contains(err.Error(), fmt.Sprint(test.status)) {
+			t.Errorf("status %d: error = %v", test.status, err)
+		}
+		if requests != 2 {
+			t.Errorf("status %d: %d requests, want 2", test.status, requests)
+		}
+		if got := attemptStatuses(t, db, channel.ID); strings.Join(got, ",") != "failed,failed" {
+			t.Errorf("status %d: attempts = %v", test.status, got)
+		}
+	}
+}
+
+func TestSMSNotifierRetriesOnlyFailedRecipients(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	var mu sync.Mutex
+	sent := make(map[string]int)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Authorization") != "Bearer token" {
+			t.Errorf("Authorization = %q", req.Header.Get("Authorization"))
+		}
+		to := req.FormValue("to")
+		if req.FormValue("from") != "gateway" || req.FormValue("message") != notificationSubject+": bear" {
+			t.Errorf("unexpected form: %v", req.Form)
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		sent[to]++
+		if to == "+2" && sent[to] == 1 {
+			http.Error(w, "gateway overloaded", http.StatusBadGateway)
+		}
+	}))
+	defer server.Close()
+
+	channel := testChannel(t, db, channelSMS, map[string]interface{}{
+		"url":             server.URL,
+		"token":           "token",
+		"from":            "gateway",
+		"to":              []string{"+1", "+2", "+3"},
+		"backoff_seconds": 0.01,
+	})
+	if err := deliverNotification(db, channel, Notification{Subject: notificationSubject, Message: "bear"}); err != nil {
+		t.Fatalf("deliverNotification: %v", err)
+	}
+
+	want := map[string]int{"+1": 1, "+2": 2, "+3": 1}
+	for to, count := range want {
+		if sent[to] != count {
+			t.Errorf("%s got %d messages, want %d", to, sent[to], count)
+		}
+	}
+	if got := attemptStatuses(t, db, channel.ID); strings.Join(got, ",") != "failed,sent" {
+		t.Errorf("attempts = %v", got)
+	}
+}
+
+// fakeSMTPServer accepts mail without STARTTLS or auth, rejecting a recipient a number of times
+type fakeSMTPServer struct {
+	listener net.Listener
+
+	mu       sync.Mutex
+	rejects  map[string]int
+	messages [][]string // the recipients of every accepted message
+}
+
+func newFakeSMTPServer(t *testing.T, rejects map[string]int) *fakeSMTPServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSMTPServer{listener: listener, rejects: rejects}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn)
+		}
+	}()
+	return server
+}
+
+func (s *fakeSMTPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	reply := func(line string) { fmt.Fprintf(conn, "%s\r\n", line) }
+
+	reply("220 localhost ESMTP")
+	var recipients []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command := strings.ToUpper(strings.Fields(line + " x")[0])
+		switch command {
+		case "EHLO", "HELO":
+			reply("250 localhost")
+		case "MAIL":
+			recipients = nil
+			reply("250 OK")
+		case "RCPT":
+			to := strings.Trim(strings.TrimSpace(line[strings.Index(line, ":")+1:]), "<>")
+			s.mu.Lock()
+			rejected := s.rejects[to] > 0
+			if rejected {
+				s.rejects[to]--
+			}
+			s.mu.Unlock()
+			if rejected {
+				reply("550 mailbox unavailable")
+				continue
+			}
+			recipients = append(recipients, to)
+			reply("250 OK")
+		case "DATA":
+			reply("354 go ahead")
+			for {
+				line, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				if line == ".\r\n" {
+					break
+				}
+			}
+			s.mu.Lock()
+			s.messages = append(s.messages, recipients)
+			s.mu.Unlock()
+			reply("250 queued")
+		case "QUIT":
+			reply("221 bye")
+			return
+		default:
+			reply("250 OK")
+		}
+	}
+}
+
+func TestSMTPNotifierRetriesOnlyRejectedRecipients(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	server := newFakeSMTPServer(t, map[string]int{"b@example.com": 1})
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	var portNumber int
+	fmt.Sscan(port, &portNumber)
+
+	channel := testChannel(t, db, channelSMTP, map[string]interface{}{
+		"host":            host,
+		"port":            portNumber,
+		"from":            "gateway@example.com",
+		"to":              []string{"a@example.com", "b@example.com", "c@example.com"},
+		"backoff_seconds": 0.01,
+	})
+	if err := deliverNotification(db, channel, Notification{Subject: notificationSubject, Message: "bear"}); err != nil {
+		t.Fatalf("deliverNotification: %v", err)
+	}
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 2 ||
+		strings.Join(server.messages[0], ",") != "a@example.com,c@example.com" ||
+		strings.Join(server.messages[1], ",") != "b@example.com" {
+		t.Errorf("messages = %v", server.messages)
+	}
+	if got := attemptStatuses(t, db, channel.ID); strings.Join(got, ",") != "failed,sent" {
+		t.Errorf("attempts = %v", got)
+	}
+}
+
+func TestSMTPNotifierAllRecipientsRejected(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	server := newFakeSMTPServer(t, map[string]int{"a@example.com": 5})
+	host, port, _ := net.SplitHostPort(server.listener.Addr().String())
+	var portNumber int
+	fmt.Sscan(port, &portNumber)
+
+	channel := testChannel(t, db, channelSMTP, map[string]interface{}{
+		"host": host, "port": portNumber, "from": "gateway@example.com", "to": []string{"a@example.com"},
+		"max_attempts": 2, "backoff_seconds": 0.01,
+	})
+	err := deliverNotification(db, channel, Notification{Message: "bear"})
+	if err == nil || !strings.Contains(err.Error(), "a@example.com") {
+		t.Errorf("error = %v", err)
+	}
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	if len(server.messages) != 0 {
+		t.Errorf("messages = %v", server.messages)
+	}
+	if got := attemptStatuses(t, db, channel.ID); strings.Join(got, ",") != "failed,failed" {
+		t.Errorf("attempts = %v", got)
+	}
+}
+
+func TestChannelSecretsRoundTrip(t *testing.T) {
+	stored := NotificationChannel{ID: 1, Name: "ops", Type: channelWebhook, Config: json.RawMessage(
+		`{"url":"https://example.com/hook","token":"t0ken","headers":{"Authorization":"Bearer abc","X-Api-Key":"k3y","X-Team":"rangers"}}`,
+	)}
+
+	redacted := stored.Redacted()
+	for _, secret := range []string{"t0ken", "Bearer abc", "k3y"} {
+		if strings.Contains(string(redacted.Config), secret) {
+			t.Errorf("redacted config %s contains %q", redacted.Config, secret)
+		}
+	}
+	if !strings.Contains(string(redacted.Config), `"token_set":true`) || !strings.Contains(string(redacted.Config), "rangers") {
+		t.Errorf("redacted config = %s", redacted.Config)
+	}
+
+	// Sending the redacted channel back with a new URL keeps every secret
+	redacted.Config = json.RawMessage(strings.Replace(string(redacted.Config), "example.com", "example.org", 1))
+	updated, err := keepChannelSecrets(redacted, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var config map[string]interface{}
+	if err := json.Unmarshal(updated.Config, &config); err != nil {
+		t.Fatal(err)
+	}
+	headers, _ := config["headers"].(map[string]interface{})
+	if config["url"] != "https://example.org/hook" || config["token"] != "t0ken" || config["token_set"] != nil ||
+		headers["Authorization"] != "Bearer abc" || headers["X-Api-Key"] != "k3y" || headers["X-Team"] != "rangers" {
+		t.Errorf("updated config = %s", updated.Config)
+	}
+
+	// A new secret replaces the stored one
+	changed := NotificationChannel{Type: channelWebhook, Config: json.RawMessage(`{"url":"https://example.com/hook","token":"n3w"}`)}
+	if changed, err = keepChannelSecrets(changed, &stored); err != nil || !strings.Contains(string(changed.Config), "n3w") {
+		t.Errorf("changed config = %s, %v", changed.Config, err)
+	}
+}
+
+func TestChannelReferences(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	channel := testChannel(t, db, channelWebhook, map[string]interface{}{"url": "https://example.com/hook"})
+
+	statements := []string{
+		`INSERT INTO rules (rule_id, client_id, trigger, callback, expression, notify) VALUES (101, '*', 'expression_trigger', 'fox_callback', 'true', '["test-webhook"]')`,
+		`INSERT INTO rules (rule_id, client_id, trigger, callback, expression, escalation) VALUES (102, '*', 'expression_trigger', 'fox_callback', 'true', '[{"after_minutes": 5, "notify": ["other", "test-webhook"]}]')`,
+		`INSERT INTO callbacks (name, action_type, topic_template, payload_template, config) VALUES ('page_rangers', 'notification', '', 'bear', '{"notify": ["test-webhook"]}')`,
+	}
+	for _, statement := range statements {
+		if _, err := db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err := deleteChannel(db, channel.ID)
+	if !errors.Is(err, errChannelInUse) || !strings.Contains(err.Error(), "callback page_rangers, rule 101, rule 102") {
+		t.Errorf("deleting a referenced channel: %v", err)
+	}
+	renamed := channel
+	renamed.Name = "renamed"
+	if err := updateChannel(db, renamed); !errors.Is(err, errChannelInUse) {
+		t.Errorf("renaming a referenced channel: %v", err)
+	}
+	// Changing the config keeps the name and is allowed
+	channel.Config = json.RawMessage(`{"url": "https://example.org/hook"}`)
+	if err := updateChannel(db, channel); err != nil {
+		t.Errorf("updating a referenced channel: %v", err)
+	}
+
+	if _, err := db.Exec("DELETE FROM rules WHERE rule_id IN (101, 102)"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("DELETE FROM callbacks WHERE name = 'page_rangers'"); err != nil {
+		t.Fatal(err)
+	}
+	if err := updateChannel(db, renamed); err != nil {
+		t.Errorf("renaming an unused channel: %v", err)
+	}
+	if err := deleteChannel(db, channel.ID); err != nil {
+		t.Errorf("deleting an unused channel: %v", err)
+	}
+	if err := deleteChannel(db, channel.ID); !errors.Is(err, errChannelNotFound) {
+		t.Errorf("deleting a deleted channel: %v", err)
+	}
+}
+
+func TestChannelNameUnique(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	channel := testChannel(t, db, channelWebhook, map[string]interface{}{"url": "https://example.com/hook"})
+
+	duplicate := channel
+	if _, err := insertChannel(db, duplicate); !errors.Is(err, errChannelExists) {
+		t.Errorf("adding a channel with a taken name: %v", err)
+	}
+	duplicate.Name = "other"
+	id, err := insertChannel(db, duplicate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	duplicate.ID = id
+	duplicate.Name = channel.Name
+	if err := updateChannel(db, duplicate); !errors.Is(err, errChannelExists) {
+		t.Errorf("renaming a channel to a taken name: %v", err)
+	}
+}
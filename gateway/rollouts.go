@@ -0,0 +1,472 @@
+// This file implements bulk settings rollouts. A rollout pushes the same settings change to every device of a group,
+// or to all devices, in two stages:
+//
+//	canary: the first devices get the change, the rest wait until the canaries passed verification
+//	rest:   the remaining devices get the change once every canary succeeded
+//
+// A stage pushes the change to each device, waits verify_after for the devices to apply it and restart, then probes
+// /healthz of each device. A device that does not answer gets its previous settings pushed back, and so does a device
+// that rejects the change, as it may have applied part of it. A failed canary aborts the rollout before the rest is
+// touched.
+//
+// The previous settings, secrets included, are only kept in memory while the rollout runs: the tables hold them with
+// the secrets redacted, and a rollout cut short by a restart is marked interrupted. Only one rollout runs at a time.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// Rollout states
+const (
+	rolloutCanary      = "canary"
+	rolloutRolling     = "rolling"
+	rolloutCompleted   = "completed"
+	rolloutPartial     = "partial"
+	rolloutAborted     = "aborted"
+	rolloutInterrupted = "interrupted"
+)
+
+// Rollout stages and the states of a device in a rollout
+const (
+	stageCanary = "canary"
+	stageRest   = "rest"
+
+	rolloutDevicePending       = "pending"
+	rolloutDeviceApplied       = "applied"
+	rolloutDeviceSucceeded     = "succeeded"
+	rolloutDeviceFailed        = "failed"
+	rolloutDeviceRestored      = "restored"
+	rolloutDeviceRestoreFailed = "restore_failed"
+	rolloutDeviceSkipped       = "skipped"
+)
+
+// Defaults of a rollout request and the probes verifying a device
+const (
+	defaultRolloutCanary      = 1
+	defaultRolloutVerifyAfter = 2 * time.Minute
+	maxRolloutVerifyAfter     = time.Hour
+	rolloutProbes             = 3
+	rolloutProbeInterval      = 10 * time.Second
+)
+
+var (
+	errRolloutNotFound = errors.New("rollout not found")
+	errRolloutRunning  = errors.New("another rollout is running")
+)
+
+// rolloutMu is held while a rollout runs
+var rolloutMu sync.Mutex
+
+// RolloutRequest starts a rollout. An empty group targets all devices, Settings holds only the settings to change.
+type RolloutRequest struct {
+	Group       string                 `json:"group"`
+	Settings    map[string]interface{} `json:"settings"`
+	Canary      int                    `json:"canary"`
+	VerifyAfter string                 `json:"verify_after"`
+}
+
+// Rollout is a row of the rollouts table, Settings has the secrets redacted
+type Rollout struct {
+	ID          int64                  `json:"id"`
+	Group       string                 `json:"group"`
+	Settings    map[string]interface{} `json:"settings"`
+	Canary      int                    `json:"canary"`
+	VerifyAfter string                 `json:"verify_after"`
+	State       string                 `json:"state"`
+	CreatedBy   string                 `json:"created_by"`
+	CreatedAt   string                 `json:"created_at"`
+	FinishedAt  string                 `json:"finished_at,omitempty"`
+	Devices     []RolloutDevice        `json:"devices,omitempty"`
+}
+
+// RolloutDevice is the outcome of a rollout on one device, Previous holds the replaced values with the secrets redacted
+type RolloutDevice struct {
+	ClientID  string                 `json:"client_id"`
+	Stage     string                 `json:"stage"`
+	State     string                 `json:"state"`
+	Previous  map[string]interface{} `json:"previous,omitempty"`
+	Error     string                 `json:"error,omitempty"`
+	UpdatedAt string                 `json:"updated_at"`
+}
+
+// validateRolloutSettings checks that the changed settings are settings of a device, of the right type
+func validateRolloutSettings(settings map[string]interface{}) error {
+	if len(settings) == 0 {
+		return fmt.Errorf("no settings to change")
+	}
+	if _, ok := settings["device_id"]; ok {
+		return fmt.Errorf("device_id cannot be changed by a rollout")
+	}
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var parsed DeviceSettings
+	if err := decoder.Decode(&parsed); err != nil {
+		return fmt.Errorf("invalid settings: %v", err)
+	}
+	return nil
+}
+
+// startRollout records a rollout and runs it in the background, returning it with its devices pending.
+// Decommissioned devices are left out, offline ones are skipped.
+func startRollout(db *sql.DB, request RolloutRequest, actor string) (Rollout, error) {
+	if err := validateRolloutSettings(request.Settings); err != nil {
+		return Rollout{}, err
+	}
+	if request.Canary == 0 {
+		request.Canary = defaultRolloutCanary
+	}
+	if request.Canary < 0 {
+		return Rollout{}, fmt.Errorf("canary must be at least 1")
+	}
+	verifyAfter := defaultRolloutVerifyAfter
+	if request.VerifyAfter != "" {
+		var err error
+		if verifyAfter, err = time.ParseDuration(request.VerifyAfter); err != nil {
+			return Rollout{}, fmt.Errorf("invalid verify_after: %v", err)
+		}
+		if verifyAfter < 0 || verifyAfter > maxRolloutVerifyAfter {
+			return Rollout{}, fmt.Errorf("verify_after must be between 0 and %s", maxRolloutVerifyAfter)
+		}
+	}
+
+	devices, err := loadDevices(db)
+	if err != nil {
+		return Rollout{}, err
+	}
+	var canary, rest, offline []Device
+	for _, device := range devices {
+		switch {
+		case request.Group != "" && device.Group != request.Group, device.HealthState == healthDecommissioned:
+			// not targeted
+		case device.HealthState == healthOffline:
+			offline = append(offline, device)
+		case len(canary) < request.Canary:
+			canary = append(canary, device)
+		default:
+			rest = append(rest, device)
+		}
+	}
+	if len(canary) == 0 && request.Group != "" {
+		return Rollout{}, fmt.Errorf("no device of group %q is online", request.Group)
+	} else if len(canary) == 0 {
+		return Rollout{}, fmt.Errorf("no device is online")
+	}
+
+	if !rolloutMu.TryLock() {
+		return Rollout{}, errRolloutRunning
+	}
+	id, err := insertRollout(db, request, verifyAfter, actor, canary, rest, offline)
+	if err != nil {
+		rolloutMu.Unlock()
+		return Rollout{}, err
+	}
+	log.Printf("Rollout %d by %s started on %d devices\n", id, actor, len(canary)+len(rest))
+
+	go func() {
+		defer rolloutMu.Unlock()
+		runRollout(db, id, actor, request.Settings, verifyAfter, canary, rest, len(offline) > 0)
+	}()
+	return getRollout(db, id)
+}
+
+func insertRollout(db *sql.DB, request RolloutRequest, verifyAfter time.Duration, actor string, canary []Device, rest []Device, offline []Device) (int64, error) {
+	settings, err := json.Marshal(redactSettings(request.Settings))
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now().Unix()
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"INSERT INTO rollouts (device_group, settings, canary, verify_after, state, created_by, created_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		nullableString(request.Group), string(settings), request.Canary, int64(verifyAfter/time.Second), rolloutCanary, actor, now,
+	)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+
+	insert := func(devices []Device, stage string, state string, reason string) error {
+		for _, device := range devices {
+			_, err := tx.Exec(
+				"INSERT INTO rollout_devices (rollout_id, client_id, stage, state, error, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
+				id, device.ID, stage, state, nullableString(reason), now,
+			)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := insert(canary, stageCanary, rolloutDevicePending, ""); err != nil {
+		return 0, err
+	}
+	if err := insert(rest, stageRest, rolloutDevicePending, ""); err != nil {
+		return 0, err
+	}
+	if err := insert(offline, stageRest, rolloutDeviceSkipped, "device is offline"); err != nil {
+		return 0, err
+	}
+	return id, tx.Commit()
+}
+
+// runRollout runs the canary stage and, if every canary succeeded, the rest
+func runRollout(db *sql.DB, id int64, actor string, changes map[string]interface{}, verifyAfter time.Duration, canary []Device, rest []Device, skipped bool) {
+	state := rolloutCompleted
+	if !runRolloutStage(db, id, actor, changes, verifyAfter, canary) {
+		state = rolloutAborted
+		for _, device := range rest {
+			setRolloutDevice(db, id, device.ID, rolloutDeviceSkipped, nil, "a canary failed")
+		}
+	} else {
+		if err := setRolloutState(db, id, rolloutRolling, false); err != nil {
+			log.Printf("Error updating rollout %d: %v\n", id, err)
+		}
+		if !runRolloutStage(db, id, actor, changes, verifyAfter, rest) || skipped {
+			state = rolloutPartial
+		}
+	}
+
+	if err := setRolloutState(db, id, state, true); err != nil {
+		log.Printf("Error updating rollout %d: %v\n", id, err)
+	}
+	log.Printf("Rollout %d %s\n", id, state)
+}
+
+// runRolloutStage pushes the change to the devices of a stage and verifies them, restoring the previous settings of
+// the devices that stopped answering. It reports whether every device succeeded.
+func runRolloutStage(db *sql.DB, id int64, actor string, changes map[string]interface{}, verifyAfter time.Duration, devices []Device) bool {
+	// A rollout outlives the request that started it
+	ctx := context.Background()
+	succeeded := true
+	pushed := make(map[string]rolloutPush, len(devices))
+	for _, device := range devices {
+		var push rolloutPush
+		current, err := fetchDeviceSettings(ctx, deviceIP(device))
+		if err == nil {
+			push.previous, err = mergeSettings(device.ID, current, nil)
+		}
+		if err == nil {
+			push.next, err = mergeSettings(device.ID, current, changes)
+		}
+		if err == nil {
+			_, err = applyDeviceSettings(ctx, db, deviceIP(device), &push.previous, push.next, settingsOrigin{Actor: actor, Source: settingsRollout, RolloutID: id})
+		}
+		if errors.Is(err, errSettingsRejected) {
+			succeeded = false
+			log.Printf("Device %s rejected rollout %d, restoring its settings: %v\n", device.ID, id, err)
+			if _, restoreErr := pushDeviceSettings(ctx, deviceIP(device), push.previous); restoreErr != nil {
+				log.Printf("Error restoring the settings of %s: %v\n", device.ID, restoreErr)
+				setRolloutDevice(db, id, device.ID, rolloutDeviceRestoreFailed, nil, fmt.Sprintf("%v; restoring failed: %v", err, restoreErr))
+				continue
+			}
+			setRolloutDevice(db, id, device.ID, rolloutDeviceRestored, nil, err.Error())
+			continue
+		} else if err != nil {
+			log.Printf("Error pushing rollout %d to %s: %v\n", id, device.ID, err)
+			setRolloutDevice(db, id, device.ID, rolloutDeviceFailed, nil, err.Error())
+			succeeded = false
+			continue
+		}
+
+		pushed[device.ID] = push
+		replaced := make(map[string]interface{}, len(changes))
+		for name := range changes {
+			replaced[name] = current[name]
+		}
+		setRolloutDevice(db, id, device.ID, rolloutDeviceApplied, redactSettings(replaced), "")
+	}
+	if len(pushed) == 0 {
+		return succeeded
+	}
+
+	time.Sleep(verifyAfter)
+	for _, device := range devices {
+		push, applied := pushed[device.ID]
+		if !applied {
+			continue
+		}
+		checkErr := verifyDevice(ctx, device)
+		if checkErr == nil {
+			setRolloutDevice(db, id, device.ID, rolloutDeviceSucceeded, nil, "")
+			continue
+		}
+
+		succeeded = false
+		log.Printf("Device %s failed its health check after rollout %d, restoring its settings: %v\n", device.ID, id, checkErr)
+		restore := settingsOrigin{Actor: healthActor, Source: settingsRestore, RolloutID: id}
+		if _, err := applyDeviceSettings(ctx, db, deviceIP(device), &push.next, push.previous, restore); err != nil {
+			log.Printf("Error restoring the settings of %s: %v\n", device.ID, err)
+			setRolloutDevice(db, id, device.ID, rolloutDeviceRestoreFailed, nil, fmt.Sprintf("health check failed: %v; restoring failed: %v", checkErr, err))
+			continue
+		}
+		setRolloutDevice(db, id, device.ID, rolloutDeviceRestored, nil, fmt.Sprintf("health check failed: %v", checkErr))
+	}
+	return succeeded
+}
+
+// rolloutPush holds the settings a device had before a rollout and the ones it got
+type rolloutPush struct {
+	previous DeviceSettings
+	next     DeviceSettings
+}
+
+// deviceIP returns the address a device last registered with, it may change when its WiFi settings do
+func deviceIP(device Device) string {
+	if client, ok := gatewayState.Client(device.ID); ok {
+		return client.IP
+	}
+	return device.IP
+}
+
+// verifyDevice probes /healthz of a device up to rolloutProbes times
+func verifyDevice(ctx context.Context, device Device) error {
+	var err error
+	for probe := 1; probe <= rolloutProbes; probe++ {
+		if err = probeDevice(ctx, deviceIP(device)); err == nil {
+			return nil
+		}
+		if probe < rolloutProbes {
+			time.Sleep(rolloutProbeInterval)
+		}
+	}
+	return err
+}
+
+// setRolloutDevice records the state of a device in a rollout, a nil previous keeps the recorded one
+func setRolloutDevice(db *sql.DB, id int64, clientID string, state string, previous map[string]interface{}, reason string) {
+	var previousJSON interface{}
+	if previous != nil {
+		data, err := json.Marshal(previous)
+		if err != nil {
+			log.Printf("Error encoding the previous settings of %s: %v\n", clientID, err)
+		}
+		previousJSON = string(data)
+	}
+	_, err := db.Exec(
+		"UPDATE rollout_devices SET state = ?, previous = COALESCE(?, previous), error = ?, updated_at = ? WHERE rollout_id = ? AND client_id = ?",
+		state, previousJSON, nullableString(reason), time.Now().Unix(), id, clientID,
+	)
+	if err != nil {
+		log.Printf("Error updating rollout %d of %s: %v\n", id, clientID, err)
+	}
+}
+
+func setRolloutState(db *sql.DB, id int64, state string, finished bool) error {
+	var finishedAt interface{}
+	if finished {
+		finishedAt = time.Now().Unix()
+	}
+	_, err := db.Exec("UPDATE rollouts SET state = ?, finished_at = ? WHERE id = ?", state, finishedAt, id)
+	return err
+}
+
+// interruptRollouts marks the rollouts a restart cut short, their devices keep the state they reached
+func interruptRollouts(db *sql.DB) error {
+	_, err := db.Exec(
+		"UPDATE rollouts SET state = ?, finished_at = ? WHERE state IN (?, ?)",
+		rolloutInterrupted, time.Now().Unix(), rolloutCanary, rolloutRolling,
+	)
+	return err
+}
+
+const rolloutColumns = "id, device_group, settings, canary, verify_after, state, created_by, created_at, finished_at"
+
+func scanRollout(row scanner) (Rollout, error) {
+	var rollout Rollout
+	var group sql.NullString
+	var settings string
+	var verifyAfter, createdAt int64
+	var finishedAt sql.NullInt64
+	if err := row.Scan(&rollout.ID, &group, &settings, &rollout.Canary, &verifyAfter, &rollout.State, &rollout.CreatedBy, &createdAt, &finishedAt); err != nil {
+		return rollout, err
+	}
+	if err := json.Unmarshal([]byte(settings), &rollout.Settings); err != nil {
+		return rollout, err
+	}
+	rollout.Group = group.String
+	rollout.VerifyAfter = (time.Duration(verifyAfter) * time.Second).String()
+	rollout.CreatedAt = formatTimestamp(createdAt)
+	if finishedAt.Valid {
+		rollout.FinishedAt = formatTimestamp(finishedAt.Int64)
+	}
+	return rollout, nil
+}
+
+// listRollouts returns the latest rollouts without their devices, newest first
+func listRollouts(db *sql.DB, limit int) ([]Rollout, error) {
+	rows, err := db.Query("SELECT "+rolloutColumns+" FROM rollouts ORDER BY id DESC LIMIT ?", limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	rollouts := []Rollout{}
+	for rows.Next() {
+		rollout, err := scanRollout(rows)
+		if err != nil {
+			return nil, err
+		}
+		rollouts = append(rollouts, rollout)
+	}
+	return rollouts, rows.Err()
+}
+
+// getRollout returns a rollout with the state of each of its devices, canaries first
+func getRollout(db *sql.DB, id int64) (Rollout, error) {
+	rollout, err := scanRollout(db.QueryRow("SELECT "+rolloutColumns+" FROM rollouts WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return rollout, errRolloutNotFound
+	} else if err != nil {
+		return rollout, err
+	}
+
+	rows, err := db.Query(
+		"SELECT client_id, stage, state, previous, error, updated_at FROM rollout_devices WHERE rollout_id = ? ORDER BY stage = ? DESC, client_id",
+		id, stageCanary,
+	)
+	if err != nil {
+		return rollout, err
+	}
+	defer rows.Close()
+
+	rollout.Devices = []RolloutDevice{}
+	for rows.Next() {
+		var device RolloutDevice
+		var previous, reason sql.NullString
+		var updatedAt int64
+		if err := rows.Scan(&device.ClientID, &device.Stage, &device.State, &previous, &reason, &updatedAt); err != nil {
+			return rollout, err
+		}
+		if previous.Valid {
+			if err := json.Unmarshal([]byte(previous.String), &device.Previous); err != nil {
+				return rollout, err
+			}
+		}
+		device.Error = reason.String
+		device.UpdatedAt = formatTimestamp(updatedAt)
+		rollout.Devices = append(rollout.Devices, device)
+	}
+	return rollout, rows.Err()
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeDevice serves /get-settings, /update-settings and /healthz like a device, answering 500 to the updates that
+// reject returns true for. It returns the address of the device and the settings of every update it received.
+func fakeDevice(t *testing.T, reject func(settings map[string]interface{}) bool) (string, func() []map[string]interface{}) {
+	t.Helper()
+	var mu sync.Mutex
+	current := map[string]interface{}{"ssid": "camp", "password": "wifi secret", "noise_threshold": 40.0, "telemetry_interval": 60.0}
+	var updates []map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		switch req.URL.Path {
+		case "/get-settings":
+			json.NewEncoder(w).Encode(current)
+		case "/update-settings":
+			var settings map[string]interface{}
+			if err := json.Unmarshal([]byte(req.FormValue("settings")), &settings); err != nil {
+				t.Error(err)
+			}
+			updates = append(updates, settings)
+			if reject(settings) {
+				http.Error(w, "flash write failed", http.StatusInternalServerError)
+				return
+			}
+			current = settings
+			w.Write([]byte(`{"status": "ok"}`))
+		case "/healthz":
+			w.WriteHeader(http.StatusOK)
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://"), func() []map[string]interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]map[string]interface{}(nil), updates...)
+	}
+}
+
+func TestRolloutRejectedByCanary(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	// The canary refuses the new threshold but takes its previous settings back
+	canaryIP, canaryUpdates := fakeDevice(t, func(settings map[string]interface{}) bool {
+		return settings["noise_threshold"] == 55.0
+	})
+	restIP, restUpdates := fakeDevice(t, func(map[string]interface{}) bool { return false })
+	canary := []Device{{ID: "00:00:00:00:00:01", IP: canaryIP}}
+	rest := []Device{{ID: "00:00:00:00:00:02", IP: restIP}}
+
+	request := RolloutRequest{Settings: map[string]interface{}{"noise_threshold": 55}, Canary: 1}
+	id, err := insertRollout(db, request, 0, "alice", canary, rest, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	runRollout(db, id, "alice", request.Settings, 0, canary, rest, false)
+
+	rollout, err := getRollout(db, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rollout.State != rolloutAborted {
+		t.Errorf("rollout state = %s, want %s", rollout.State, rolloutAborted)
+	}
+	states := map[string]RolloutDevice{}
+	for _, device := range rollout.Devices {
+		states[device.ClientID] = device
+	}
+	if device := states[canary[0].ID]; device.State != rolloutDeviceRestored || !strings.Contains(device.Error, "500") {
+		t.Errorf("canary = %+v, want restored after a 500", device)
+	}
+	if device := states[rest[0].ID]; device.State != rolloutDeviceSkipped {
+		t.Errorf("rest = %+v, want skipped", device)
+	}
+
+	// The canary got the change and then its previous settings, secrets included, the rest nothing
+	updates := canaryUpdates()
+	if len(updates) != 2 || updates[1]["noise_threshold"] != 40.0 || updates[1]["password"] != "wifi secret" {
+		t.Errorf("canary updates = %v", updates)
+	}
+	if updates := restUpdates(); len(updates) != 0 {
+		t.Errorf("rest updates = %v", updates)
+	}
+
+	// A rejected push is not recorded as a settings change
+	var changes int
+	if err := db.QueryRow("SELECT COUNT(*) FROM settings_changes WHERE rollout_id = ?", id).Scan(&changes); err != nil {
+		t.Fatal(err)
+	}
+	if changes != 0 {
+		t.Errorf("%d settings changes recorded for the rollout, want 0", changes)
+	}
+}
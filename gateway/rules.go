@@ -0,0 +1,202 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Rule triggers supported by matchRuleAndExecuteCallback
+const (
+	insideRangeTrigger  = "inside_range_trigger"
+	outsideRangeTrigger = "outside_range_trigger"
+	expressionTrigger   = "expression_trigger"
+)
+
+// ruleColumns is the column list matching scanRule
+const ruleColumns = "rule_id, client_id, parameter_name, min_range, max_range, trigger, callback, expression, enabled, notify, cooldown_seconds, cooldown_scope, escalation"
+
+// errRuleNotFound is returned when a rule ID does not exist
+var errRuleNotFound = errors.New("rule not found")
+
+// scanner is implemented by both *sql.Row and *sql.Rows
+type scanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanRule reads a rule selected with ruleColumns. Expression rules leave the range columns NULL.
+func scanRule(row scanner) (Rule, error) {
+	var rule Rule
+	var parameterName, expression, notify, escalation sql.NullString
+	var minRange, maxRange sql.NullFloat64
+	if err := row.Scan(&rule.RuleID, &rule.ClientID, &parameterName, &minRange, &maxRange, &rule.Trigger, &rule.Callback, &expression, &rule.Enabled, &notify, &rule.CooldownSeconds, &rule.CooldownScope, &escalation); err != nil {
+		return rule, err
+	}
+	rule.Escalation = []EscalationTier{}
+	if escalation.Valid && escalation.String != "" {
+		if err := json.Unmarshal([]byte(escalation.String), &rule.Escalation); err != nil {
+			return rule, fmt.Errorf("rule %d has an invalid escalation policy: %v", rule.RuleID, err)
+		}
+	}
+	rule.Notify = []string{}
+	if notify.Valid && notify.String != "" {
+		if err := json.Unmarshal([]byte(notify.String), &rule.Notify); err != nil {
+			return rule, fmt.Errorf("rule %d has an invalid notify list: %v", rule.RuleID, err)
+		}
+	}
+	rule.ParameterName = parameterName.String
+	rule.MinRange = minRange.Float64
+	rule.MaxRange = maxRange.Float64
+	rule.Expression = expression.String
+	return rule, nil
+}
+
+// loadRules returns all rules stored in the database
+func loadRules(db *sql.DB) ([]Rule, error) {
+	rows, err := db.Query("SELECT " + ruleColumns + " FROM rules")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rules []Rule
+	for rows.Next() {
+		rule, err := scanRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, rows.Err()
+}
+
+// getRule returns a single rule by ID
+func getRule(db *sql.DB, ruleID int64) (Rule, error) {
+	rule, err := scanRule(db.QueryRow("SELECT "+ruleColumns+" FROM rules WHERE rule_id = ?", ruleID))
+	if errors.Is(err, sql.ErrNoRows) {
+		return rule, errRuleNotFound
+	}
+	return rule, err
+}
+
+// ruleValues returns the values stored for a rule, range columns are NULL for expression rules and the expression is NULL for range rules
+func ruleValues(rule Rule) []interface{} {
+	notify, _ := json.Marshal(rule.Notify)
+	if rule.Notify == nil {
+		notify = []byte("[]")
+	}
+	escalation, _ := json.Marshal(rule.Escalation)
+	if rule.Escalation == nil {
+		escalation = []byte("[]")
+	}
+	if rule.CooldownScope == "" {
+		rule.CooldownScope = cooldownPerDevice
+	}
+	if rule.Trigger == expressionTrigger {
+		return []interface{}{rule.ClientID, nil, nil, nil, rule.Trigger, rule.Callback, rule.Expression, rule.Enabled, string(notify), rule.CooldownSeconds, rule.CooldownScope, string(escalation)}
+	}
+	return []interface{}{rule.ClientID, rule.ParameterName, rule.MinRange, rule.MaxRange, rule.Trigger, rule.Callback, nil, rule.Enabled, string(notify), rule.CooldownSeconds, rule.CooldownScope, string(escalation)}
+}
+
+// insertRule stores a new rule and returns its ID. The rule must have been validated with validateRuleForSave.
+func insertRule(db *sql.DB, rule Rule) (int64, error) {
+	result, err := db.Exec(
+		"INSERT INTO rules (client_id, parameter_name, min_range, max_range, trigger, callback, expression, enabled, notify, cooldown_seconds, cooldown_scope, escalation) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		ruleValues(rule)...,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// updateRule replaces all fields of an existing rule. The rule must have been validated with validateRuleForSave.
+func updateRule(db *sql.DB, rule Rule) error {
+	result, err := db.Exec(
+		"UPDATE rules SET client_id = ?, parameter_name = ?, min_range = ?, max_range = ?, trigger = ?, callback = ?, expression = ?, enabled = ?, notify = ?, cooldown_seconds = ?, cooldown_scope = ?, escalation = ? WHERE rule_id = ?",
+		append(ruleValues(rule), rule.RuleID)...,
+	)
+	return expectOneRow(result, err, errRuleNotFound)
+}
+
+func deleteRule(db *sql.DB, ruleID int64) error {
+	result, err := db.Exec("DELETE FROM rules WHERE rule_id = ?", ruleID)
+	return expectOneRow(result, err, errRuleNotFound)
+}
+
+func setRuleEnabled(db *sql.DB, ruleID int64, enabled bool) error {
+	result, err := db.Exec("UPDATE rules SET enabled = ? WHERE rule_id = ?", enabled, ruleID)
+	return expectOneRow(result, err, errRuleNotFound)
+}
+
+// expectOneRow turns an UPDATE or DELETE that touched no rows into notFound
+func expectOneRow(result sql.Result, err error, notFound error) error {
+	if err != nil {
+		return err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return notFound
+	}
+	return nil
+}
+
+// isUniqueViolation reports whether an INSERT or UPDATE failed on a UNIQUE constraint
+func isUniqueViolation(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+// validateRule checks that a rule is well formed before it is saved or matched
+func validateRule(rule Rule) error {
+	switch rule.Trigger {
+	case insideRangeTrigger, outsideRangeTrigger:
+		if rule.ParameterName == "" {
+			return fmt.Errorf("parameter_name is required for %s", rule.Trigger)
+		}
+		if rule.MinRange > rule.MaxRange {
+			return fmt.Errorf("min_range (%v) must not be greater than max_range (%v)", rule.MinRange, rule.MaxRange)
+		}
+	case expressionTrigger:
+		if _, err := parseExpression(rule.Expression); err != nil {
+			return fmt.Errorf("invalid expression: %v", err)
+		}
+	default:
+		return fmt.Errorf("invalid trigger: %s", rule.Trigger)
+	}
+	return nil
+}
+
+// validateRuleForSave checks a rule coming from the API, on top of validateRule the callback
+// must be built in or registered in the callbacks table, client_id must be "*" or a known device, every notify entry must name a channel
+// and the cooldown and escalation settings must be valid
+func validateRuleForSave(db *sql.DB, rule Rule) error {
+	if err := validateRule(rule); err != nil {
+		return err
+	}
+	if err := validateAlertPolicy(db, rule); err != nil {
+		return err
+	}
+	if ok, err := callbackExists(db, rule.Callback); err != nil {
+		return err
+	} else if !ok {
+		return fmt.Errorf("unknown callback: %s", rule.Callback)
+	}
+	if rule.ClientID != "*" {
+		if _, ok := gatewayState.Client(rule.ClientID); !ok {
+			return fmt.Errorf("unknown client_id: %s", rule.ClientID)
+		}
+	}
+	for _, name := range rule.Notify {
+		if _, err := getChannelByName(db, name); errors.Is(err, errChannelNotFound) {
+			return fmt.Errorf("unknown notification channel: %s", name)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
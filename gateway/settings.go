@@ -0,0 +1,154 @@
+// This file implements the proxy to the settings of a device, which the device serves at /get-settings and accepts
+// at /update-settings. The WiFi and MQTT passwords are write-only: reads return them blank, with <name>_set telling
+// whether the device has one, and a secret left blank in an update keeps the value the device has. Secrets are never
+// written to the logs.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// errSettingsRejected is returned when a device answers /update-settings with an error status
+var errSettingsRejected = errors.New("device rejected the settings")
+
+// DeviceSettings are the settings accepted by /update-settings
+type DeviceSettings struct {
+	DeviceID          string `json:"device_id"`
+	SSID              string `json:"ssid"`
+	Password          string `json:"password"`
+	Gateway           string `json:"gateway"`
+	NoiseThreshold    int    `json:"noise_threshold"`
+	TelemetryInterval int    `json:"telemetry_interval"`
+	MQTTBroker        string `json:"mqtt_broker"`
+	MQTTTopic         string `json:"mqtt_topic"`
+	MQTTTopicSub      string `json:"mqtt_topic_sub"`
+	MQTTUsername      string `json:"mqtt_username"`
+	MQTTPassword      string `json:"mqtt_password"`
+	MQTTPort          int    `json:"mqtt_port"`
+}
+
+// redactedValue replaces a secret that is set in the logs
+const redactedValue = "[redacted]"
+
+// isSecretSetting reports whether a setting is write-only. Besides password and mqtt_password this covers any
+// password, secret or token a newer firmware may add.
+func isSecretSetting(name string) bool {
+	name = strings.ToLower(name)
+	return strings.HasSuffix(name, "password") || strings.Contains(name, "secret") || strings.Contains(name, "token")
+}
+
+// redactSettings blanks the secrets of a settings object and adds <name>_set for each of them
+func redactSettings(settings map[string]interface{}) map[string]interface{} {
+	redacted := make(map[string]interface{}, len(settings))
+	for name, value := range settings {
+		if !isSecretSetting(name) {
+			redacted[name] = value
+			continue
+		}
+		redacted[name] = ""
+		redacted[name+"_set"] = value != nil && value != ""
+	}
+	return redacted
+}
+
+// redactSettingsJSON redacts a JSON settings object, anything else is returned as it is
+func redactSettingsJSON(data []byte) []byte {
+	var settings map[string]interface{}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return data
+	}
+	redacted, err := json.Marshal(redactSettings(settings))
+	if err != nil {
+		return data
+	}
+	return redacted
+}
+
+// Redacted returns a copy of the settings fit for the logs
+func (s DeviceSettings) Redacted() DeviceSettings {
+	for _, secret := range []*string{&s.Password, &s.MQTTPassword} {
+		if *secret != "" {
+			*secret = redactedValue
+		}
+	}
+	return s
+}
+
+// keepSecrets fills the secrets left blank with the values of the current settings of the device
+func (s *DeviceSettings) keepSecrets(current map[string]interface{}) {
+	if s.Password == "" {
+		s.Password, _ = current["password"].(string)
+	}
+	if s.MQTTPassword == "" {
+		s.MQTTPassword, _ = current["mqtt_password"].(string)
+	}
+}
+
+// mergeSettings applies the changes to the current settings of a device
+func mergeSettings(clientID string, current map[string]interface{}, changes map[string]interface{}) (DeviceSettings, error) {
+	merged := make(map[string]interface{}, len(current)+len(changes))
+	for name, value := range current {
+		merged[name] = value
+	}
+	for name, value := range changes {
+		merged[name] = value
+	}
+
+	var settings DeviceSettings
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return settings, err
+	}
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return settings, fmt.Errorf("invalid settings from device: %v", err)
+	}
+	settings.DeviceID = clientID
+	return settings, nil
+}
+
+// fetchDeviceSettings reads the settings of the device at ip, secrets included
+func fetchDeviceSettings(ctx context.Context, ip string) (map[string]interface{}, error) {
+	var settings map[string]interface{}
+	err := deviceRequest(ctx, ip, "/get-settings", nil, func(resp *http.Response) error {
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("device answered %s", resp.Status)
+		}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, maxDeviceResponse)).Decode(&settings); err != nil {
+			return fmt.Errorf("invalid settings from device: %v", err)
+		}
+		return nil
+	})
+	return settings, err
+}
+
+// pushDeviceSettings sends the settings to the device at ip and returns its response with any secrets redacted
+func pushDeviceSettings(ctx context.Context, ip string, settings DeviceSettings) ([]byte, error) {
+	settingsPayload, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+
+	// The device expects the JSON in the settings field of a URL encoded form
+	data := url.Values{}
+	data.Set("settings", string(settingsPayload))
+	var body []byte
+	err = deviceRequest(ctx, ip, "/update-settings", data, func(resp *http.Response) error {
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			return fmt.Errorf("%w: device answered %s", errSettingsRejected, resp.Status)
+		}
+		body, err = io.ReadAll(io.LimitReader(resp.Body, maxDeviceResponse))
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return redactSettingsJSON(body), nil
+}
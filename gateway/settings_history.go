@@ -0,0 +1,254 @@
+// This file implements the history of the device settings. Every push to /update-settings, from the settings page,
+// a rollout or a revert, is stored in settings_changes with who made it and the complete settings before and after.
+// The secrets are stored as hashes, salted with the client ID: enough to tell whether a password changed, never the
+// password itself. That is also why a revert restores every setting but the passwords, which keep their current value.
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"time"
+)
+
+// Sources of a settings change
+const (
+	settingsManual  = "manual"
+	settingsRollout = "rollout"
+	settingsRestore = "restore"
+	settingsRevert  = "revert"
+)
+
+var (
+	errSettingsChangeNotFound = errors.New("settings change not found")
+	errPreviousUnknown        = errors.New("the settings before this change are unknown")
+)
+
+// settingsOrigin tells who made a settings change and why, RolloutID and RevertOf are 0 when they do not apply
+type settingsOrigin struct {
+	Actor     string
+	Source    string
+	RolloutID int64
+	RevertOf  int64
+}
+
+// SettingsChange is a row of the settings_changes table. Previous and New are complete settings with the secrets
+// hashed, Previous is nil when the device could not be read before the change. Changed lists the settings that differ.
+type SettingsChange struct {
+	ID        int64                  `json:"id"`
+	ClientID  string                 `json:"client_id"`
+	Actor     string                 `json:"actor"`
+	Source    string                 `json:"source"`
+	RolloutID *int64                 `json:"rollout_id,omitempty"`
+	RevertOf  *int64                 `json:"revert_of,omitempty"`
+	Previous  map[string]interface{} `json:"previous"`
+	New       map[string]interface{} `json:"new"`
+	Changed   []string               `json:"changed"`
+	Timestamp string                 `json:"timestamp"`
+}
+
+// hashSecret returns the hash of a secret setting of a device, empty secrets stay empty
+func hashSecret(clientID string, value string) string {
+	if value == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(clientID + "\x00" + value))
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// settingsSnapshot returns the settings as stored in the history, with the secrets hashed
+func settingsSnapshot(settings DeviceSettings) (map[string]interface{}, error) {
+	data, err := json.Marshal(settings)
+	if err != nil {
+		return nil, err
+	}
+	var snapshot map[string]interface{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, err
+	}
+	for name, value := range snapshot {
+		if secret, ok := value.(string); ok && isSecretSetting(name) {
+			snapshot[name] = hashSecret(settings.DeviceID, secret)
+		}
+	}
+	return snapshot, nil
+}
+
+// applyDeviceSettings pushes the settings to the device at ip and records the change, previous is nil when the
+// settings of the device are unknown. Only a change the device accepted is recorded. A change that cannot be
+// recorded is logged, the push still counts.
+func applyDeviceSettings(ctx context.Context, db *sql.DB, ip string, previous *DeviceSettings, settings DeviceSettings, origin settingsOrigin) ([]byte, error) {
+	response, err := pushDeviceSettings(ctx, ip, settings)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := recordSettingsChange(db, previous, settings, origin); err != nil {
+		log.Printf("Error recording the settings change of %s: %v\n", settings.DeviceID, err)
+	}
+	return response, nil
+}
+
+func recordSettingsChange(db *sql.DB, previous *DeviceSettings, settings DeviceSettings, origin settingsOrigin) (int64, error) {
+	next, err := settingsSnapshot(settings)
+	if err != nil {
+		return 0, err
+	}
+	newJSON, err := json.Marshal(next)
+	if err != nil {
+		return 0, err
+	}
+	var previousJSON interface{}
+	if previous != nil {
+		snapshot, err := settingsSnapshot(*previous)
+		if err != nil {
+			return 0, err
+		}
+		data, err := json.Marshal(snapshot)
+		if err != nil {
+			return 0, err
+		}
+		previousJSON = string(data)
+	}
+
+	result, err := db.Exec(
+		"INSERT INTO settings_changes (client_id, actor, source, rollout_id, revert_of, previous, new, created_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		settings.DeviceID, origin.Actor, origin.Source, nullableID(origin.RolloutID), nullableID(origin.RevertOf), previousJSON, string(newJSON), time.Now().Unix(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// revertSettingsChange pushes the settings a device had before a change back to it, keeping its current passwords
+func revertSettingsChange(ctx context.Context, db *sql.DB, changeID int64, actor string) (SettingsChange, error) {
+	change, err := getSettingsChange(db, changeID)
+	if err != nil {
+		return change, err
+	}
+	if change.Previous == nil {
+		return change, errPreviousUnknown
+	}
+	client, ok := gatewayState.Client(change.ClientID)
+	if !ok {
+		return change, errDeviceNotFound
+	}
+
+	current, err := fetchDeviceSettings(ctx, client.IP)
+	if err != nil {
+		return change, fmt.Errorf("error fetching the current settings: %v", err)
+	}
+	restored := make(map[string]interface{}, len(change.Previous))
+	for name, value := range change.Previous {
+		if !isSecretSetting(name) {
+			restored[name] = value
+		}
+	}
+	previous, err := mergeSettings(change.ClientID, current, nil)
+	if err != nil {
+		return change, err
+	}
+	settings, err := mergeSettings(change.ClientID, current, restored)
+	if err != nil {
+		return change, err
+	}
+
+	if _, err := pushDeviceSettings(ctx, client.IP, settings); err != nil {
+		return change, fmt.Errorf("error updating device settings: %w", err)
+	}
+	log.Printf("%s reverted settings change %d of %s\n", actor, changeID, change.ClientID)
+	revertID, err := recordSettingsChange(db, &previous, settings, settingsOrigin{Actor: actor, Source: settingsRevert, RevertOf: changeID})
+	if err != nil {
+		return change, err
+	}
+	return getSettingsChange(db, revertID)
+}
+
+// changedSettings returns the names of the settings that differ between two snapshots, sorted
+func changedSettings(previous map[string]interface{}, next map[string]interface{}) []string {
+	changed := []string{}
+	if previous == nil {
+		return changed
+	}
+	for name, value := range next {
+		if !reflect.DeepEqual(previous[name], value) {
+			changed = append(changed, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := next[name]; !ok {
+			changed = append(changed, name)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+const settingsChangeColumns = "id, client_id, actor, source, rollout_id, revert_of, previous, new, created_at"
+
+func scanSettingsChange(row scanner) (SettingsChange, error) {
+	var change SettingsChange
+	var rolloutID, revertOf sql.NullInt64
+	var previous sql.NullString
+	var next string
+	var createdAt int64
+	if err := row.Scan(&change.ID, &change.ClientID, &change.Actor, &change.Source, &rolloutID, &revertOf, &previous, &next, &createdAt); err != nil {
+		return change, err
+	}
+	if previous.Valid {
+		if err := json.Unmarshal([]byte(previous.String), &change.Previous); err != nil {
+			return change, err
+		}
+	}
+	if err := json.Unmarshal([]byte(next), &change.New); err != nil {
+		return change, err
+	}
+	if rolloutID.Valid {
+		change.RolloutID = &rolloutID.Int64
+	}
+	if revertOf.Valid {
+		change.RevertOf = &revertOf.Int64
+	}
+	change.Changed = changedSettings(change.Previous, change.New)
+	change.Timestamp = formatTimestamp(createdAt)
+	return change, nil
+}
+
+func getSettingsChange(db *sql.DB, id int64) (SettingsChange, error) {
+	change, err := scanSettingsChange(db.QueryRow("SELECT "+settingsChangeColumns+" FROM settings_changes WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return change, errSettingsChangeNotFound
+	}
+	return change, err
+}
+
+// listSettingsChanges returns the latest settings changes of a device, or of all devices for an empty clientID,
+// newest first
+func listSettingsChanges(db *sql.DB, clientID string, limit int) ([]SettingsChange, error) {
+	rows, err := db.Query(
+		"SELECT "+settingsChangeColumns+" FROM settings_changes WHERE ? = '' OR client_id = ? ORDER BY id DESC LIMIT ?",
+		clientID, clientID, limit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []SettingsChange{}
+	for rows.Next() {
+		change, err := scanSettingsChange(rows)
+		if err != nil {
+			return nil, err
+		}
+		changes = append(changes, change)
+	}
+	return changes, rows.Err()
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+)
+
+func TestRejectedSettingsAreNotRecorded(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+	ctx := context.Background()
+
+	var rejecting atomic.Bool
+	ip, _ := fakeDevice(t, func(map[string]interface{}) bool { return rejecting.Load() })
+	clientID := "00:00:00:00:00:24"
+	gatewayState.SetClient(ClientInfo{ID: clientID, IP: ip})
+	origin := settingsOrigin{Actor: "alice", Source: settingsManual}
+
+	apply := func(threshold int) error {
+		t.Helper()
+		current, err := fetchDeviceSettings(ctx, ip)
+		if err != nil {
+			t.Fatal(err)
+		}
+		previous, err := mergeSettings(clientID, current, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		settings, err := mergeSettings(clientID, current, map[string]interface{}{"noise_threshold": threshold})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = applyDeviceSettings(ctx, db, ip, &previous, settings, origin)
+		return err
+	}
+	countChanges := func() int {
+		t.Helper()
+		changes, err := listSettingsChanges(db, clientID, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(changes)
+	}
+
+	if err := apply(55); err != nil {
+		t.Fatal(err)
+	}
+	changes, err := listSettingsChanges(db, clientID, 10)
+	if err != nil || len(changes) != 1 {
+		t.Fatalf("changes = %v, %v", changes, err)
+	}
+
+	// The device refuses an update and a revert, neither is recorded
+	rejecting.Store(true)
+	if err := apply(70); !errors.Is(err, errSettingsRejected) {
+		t.Errorf("rejected update: %v", err)
+	}
+	if _, err := revertSettingsChange(ctx, db, changes[0].ID, "alice"); !errors.Is(err, errSettingsRejected) {
+		t.Errorf("rejected revert: %v", err)
+	}
+	if n := countChanges(); n != 1 {
+		t.Errorf("%d changes after the rejected pushes, want 1", n)
+	}
+
+	rejecting.Store(false)
+	revert, err := revertSettingsChange(ctx, db, changes[0].ID, "alice")
+	if err != nil || revert.Source != settingsRevert || revert.RevertOf == nil || *revert.RevertOf != changes[0].ID {
+		t.Errorf("revert = %+v, %v", revert, err)
+	}
+	if n := countChanges(); n != 2 {
+		t.Errorf("%d changes after the revert, want 2", n)
+	}
+}
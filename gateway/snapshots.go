@@ -0,0 +1,268 @@
+// This file implements the snapshot archive. When a rule raises an alert the gateway pulls a JPEG from the
+// device's /capture endpoint, the same one the YOLO service uses, so every alert keeps its visual evidence.
+// Images are stored content-addressed under snapshotDir (the SHA-256 of the JPEG is its name), so identical
+// captures are stored once, and referenced from the events and alerts rows by that hash.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Snapshot archive settings
+const (
+	snapshotDir        = "snapshots"
+	snapshotTimeout    = 10 * time.Second
+	snapshotMaxSize    = 5 << 20 // bytes, the ESP32 camera produces far smaller images
+	snapshotThumbWidth = 160
+)
+
+var errSnapshotNotFound = errors.New("snapshot not found")
+
+var snapshotHashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// snapshotMu is held while a snapshot is stored or pruned, so pruning never deletes the files of a snapshot that was
+// just stored again
+var snapshotMu sync.Mutex
+
+// snapshotPath returns where the image with the given hash is stored, fanned out by the first two hex digits
+func snapshotPath(hash string, thumb bool) string {
+	name := hash + ".jpg"
+	if thumb {
+		name = hash + ".thumb.jpg"
+	}
+	return filepath.Join(snapshotDir, hash[:2], name)
+}
+
+// captureSnapshot fetches a JPEG from the device of an alert and links it to the alert and its event
+func captureSnapshot(db *sql.DB, clientID string, eventID int64, alertID int64) {
+	_clientData, ok := gatewayState.Client(clientID)
+	if !ok {
+		log.Printf("Error capturing snapshot: unknown client %s\n", clientID)
+		return
+	}
+
+	hash, err := fetchSnapshot(db, clientID, "http://"+_clientData.IP+"/capture")
+	if err != nil {
+		log.Printf("Error capturing snapshot from %s: %v\n", clientID, err)
+		return
+	}
+
+	if _, err := db.Exec("UPDATE alerts SET snapshot_hash = ? WHERE id = ?", hash, alertID); err != nil {
+		log.Printf("Error linking snapshot to alert %d: %v\n", alertID, err)
+	}
+	if eventID != 0 {
+		if _, err := db.Exec("UPDATE events SET snapshot_hash = ? WHERE id = ?", hash, eventID); err != nil {
+			log.Printf("Error linking snapshot to event %d: %v\n", eventID, err)
+		}
+	}
+}
+
+// fetchSnapshot downloads a JPEG and stores it in the archive, returning its hash
+func fetchSnapshot(db *sql.DB, clientID string, url string) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), snapshotTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := deviceClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, snapshotMaxSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > snapshotMaxSize {
+		return "", fmt.Errorf("snapshot is larger than %d bytes", snapshotMaxSize)
+	}
+	return storeSnapshot(db, clientID, data)
+}
+
+// storeSnapshot writes an image and its thumbnail to the archive unless it is already there
+func storeSnapshot(db *sql.DB, clientID string, data []byte) (string, error) {
+	img, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("not a JPEG image: %v", err)
+	}
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	now := time.Now().Unix()
+
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	if _, err := os.Stat(snapshotPath(hash, false)); errors.Is(err, os.ErrNotExist) {
+		if err := os.MkdirAll(filepath.Dir(snapshotPath(hash, false)), 0755); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(snapshotPath(hash, false), data); err != nil {
+			return "", err
+		}
+
+		var thumb bytes.Buffer
+		if err := jpeg.Encode(&thumb, thumbnail(img, snapshotThumbWidth), &jpeg.Options{Quality: 75}); err != nil {
+			return "", err
+		}
+		if err := writeFileAtomic(snapshotPath(hash, true), thumb.Bytes()); err != nil {
+			return "", err
+		}
+	} else if err != nil {
+		return "", err
+	}
+
+	bounds := img.Bounds()
+	_, err = db.Exec(
+		`INSERT INTO snapshots (hash, client_id, size, width, height, created_at, last_used_at) VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT (hash) DO UPDATE SET last_used_at = excluded.last_used_at`,
+		hash, clientID, len(data), bounds.Dx(), bounds.Dy(), now, now,
+	)
+	return hash, err
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a truncated image behind
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// thumbnail scales img down to width pixels by averaging the source pixels that fall into each target pixel
+func thumbnail(img image.Image, width int) image.Image {
+	bounds := img.Bounds()
+	if bounds.Dx() <= width {
+		return img
+	}
+	height := bounds.Dy() * width / bounds.Dx()
+	if height < 1 {
+		height = 1
+	}
+
+	thumb := image.NewRGBA(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		y0 := bounds.Min.Y + y*bounds.Dy()/height
+		y1 := bounds.Min.Y + (y+1)*bounds.Dy()/height
+		for x := 0; x < width; x++ {
+			x0 := bounds.Min.X + x*bounds.Dx()/width
+			x1 := bounds.Min.X + (x+1)*bounds.Dx()/width
+
+			var r, g, b, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					cr, cg, cb, _ := img.At(sx, sy).RGBA()
+					r, g, b, n = r+uint64(cr), g+uint64(cg), b+uint64(cb), n+1
+				}
+			}
+			thumb.Set(x, y, color.RGBA64{R: uint16(r / n), G: uint16(g / n), B: uint16(b / n), A: 0xffff})
+		}
+	}
+	return thumb
+}
+
+// openSnapshot opens the image or thumbnail with the given hash
+func openSnapshot(hash string, thumb bool) (*os.File, error) {
+	if !snapshotHashRegex.MatchString(hash) {
+		return nil, errSnapshotNotFound
+	}
+	file, err := os.Open(snapshotPath(hash, thumb))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, errSnapshotNotFound
+	}
+	return file, err
+}
+
+// pruneSnapshots deletes snapshots not used for longer than the configured retention and clears the references to them
+func pruneSnapshots(db *sql.DB) {
+	cutoff := time.Now().Add(-currentConfig().Snapshots.Retention).Unix()
+	rows, err := db.Query("SELECT hash FROM snapshots WHERE last_used_at < ?", cutoff)
+	if err != nil {
+		log.Printf("Error loading snapshots to prune: %v\n", err)
+		return
+	}
+	var hashes []string
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			log.Printf("Error loading snapshots to prune: %v\n", err)
+			break
+		}
+		hashes = append(hashes, hash)
+	}
+	rows.Close()
+
+	pruned := 0
+	for _, hash := range hashes {
+		ok, err := pruneSnapshot(db, hash, cutoff)
+		if err != nil {
+			log.Printf("Error deleting snapshot %s: %v\n", hash, err)
+		} else if ok {
+			pruned++
+		}
+	}
+	if pruned > 0 {
+		log.Printf("Pruned %d snapshots\n", pruned)
+	}
+}
+
+// pruneSnapshot deletes a snapshot and its files unless it was used again since cutoff, and reports whether it did
+func pruneSnapshot(db *sql.DB, hash string, cutoff int64) (bool, error) {
+	snapshotMu.Lock()
+	defer snapshotMu.Unlock()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("DELETE FROM snapshots WHERE hash = ? AND last_used_at < ?", hash, cutoff)
+	if err != nil {
+		return false, err
+	}
+	if n, err := result.RowsAffected(); err != nil || n == 0 {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE events SET snapshot_hash = NULL WHERE snapshot_hash = ?", hash); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec("UPDATE alerts SET snapshot_hash = NULL WHERE snapshot_hash = ?", hash); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	for _, thumb := range []bool{false, true} {
+		if err := os.Remove(snapshotPath(hash, thumb)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("Error deleting snapshot file %s: %v\n", snapshotPath(hash, thumb), err)
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,207 @@
+// This file holds the species table used to interpret verdicts of the YOLO backend. YOLO is trained on ImageNet,
+// whose labels are much finer than the species the edge model knows (red_fox, kit_fox and grey_fox are all a fox),
+// so every species lists the labels that map to it, the callback to run when it is confirmed and the confidence
+// YOLO must reach for that.
+
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// errSpeciesNotFound is returned when a species does not exist
+var errSpeciesNotFound = errors.New("species not found")
+
+// Species struct to hold a row of the species table together with its labels.
+// MinConfidence uses the same 0-100 scale as the edge model's predicted_confidence.
+type Species struct {
+	ID            int64    `json:"id"`
+	Name          string   `json:"name"`
+	Callback      string   `json:"callback"`
+	MinConfidence float64  `json:"min_confidence"`
+	Labels        []string `json:"labels"`
+}
+
+const speciesColumns = "id, name, callback, min_confidence"
+
+func scanSpecies(row scanner) (Species, error) {
+	var species Species
+	err := row.Scan(&species.ID, &species.Name, &species.Callback, &species.MinConfidence)
+	return species, err
+}
+
+// loadSpeciesLabels fills in the labels of a species
+func loadSpeciesLabels(db *sql.DB, species *Species) error {
+	rows, err := db.Query("SELECT label FROM species_labels WHERE species_id = ? ORDER BY label", species.ID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	species.Labels = []string{}
+	for rows.Next() {
+		var label string
+		if err := rows.Scan(&label); err != nil {
+			return err
+		}
+		species.Labels = append(species.Labels, label)
+	}
+	return rows.Err()
+}
+
+func loadSpecies(db *sql.DB) ([]Species, error) {
+	rows, err := db.Query("SELECT " + speciesColumns + " FROM species ORDER BY name")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []Species{}
+	for rows.Next() {
+		species, err := scanSpecies(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, species)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range list {
+		if err := loadSpeciesLabels(db, &list[i]); err != nil {
+			return nil, err
+		}
+	}
+	return list, nil
+}
+
+func getSpecies(db *sql.DB, id int64) (Species, error) {
+	species, err := scanSpecies(db.QueryRow("SELECT "+speciesColumns+" FROM species WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return species, errSpeciesNotFound
+	} else if err != nil {
+		return species, err
+	}
+	return species, loadSpeciesLabels(db, &species)
+}
+
+// lookupSpeciesByLabel returns the species a YOLO label maps to, or errSpeciesNotFound for labels nobody cares about
+func lookupSpeciesByLabel(db *sql.DB, label string) (Species, error) {
+	species, err := scanSpecies(db.QueryRow(
+		"SELECT s.id, s.name, s.callback, s.min_confidence FROM species s JOIN species_labels l ON l.species_id = s.id WHERE l.label = ?",
+		normalizeLabel(label),
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return species, errSpeciesNotFound
+	}
+	return species, err
+}
+
+// normalizeLabel makes label lookups case-insensitive, ImageNet mixes American_black_bear with brown_bear
+func normalizeLabel(label string) string {
+	return strings.ToLower(strings.TrimSpace(label))
+}
+
+// validateSpecies checks a species coming from the API
+func validateSpecies(db *sql.DB, species Species) error {
+	if species.Name == "" {
+		return fmt.Errorf("name is required")
+	}
+	if species.MinConfidence < 0 || species.MinConfidence > 100 {
+		return fmt.Errorf("min_confidence must be between 0 and 100")
+	}
+	if len(species.Labels) == 0 {
+		return fmt.Errorf("at least one label is required")
+	}
+	for _, label := range species.Labels {
+		if normalizeLabel(label) == "" {
+			return fmt.Errorf("labels must not be empty")
+		}
+		owner, err := lookupSpeciesByLabel(db, label)
+		if err == nil && owner.ID != species.ID {
+			return fmt.Errorf("label %s is already mapped to %s", label, owner.Name)
+		} else if err != nil && !errors.Is(err, errSpeciesNotFound) {
+			return err
+		}
+	}
+
+	exists, err := callbackExists(db, species.Callback)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("unknown callback: %s", species.Callback)
+	}
+	return nil
+}
+
+// replaceSpeciesLabels swaps the labels of a species inside tx
+func replaceSpeciesLabels(tx *sql.Tx, species Species) error {
+	if _, err := tx.Exec("DELETE FROM species_labels WHERE species_id = ?", species.ID); err != nil {
+		return err
+	}
+	for _, label := range species.Labels {
+		if _, err := tx.Exec("INSERT OR REPLACE INTO species_labels (label, species_id) VALUES (?, ?)", normalizeLabel(label), species.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func insertSpecies(db *sql.DB, species Species) (int64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("INSERT INTO species (name, callback, min_confidence) VALUES (?, ?, ?)", species.Name, species.Callback, species.MinConfidence)
+	if err != nil {
+		return 0, err
+	}
+	if species.ID, err = result.LastInsertId(); err != nil {
+		return 0, err
+	}
+	if err := replaceSpeciesLabels(tx, species); err != nil {
+		return 0, err
+	}
+	return species.ID, tx.Commit()
+}
+
+func updateSpecies(db *sql.DB, species Species) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE species SET name = ?, callback = ?, min_confidence = ? WHERE id = ?", species.Name, species.Callback, species.MinConfidence, species.ID)
+	if err := expectOneRow(result, err, errSpeciesNotFound); err != nil {
+		return err
+	}
+	if err := replaceSpeciesLabels(tx, species); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func deleteSpecies(db *sql.DB, id int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM species_labels WHERE species_id = ?", id); err != nil {
+		return err
+	}
+	result, err := tx.Exec("DELETE FROM species WHERE id = ?", id)
+	if err := expectOneRow(result, err, errSpeciesNotFound); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
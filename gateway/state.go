@@ -0,0 +1,51 @@
+// This file holds the in-memory state shared by the MQTT handler, the HTTP handlers, the health checks and the
+// callback goroutines. All access goes through GatewayState so it is synchronized; the database is the source of
+// truth and GatewayState only caches what the hot paths need.
+
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sync"
+)
+
+// sqliteBusyTimeout is how long, in milliseconds, a connection waits for a lock held by another goroutine
+// before SQLite gives up with "database is locked"
+const sqliteBusyTimeout = 5000
+
+// GatewayState is the concurrency-safe store of the registered clients
+type GatewayState struct {
+	mu      sync.RWMutex
+	clients map[string]ClientInfo
+}
+
+func newGatewayState() *GatewayState {
+	return &GatewayState{clients: make(map[string]ClientInfo)}
+}
+
+// gatewayState is shared by the whole gateway
+var gatewayState = newGatewayState()
+
+// Client returns the client with the given ID
+func (s *GatewayState) Client(clientID string) (ClientInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	client, ok := s.clients[clientID]
+	return client, ok
+}
+
+// SetClient adds or replaces a client
+func (s *GatewayState) SetClient(client ClientInfo) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.clients[client.ID] = client
+}
+
+// openDatabase opens the SQLite database. Many goroutines write to it at once, so connections wait for locks
+// instead of failing immediately. The write-ahead log lets long reads, such as exports, run without blocking writers.
+// Every transaction writes, so it takes the write lock when it begins: what it reads cannot change before it
+// commits, and it never fails to upgrade a read lock held while another connection writes.
+func openDatabase(path string) (*sql.DB, error) {
+	return sql.Open("sqlite3", fmt.Sprintf("%s?_busy_timeout=%d&_journal_mode=WAL&_txlock=immediate", path, sqliteBusyTimeout))
+}
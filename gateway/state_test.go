@@ -0,0 +1,176 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// newTestDB creates a database migrated to the latest schema in a temporary directory
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	db, err := openDatabase(filepath.Join(t.TempDir(), "gateway.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	if err := migrateUp(db, 0); err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+// quietLog discards the gateway's log output for the duration of a test
+func quietLog(t *testing.T) {
+	log.SetOutput(io.Discard)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+}
+
+func testMessage(t *testing.T, clientID string, event string, data map[string]interface{}) []byte {
+	t.Helper()
+	payload, err := json.Marshal(map[string]interface{}{
+		"client_id":       clientID,
+		"device_type":     "esp32",
+		"event":           event,
+		"local_timestamp": 1700000000,
+		"data":            data,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return payload
+}
+
+func TestGatewayStateConcurrentClients(t *testing.T) {
+	state := newGatewayState()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := fmt.Sprintf("client-%d", j%10)
+				state.SetClient(ClientInfo{ID: id, IP: fmt.Sprintf("10.0.0.%d", i), Type: "esp32"})
+				if client, ok := state.Client(id); !ok || client.ID != id {
+					t.Errorf("Client(%s) = %+v, %v", id, client, ok)
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for j := 0; j < 10; j++ {
+		if _, ok := state.Client(fmt.Sprintf("client-%d", j)); !ok {
+			t.Errorf("client-%d is missing", j)
+		}
+	}
+}
+
+// TestGatewayConcurrentDevices simulates many devices registering, sending telemetry and being health-checked at once.
+// Run it with -race.
+func TestGatewayConcurrentDevices(t *testing.T) {
+	quietLog(t)
+	db := newTestDB(t)
+
+	oldState := gatewayState
+	gatewayState = newGatewayState()
+	t.Cleanup(func() { gatewayState = oldState })
+
+	// Every other device answers its health checks
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unhealthy.Close()
+
+	const devices = 40
+	const messages = 5
+
+	deviceIP := func(i int) string {
+		if i%2 == 0 {
+			return strings.TrimPrefix(healthy.URL, "http://")
+		}
+		return strings.TrimPrefix(unhealthy.URL, "http://")
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < devices; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			clientID := fmt.Sprintf("00:00:00:00:00:%02x", i)
+			handleMessage(db, "uol/test", testMessage(t, clientID, "registration", map[string]interface{}{"ip": deviceIP(i)}))
+			for j := 0; j < messages; j++ {
+				handleMessage(db, "uol/test", testMessage(t, clientID, "telemetry", map[string]interface{}{"loudness": float64(j)}))
+			}
+		}(i)
+	}
+
+	// Health checks and readers run while the devices register
+	for i := 0; i < 3; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			checkClients(db)
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < devices; j++ {
+				gatewayState.Client(fmt.Sprintf("00:00:00:00:00:%02x", j))
+				if _, err := loadDevices(db); err != nil {
+					t.Error(err)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Every device went through at least one health check after registering
+	checkClients(db)
+
+	for i := 0; i < devices; i++ {
+		clientID := fmt.Sprintf("00:00:00:00:00:%02x", i)
+		client, ok := gatewayState.Client(clientID)
+		if !ok {
+			t.Errorf("%s is not registered", clientID)
+			continue
+		}
+		if client.IP != deviceIP(i) {
+			t.Errorf("%s has IP %s, want %s", clientID, client.IP, deviceIP(i))
+		}
+
+		device, err := getDevice(db, clientID)
+		if err != nil {
+			t.Errorf("getDevice(%s): %v", clientID, err)
+			continue
+		}
+		want := healthOnline
+		if i%2 == 1 {
+			want = healthDegraded
+		}
+		if device.HealthState != want && !(i%2 == 1 && device.HealthState == healthOffline) {
+			t.Errorf("%s is %s, want %s", clientID, device.HealthState, want)
+		}
+	}
+
+	var events int
+	if err := db.QueryRow("SELECT COUNT(*) FROM events").Scan(&events); err != nil {
+		t.Fatal(err)
+	}
+	if events != devices*messages {
+		t.Errorf("stored %d events, want %d", events, devices*messages)
+	}
+}
@@ -0,0 +1,61 @@
+// Shared by every page of the gateway: sends the CSRF token with jQuery requests, sends the browser to the login
+// form when the session ends, and shows the logged in user in the side menu.
+(function() {
+    function cookie(name) {
+        var match = document.cookie.match(new RegExp("(?:^|; )" + name + "=([^;]*)"));
+        return match ? decodeURIComponent(match[1]) : "";
+    }
+
+    $.ajaxSetup({
+        beforeSend: function(xhr) {
+            xhr.setRequestHeader("X-CSRF-Token", cookie("gateway_csrf"));
+        }
+    });
+
+    $(document).ajaxError(function(event, xhr) {
+        if (xhr.status === 401) {
+            window.location = "/login?next=" + encodeURIComponent(window.location.pathname);
+        }
+    });
+
+    $(function() {
+        $.getJSON("/_me", function(user) {
+            var menu = $("aside ul").first();
+            if (user.role === "admin") {
+                menu.append("<li class='mb-2'><a href='/users' class='hover:bg-green-700 px-4 py-2 rounded" + (window.location.pathname === "/users" ? " bg-green-700" : "") + "'>Users</a></li>");
+            }
+            var account = $("<div class='mt-6 text-sm'></div>");
+            account.append($("<div></div>").text(user.username + " (" + user.role + ")"));
+            var logout = $("<a href='#' class='underline'>Log out</a>");
+            logout.click(function(e) {
+                e.preventDefault();
+                $.post("/logout").always(function() {
+                    window.location = "/login";
+                });
+            });
+            var password = $("<a href='#' class='underline mr-2'>Change password</a>");
+            password.click(function(e) {
+                e.preventDefault();
+                var current = prompt("Current password");
+                var next = current && prompt("New password (at least 8 characters)");
+                if (next) {
+                    $.ajax({
+                        url: "/_me",
+                        type: "PUT",
+                        contentType: "application/json",
+                        data: JSON.stringify({current_password: current, password: next}),
+                        success: function() {
+                            alert("Password changed, your other sessions were logged out");
+                        },
+                        error: function(error) {
+                            alert("Error changing password: " + error.responseText);
+                        }
+                    });
+                }
+            });
+            account.append(password);
+            account.append(logout);
+            $("aside").append(account);
+        });
+    });
+})();
@@ -0,0 +1,171 @@
+// This file implements the yolo_post_classification callback. When the edge model is unsure about an intrusion,
+// the gateway asks the YOLO backend to classify a fresh snapshot of the camera (through the queue in
+// inference_queue.go), maps the ImageNet label it returns to a species (see species.go) and runs that species'
+// callback if YOLO is confident enough.
+// Every verdict is stored as a "yolo_verdict" event linked to the intrusion that triggered it.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// eventYoloVerdict is the event type of the stored verdicts
+const eventYoloVerdict = "yolo_verdict"
+
+// Verdict outcomes
+const (
+	verdictConfirmed      = "confirmed"       // species callback was run
+	verdictUnmapped       = "unmapped"        // the label does not belong to any species
+	verdictBelowThreshold = "below_threshold" // YOLO is less confident than the species requires
+	verdictOverruled      = "overruled"       // the edge model was more confident about a different species
+)
+
+// yoloVerdict is the data of a yolo_verdict event. Confidences use the 0-100 scale of the edge model.
+type yoloVerdict struct {
+	TopLabel       string  `json:"top_label"`
+	Confidence     float64 `json:"confidence"`
+	Species        string  `json:"species,omitempty"`
+	EdgeAnimal     string  `json:"edge_animal,omitempty"`
+	EdgeConfidence float64 `json:"edge_confidence,omitempty"`
+	AgreesWithEdge bool    `json:"agrees_with_edge"`
+	Callback       string  `json:"callback,omitempty"`
+	Outcome        string  `json:"outcome"`
+}
+
+// yoloResponse is the reply of the inference service, confidence is between 0 and 1
+type yoloResponse struct {
+	TopLabel   string  `json:"top_label"`
+	Confidence float64 `json:"confidence"`
+}
+
+func yolo_post_classification(ac *ActionContext) error {
+	_clientData, ok := gatewayState.Client(ac.ClientID)
+	if !ok {
+		return fmt.Errorf("unknown client %s", ac.ClientID)
+	}
+
+	// Recorded before the job exists, so the result the worker records cannot be overwritten
+	if ac.AlertID != 0 {
+		recordActionStatus(ac.DB, ac.AlertID, "yolo_post_classification", actionQueued, "")
+	}
+	job, err := inferenceQueue.Enqueue(ac, _clientData.IP)
+	if err != nil {
+		return err
+	}
+	if job.State == jobSucceeded {
+		// Merged into a job that already classified the same animal
+		return nil
+	}
+	log.Printf("Queued YOLO inference job %d for %s", job.ID, ac.ClientID)
+	return errActionQueued
+}
+
+// handleYoloPrediction stores the verdict on a YOLO prediction and runs the species callback if it is confirmed.
+// It returns the verdict outcome.
+func handleYoloPrediction(ac *ActionContext, prediction yoloResponse) (string, error) {
+	verdict, species, err := judgeYoloPrediction(ac.DB, prediction, ac.Data)
+	if err != nil {
+		return "", err
+	}
+	if err := saveYoloVerdict(ac.DB, ac.ClientID, ac.EventID, verdict); err != nil {
+		log.Printf("Error storing YOLO verdict for %s: %v\n", ac.ClientID, err)
+	}
+
+	if verdict.Outcome != verdictConfirmed {
+		log.Printf("YOLO verdict for %s: %s is %s, not escalating\n", ac.ClientID, prediction.TopLabel, verdict.Outcome)
+		return verdict.Outcome, nil
+	}
+
+	// The species callback runs on behalf of the same device, event and alert
+	return verdict.Outcome, executeCallback(ac, species.Callback)
+}
+
+// requestYoloInference asks the YOLO backend to classify a snapshot of the device at deviceIP
+func requestYoloInference(ctx context.Context, deviceIP string) (yoloResponse, error) {
+	var prediction yoloResponse
+
+	payloadBytes, err := json.Marshal(map[string]interface{}{"ip_address": deviceIP})
+	if err != nil {
+		return prediction, fmt.Errorf("error marshaling payload: %v", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, currentConfig().YOLO.URL, bytes.NewBuffer(payloadBytes))
+	if err != nil {
+		return prediction, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return prediction, fmt.Errorf("error invoking YOLO model: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return prediction, fmt.Errorf("YOLO model returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&prediction); err != nil {
+		return prediction, fmt.Errorf("error decoding YOLO response: %v", err)
+	}
+	return prediction, nil
+}
+
+// judgeYoloPrediction maps a YOLO label to a species and decides whether it is trustworthy.
+// data is the telemetry of the intrusion, which carries the edge model's predicted_animal and predicted_confidence.
+// YOLO only overrules the edge model on the species if it is at least as confident.
+func judgeYoloPrediction(db *sql.DB, prediction yoloResponse, data map[string]interface{}) (yoloVerdict, Species, error) {
+	verdict := yoloVerdict{
+		TopLabel:   prediction.TopLabel,
+		Confidence: prediction.Confidence * 100,
+	}
+	verdict.EdgeAnimal, _ = data["predicted_animal"].(string)
+	verdict.EdgeConfidence, _ = data["predicted_confidence"].(float64)
+
+	species, err := lookupSpeciesByLabel(db, prediction.TopLabel)
+	if errors.Is(err, errSpeciesNotFound) {
+		verdict.Outcome = verdictUnmapped
+		return verdict, species, nil
+	} else if err != nil {
+		return verdict, species, err
+	}
+
+	verdict.Species = species.Name
+	verdict.AgreesWithEdge = verdict.EdgeAnimal == "" || strings.EqualFold(verdict.EdgeAnimal, species.Name)
+	switch {
+	case verdict.Confidence < species.MinConfidence:
+		verdict.Outcome = verdictBelowThreshold
+	case !verdict.AgreesWithEdge && verdict.Confidence < verdict.EdgeConfidence:
+		verdict.Outcome = verdictOverruled
+	default:
+		verdict.Outcome = verdictConfirmed
+		verdict.Callback = species.Callback
+	}
+	return verdict, species, nil
+}
+
+// saveYoloVerdict stores a verdict as a yolo_verdict event linked to the intrusion event it classifies
+func saveYoloVerdict(db *sql.DB, clientID string, eventID int64, verdict yoloVerdict) error {
+	dataJSON, err := json.Marshal(verdict)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().Unix()
+	_, err = db.Exec(
+		"INSERT INTO events (client_id, type, local_timestamp, received_at, event, data, parent_event_id) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		clientID, "yolo", now, now, eventYoloVerdict, string(dataJSON), nullableID(eventID),
+	)
+	return err
+}